@@ -2,26 +2,166 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 )
 
 // ==================== КОНФИГУРАЦИЯ ИГРЫ ====================
 const (
-	START_HP          = 100
-	START_MANA        = 50
-	START_GOLD        = 100
-	MANA_REGEN        = 10
-	HEAL_BETWEEN_BOSS = 30
-	SERVER_PORT       = "8080"
+	START_HP           = 100
+	START_MANA         = 50
+	START_GOLD         = 100
+	MANA_REGEN         = 10
+	HEAL_BETWEEN_BOSS  = 30
+	BUFF_DURATION      = 3   // длительность баффа в раундах, если не задана способностью
+	DEFENSE_SCALE      = 50  // защита, при которой урон уменьшается вдвое
+	CRIT_PERCENT       = 150 // урон критического удара в процентах от обычного
+	MIN_DAMAGE         = 1
+	DEFAULT_DIFFICULTY = 80 // насколько охотно финальный босс подстраивается под игрока, 0-100
+	SERVER_PORT        = "8080"
+	PROTOCOL_VERSION   = 2 // версия 1 — сообщения без рукопожатия (3ver и ранние 4ver)
+	GAME_BUILD         = "4ver"
+	HANDSHAKE_TIMEOUT  = 10 * time.Second
+	TURN_TIMEOUT       = 60 * time.Second // время на ход в сетевом бою по умолчанию
+	AFK_LIMIT          = 3                // таймаутов подряд до технического поражения по умолчанию
+	HEARTBEAT_INTERVAL = 5 * time.Second
+	HEARTBEAT_TIMEOUT  = 20 * time.Second // молчание, после которого соединение считается мёртвым
+	WRITE_TIMEOUT      = 10 * time.Second // сколько отправка ждёт получателя, который не читает
+	SPECTATOR_TIMEOUT  = 3 * time.Second  // то же для зрителей: бой не должен ждать отстающих
+	LOBBY_WAIT_TIMEOUT = 2 * time.Minute  // сколько игрок ждёт соперника по вызову или в очереди
+	SHUTDOWN_TIMEOUT   = 30 * time.Second // сколько остановка сервера ждёт окончания боёв
+	RECONNECT_GRACE    = 60 * time.Second // сколько сервер держит место игрока после обрыва связи
+	RECONNECT_INTERVAL = 3 * time.Second
+	SAVE_VERSION       = 1
+	SAVE_DIR           = "saves"
+	SAVE_SLOTS         = 3
+	CONTENT_FILE       = "content.json"
+	MERCHANT_STOCK     = 2     // экземпляров каждого товара у торговца, если не задано в наборе
+	SELL_PERCENT       = 50    // доля цены, которую торговец платит за предметы игрока, если не задано
+	BUYBACK_LIMIT      = 5     // сколько последних проданных предметов можно выкупить
+	SUPPLY_STEP        = 10    // на сколько процентов дешевеет предмет за каждый проданный торговцу экземпляр
+	SUPPLY_MIN_PERCENT = 40    // ниже этой доли цены избыток товара не опускает
+	REPUTATION_STEP    = 2     // процентов скидки за каждую покупку у торговца
+	REPUTATION_MAX     = 20    // наибольшая скидка постоянному покупателю
+	CONFIRM_PRICE      = 150   // покупка от этой цены требует подтверждения
+	TLS_DIR            = "tls" // сертификат сервера и отпечатки знакомых серверов
+	TLS_CERT_YEARS     = 10
 )
 
+// GameSession — одна партия. Ей принадлежит единственный источник
+// случайности: зная зерно, партию можно повторить в точности. Через IO
+// партия общается с игроком, а Content задаёт её главы, предметы и врагов.
+type GameSession struct {
+	Seed    int64
+	Rand    *rand.Rand
+	IO      GameIO
+	Content *ContentPack
+	Config  Config
+
+	// Торговцы партии по ID: запас, цены и репутация переживают главы
+	Merchants map[string]*Merchant
+}
+
+func NewGameSession(ui GameIO, pack *ContentPack, seed int64) *GameSession {
+	return &GameSession{
+		Seed:      seed,
+		Rand:      rand.New(rand.NewSource(seed)),
+		IO:        ui,
+		Content:   pack,
+		Config:    defaultConfig(),
+		Merchants: make(map[string]*Merchant),
+	}
+}
+
+// Config — настройки из командной строки. Флаги разбирает только main,
+// остальной код читает настройки из сессии.
+type Config struct {
+	PlayerName  string
+	Difficulty  int
+	SaveSlot    int
+	Port        string
+	ServerAddr  string
+	TurnTimeout time.Duration
+	AFKLimit    int
+	TLS         bool
+	Password    string
+	Record      bool
+}
+
+// defaultConfig — настройки, когда флаги не заданы
+func defaultConfig() Config {
+	return Config{
+		Difficulty:  DEFAULT_DIFFICULTY,
+		ServerAddr:  ":" + SERVER_PORT,
+		TurnTimeout: TURN_TIMEOUT,
+		AFKLimit:    AFK_LIMIT,
+	}
+}
+
+// Reseed продолжает игру с нового зерна, взятого из текущей
+// последовательности, и возвращает его. Так сохранение или запись боя
+// можно повторить с того же места.
+func (g *GameSession) Reseed() int64 {
+	seed := g.Rand.Int63()
+	g.Rand.Seed(seed)
+	return seed
+}
+
+// newSeed возвращает зерно из флага -seed или, если оно не задано, случайное
+func newSeed() int64 {
+	if *seedFlag != 0 {
+		return *seedFlag
+	}
+	return time.Now().UnixNano()
+}
+
+var (
+	seedFlag     = flag.Int64("seed", 0, "зерно генератора случайных чисел для повторения партии, 0 — случайное")
+	playerName   = flag.String("name", "", "имя персонажа; если не задано, игра спросит")
+	difficulty   = flag.Int("difficulty", DEFAULT_DIFFICULTY, "насколько боссы подстраиваются под игрока, 0-100")
+	contentPath  = flag.String("content", CONTENT_FILE, "файл набора контента")
+	saveSlot     = flag.Int("slot", 0, fmt.Sprintf("слот сохранения кампании 1-%d: из него продолжается игра и в него она сохраняется", SAVE_SLOTS))
+	port         = flag.String("port", "", "порт сервера; заменяет порт в -addr и порт по умолчанию у клиента")
+	serverAddr   = flag.String("addr", ":"+SERVER_PORT, "адрес, на котором сервер принимает подключения")
+	turnTimeout  = flag.Duration("turn-timeout", TURN_TIMEOUT, "время на ход в сетевом бою")
+	afkLimit     = flag.Int("afk-limit", AFK_LIMIT, "пропущенных ходов подряд до технического поражения, 0 — без ограничения")
+	useTLS       = flag.Bool("tls", false, "шифровать сетевую игру; сервер при первом запуске создаст самоподписанный сертификат")
+	netPassword  = flag.String("password", "", "пароль закрытого сервера; клиенту — пароль для входа")
+	recordFights = flag.Bool("record", false, "записывать бои в папку "+REPLAY_DIR+" для просмотра")
+)
+
+// errTurnTimeout — игрок не успел выбрать действие за время хода
+var errTurnTimeout = errors.New("время хода истекло")
+
 // ==================== ТИПЫ ДАННЫХ ====================
 type BodyPart int
 
@@ -33,6 +173,9 @@ const (
 )
 
 func (bp BodyPart) String() string {
+	if bp < Head || bp > Legs {
+		return "ничего"
+	}
 	return []string{"голова", "торс", "руки", "ноги"}[bp]
 }
 
@@ -45,15 +188,230 @@ const (
 	Special
 )
 
+// EquipSlot — место на теле. Броня в слотах головы, торса, рук и ног
+// защищает только свою часть тела, в остальных слотах — всё тело.
+type EquipSlot int
+
+const (
+	SlotAuto EquipSlot = iota // по типу предмета: оружие в правую руку, броня на торс
+	SlotHelmet
+	SlotChest
+	SlotGauntlets
+	SlotGreaves
+	SlotMainHand
+	SlotOffHand
+	SlotAmulet
+	SlotRing
+)
+
+func (s EquipSlot) String() string {
+	if s < SlotHelmet || s > SlotRing {
+		return "неизвестно"
+	}
+	return []string{"голова", "торс", "руки", "ноги", "правая рука", "левая рука", "амулет", "кольцо"}[s-SlotHelmet]
+}
+
+// BodyPart возвращает часть тела, которую закрывает слот
+func (s EquipSlot) BodyPart() (BodyPart, bool) {
+	switch s {
+	case SlotHelmet:
+		return Head, true
+	case SlotChest:
+		return Torso, true
+	case SlotGauntlets:
+		return Arms, true
+	case SlotGreaves:
+		return Legs, true
+	}
+	return NoChoice, false
+}
+
+// Rarity — редкость предмета. Чем реже предмет, тем больше у него свойств.
+type Rarity int
+
+const (
+	Common Rarity = iota
+	Uncommon
+	Rare
+	Epic
+	Legendary
+)
+
+func (r Rarity) String() string {
+	if r < Common || r > Legendary {
+		return "неизвестно"
+	}
+	return []string{"Обычный", "Необычный", "Редкий", "Эпический", "Легендарный"}[r]
+}
+
+type AffixKind int
+
+const (
+	AffixAttack    AffixKind = iota
+	AffixDefense             // работает с любого надетого предмета
+	AffixHPOnHit             // HP за каждый попавший удар
+	AffixManaOnHit           // мана за каждый попавший удар
+	AffixLifesteal           // процент нанесённого урона, возвращаемый здоровьем
+	AffixCrit                // шанс критического удара в процентах
+)
+
+// EffectKind — вид действия особого предмета
+type EffectKind int
+
+const (
+	EffectCast   EffectKind = iota // применить способность Ability без затрат маны
+	EffectSmoke                    // противник пропускает Value раундов (по умолчанию один)
+	EffectRevive                   // при гибели вернуть Value% здоровья
+	EffectUnlock                   // открыть закрытую главу Chapter
+)
+
+// Affix — дополнительное свойство предмета
+type Affix struct {
+	Kind  AffixKind
+	Value int
+}
+
+func (a Affix) String() string {
+	switch a.Kind {
+	case AffixAttack:
+		return fmt.Sprintf("+%d к атаке", a.Value)
+	case AffixDefense:
+		return fmt.Sprintf("+%d к защите", a.Value)
+	case AffixHPOnHit:
+		return fmt.Sprintf("+%d HP за удар", a.Value)
+	case AffixManaOnHit:
+		return fmt.Sprintf("+%d маны за удар", a.Value)
+	case AffixLifesteal:
+		return fmt.Sprintf("вампиризм %d%%", a.Value)
+	case AffixCrit:
+		return fmt.Sprintf("шанс крита %d%%", a.Value)
+	}
+	return "неизвестное свойство"
+}
+
 type AbilityType int
 
 const (
 	DamageAbility AbilityType = iota
 	HealAbility
 	BuffAbility
+	CurseAbility
+)
+
+type StackRule int
+
+const (
+	StackRefresh   StackRule = iota // повторное наложение обновляет длительность
+	StackIntensity                  // добавляет стак (до MaxStacks) и обновляет длительность
+	StackIgnore                     // повторное наложение не действует
+)
+
+var (
+	itemTypeKeys    = []string{"weapon", "armor", "consumable", "special"}
+	abilityTypeKeys = []string{"damage", "heal", "buff", "curse"}
+	stackRuleKeys   = []string{"refresh", "intensity", "ignore"}
+	equipSlotKeys   = []string{"auto", "head", "chest", "arms", "legs", "main_hand", "off_hand", "amulet", "ring"}
+	rarityKeys      = []string{"common", "uncommon", "rare", "epic", "legendary"}
+	affixKindKeys   = []string{"attack", "defense", "hp_on_hit", "mana_on_hit", "lifesteal", "crit"}
+	effectKindKeys  = []string{"cast", "smoke", "revive", "unlock"}
 )
 
+func enumText(keys []string, value int, what string) ([]byte, error) {
+	if value < 0 || value >= len(keys) {
+		return nil, fmt.Errorf("неизвестный %s: %d", what, value)
+	}
+	return []byte(keys[value]), nil
+}
+
+func parseEnum(keys []string, text []byte, what string) (int, error) {
+	for i, key := range keys {
+		if key == string(text) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("неизвестный %s %q, допустимо: %s", what, text, strings.Join(keys, ", "))
+}
+
+func (t ItemType) MarshalText() ([]byte, error) {
+	return enumText(itemTypeKeys, int(t), "тип предмета")
+}
+
+func (t *ItemType) UnmarshalText(text []byte) error {
+	value, err := parseEnum(itemTypeKeys, text, "тип предмета")
+	*t = ItemType(value)
+	return err
+}
+
+func (t AbilityType) MarshalText() ([]byte, error) {
+	return enumText(abilityTypeKeys, int(t), "тип способности")
+}
+
+func (t *AbilityType) UnmarshalText(text []byte) error {
+	value, err := parseEnum(abilityTypeKeys, text, "тип способности")
+	*t = AbilityType(value)
+	return err
+}
+
+func (r StackRule) MarshalText() ([]byte, error) {
+	return enumText(stackRuleKeys, int(r), "режим наложения")
+}
+
+func (r *StackRule) UnmarshalText(text []byte) error {
+	value, err := parseEnum(stackRuleKeys, text, "режим наложения")
+	*r = StackRule(value)
+	return err
+}
+
+func (s EquipSlot) MarshalText() ([]byte, error) {
+	return enumText(equipSlotKeys, int(s), "слот")
+}
+
+func (s *EquipSlot) UnmarshalText(text []byte) error {
+	value, err := parseEnum(equipSlotKeys, text, "слот")
+	*s = EquipSlot(value)
+	return err
+}
+
+func (r Rarity) MarshalText() ([]byte, error) {
+	return enumText(rarityKeys, int(r), "уровень редкости")
+}
+
+func (r *Rarity) UnmarshalText(text []byte) error {
+	value, err := parseEnum(rarityKeys, text, "уровень редкости")
+	*r = Rarity(value)
+	return err
+}
+
+func (k AffixKind) MarshalText() ([]byte, error) {
+	return enumText(affixKindKeys, int(k), "тип свойства")
+}
+
+func (k *AffixKind) UnmarshalText(text []byte) error {
+	value, err := parseEnum(affixKindKeys, text, "тип свойства")
+	*k = AffixKind(value)
+	return err
+}
+
+func (k EffectKind) MarshalText() ([]byte, error) {
+	return enumText(effectKindKeys, int(k), "вид действия")
+}
+
+func (k *EffectKind) UnmarshalText(text []byte) error {
+	value, err := parseEnum(effectKindKeys, text, "вид действия")
+	*k = EffectKind(value)
+	return err
+}
+
 // ==================== СЕТЕВЫЕ ТИПЫ ====================
+// Правила совместимости протокола:
+//   - новые типы сообщений добавляются только в конец списка, существующие
+//     номера никогда не меняются и не переиспользуются;
+//   - получатель молча пропускает типы, которых не знает, поэтому новый
+//     необязательный тип не требует смены версии;
+//   - новые поля GameMessage можно добавлять свободно (gob их пропустит),
+//     а изменение смысла существующих полей или обязательный новый тип
+//     требуют увеличить PROTOCOL_VERSION;
+//   - стороны с разными версиями протокола не играют друг с другом.
 type GameMessageType int
 
 const (
@@ -62,6 +420,17 @@ const (
 	GameStateMsg
 	ChatMessage
 	Disconnect
+	ActionRejected
+	LobbyCommand
+	LobbyReply
+	LobbyNotice
+	MatchStart
+	MatchCancelled
+	MatchEnd
+	Hello
+	MatchResume
+	Heartbeat
+	TurnStart
 )
 
 type GameMessage struct {
@@ -73,7 +442,32 @@ type GameMessage struct {
 	AbilityID int
 	ItemID    int
 	Text      string
+	Sender    string
 	Player    *PlayerData
+	Opponent  *PlayerData
+	Round     int
+	Seconds   int
+	Result    *RoundResult
+	Hello     *HelloData
+	Matches   []MatchInfo
+}
+
+// MatchInfo — строка списка боёв для зрителей
+type MatchInfo struct {
+	ID         int
+	Players    [2]string
+	Round      int
+	Spectators int
+}
+
+// HelloData — первое сообщение каждой стороны соединения
+type HelloData struct {
+	Protocol    int
+	Build       string
+	ContentHash string
+	Session     string // токен сессии: выдаёт сервер, клиент возвращает при переподключении
+	Challenge   []byte // случайный вызов закрытого сервера
+	Proof       []byte // ответ клиента: HMAC пароля от вызова
 }
 
 type PlayerData struct {
@@ -87,10 +481,12 @@ type PlayerData struct {
 	Inventory    []Item
 	Equipment    []Item
 	Abilities    []Ability
+	Effects      StatusEffects
 }
 
 // ==================== СТРУКТУРЫ ДАННЫХ ====================
 type Ability struct {
+	ID          string
 	Name        string
 	Description string
 	Type        AbilityType
@@ -99,9 +495,29 @@ type Ability struct {
 	ManaCost    int
 	BuffAttack  int
 	BuffDefense int
+	Duration    int
+	Effect      *StatusEffect
+}
+
+type StatusEffect struct {
+	Name          string
+	Duration      int
+	Stacks        int
+	MaxStacks     int
+	Stacking      StackRule
+	AttackBonus   int
+	DefenseBonus  int
+	DamagePerTurn int
+	HealPerTurn   int
+	Shield        int
+	Stun          bool
+	Fresh         bool
 }
 
+type StatusEffects []StatusEffect
+
 type Item struct {
+	ID       string
 	Name     string
 	Type     ItemType
 	Attack   int
@@ -109,6 +525,67 @@ type Item struct {
 	PlusHP   int
 	PlusMana int
 	Price    int
+	Rarity   Rarity       `json:",omitempty"`
+	Affixes  []Affix      `json:",omitempty"`
+	Slot     EquipSlot    `json:",omitempty"`
+	Effects  []ItemEffect `json:",omitempty"` // действие особого предмета
+}
+
+// ItemEffect — действие особого предмета; что значат Ability, Chapter и
+// Value, зависит от вида Kind
+type ItemEffect struct {
+	Kind    EffectKind
+	Ability string `json:",omitempty"`
+	Chapter string `json:",omitempty"`
+	Value   int    `json:",omitempty"`
+}
+
+// Describe описывает действие для списков предметов. abilityName — имя
+// способности Ability, его знает только набор контента.
+func (e ItemEffect) Describe(abilityName string) string {
+	switch e.Kind {
+	case EffectCast:
+		return fmt.Sprintf("«%s» без маны", abilityName)
+	case EffectSmoke:
+		return fmt.Sprintf("противник пропускает раундов: %d", smokeRounds(e))
+	case EffectRevive:
+		return fmt.Sprintf("воскрешает с %d%% HP", e.Value)
+	case EffectUnlock:
+		return "открывает тайный путь"
+	}
+	return "неизвестное действие"
+}
+
+func smokeRounds(e ItemEffect) int {
+	if e.Value > 0 {
+		return e.Value
+	}
+	return 1
+}
+
+// UsableInBattle сообщает, есть ли смысл тратить на предмет ход: обереги
+// и ключи срабатывают сами, а в бою ничего не делают
+func (item Item) UsableInBattle() bool {
+	if item.Type != Special {
+		return true
+	}
+	for _, effect := range item.Effects {
+		if effect.Kind == EffectCast || effect.Kind == EffectSmoke {
+			return true
+		}
+	}
+	return false
+}
+
+// EquipSlot — слот, в который надевается предмет
+func (item Item) EquipSlot() EquipSlot {
+	switch {
+	case item.Slot != SlotAuto:
+		return item.Slot
+	case item.Type == Weapon:
+		return SlotMainHand
+	}
+	return SlotChest
 }
 
 type Character interface {
@@ -116,11 +593,13 @@ type Character interface {
 	GetHP() int
 	GetMana() int
 	GetStrength() int
+	GetDefense() int
+	DefenseAt(part BodyPart) int
 	SetHP(int)
 	SetMana(int)
-	Hit() BodyPart
-	Block() BodyPart
 	IsAlive() bool
+	GetAbilities() []Ability
+	GetEffects() *StatusEffects
 	UseAbility(ability Ability, target Character) string
 }
 
@@ -136,27 +615,177 @@ type Player struct {
 	Inventory    []Item
 	Equipment    []Item
 	Abilities    []Ability
-	ActiveBuffs  struct {
-		AttackBuff  int
-		DefenseBuff int
-	}
+	Effects      StatusEffects
 }
 
 type Enemy struct {
 	Name       string
 	HP         int
+	MaxHP      int
 	Mana       int
 	Strength   int
+	Defense    int
 	Loot       []Item
 	GoldDrop   int
 	Ability    Ability
 	DeathQuote string
+	Effects    StatusEffects
+	AI         EnemyAI
+	Tracker    *PatternTracker
+	Difficulty int
+	rng        *rand.Rand
 }
 
 type Merchant struct {
-	Name     string
-	Items    []Item
-	Dialogue string
+	ID          string
+	Name        string
+	Items       []Item
+	Dialogue    string   // приветствие при первой встрече
+	Lines       []string // реплики при следующих визитах, по кругу
+	Stock       []int    // сколько осталось каждого товара из Items
+	MaxStock    int      // до скольких пополняется запас между главами
+	SellPercent int
+	BuyBack     []SoldItem
+	Supply      map[string]int // сколько экземпляров каждого предмета продал игрок
+	Reputation  int            // число покупок игрока у этого торговца
+	Visits      int
+}
+
+// MerchantState — изменяемая часть торговца, которая попадает в сохранение
+type MerchantState struct {
+	Stock      []int
+	BuyBack    []SoldItem
+	Supply     map[string]int
+	Reputation int
+	Visits     int
+}
+
+// SoldItem — проданный торговцу предмет и цена, за которую его можно выкупить
+type SoldItem struct {
+	Item  Item
+	Price int
+}
+
+// ==================== ВВОД-ВЫВОД ====================
+// GameIO — единственная точка общения игры с пользователем. Терминальная
+// реализация работает с консолью, сценарная воспроизводит заранее заданный
+// ввод и копит вывод, что позволяет прогонять игру без человека.
+type GameIO interface {
+	ReadLine() (string, error)
+	Print(args ...interface{})
+	Printf(format string, args ...interface{})
+	Println(args ...interface{})
+}
+
+type TerminalIO struct {
+	mu     sync.Mutex
+	reader *bufio.Reader
+	out    io.Writer
+}
+
+// ScriptedIO отдаёт строки Inputs по порядку. Когда ввод заканчивается,
+// ReadLine возвращает ErrScriptExhausted, чтобы сценарий не зациклился в меню.
+type ScriptedIO struct {
+	mu     sync.Mutex
+	Inputs []string
+	pos    int
+	out    bytes.Buffer
+}
+
+var ErrScriptExhausted = errors.New("сценарий ввода закончился")
+
+// ErrInputClosed — стандартный ввод закрыт (Ctrl+D или конец файла при
+// запуске из скрипта). Игра, получив его, завершается.
+var ErrInputClosed = errors.New("ввод закончился")
+
+// isInputError отличает конец ввода от ошибок сети и файлов, о которых
+// игре достаточно сообщить и продолжить
+func isInputError(err error) bool {
+	return errors.Is(err, ErrInputClosed) || errors.Is(err, ErrScriptExhausted)
+}
+
+func NewTerminalIO(in io.Reader, out io.Writer) *TerminalIO {
+	return &TerminalIO{reader: bufio.NewReader(in), out: out}
+}
+
+func (t *TerminalIO) ReadLine() (string, error) {
+	line, err := t.reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", ErrInputClosed
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func (t *TerminalIO) Print(args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprint(t.out, args...)
+}
+
+func (t *TerminalIO) Printf(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.out, format, args...)
+}
+
+func (t *TerminalIO) Println(args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintln(t.out, args...)
+}
+
+func NewScriptedIO(inputs ...string) *ScriptedIO {
+	return &ScriptedIO{Inputs: inputs}
+}
+
+func (s *ScriptedIO) ReadLine() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pos >= len(s.Inputs) {
+		return "", ErrScriptExhausted
+	}
+	line := strings.TrimSpace(s.Inputs[s.pos])
+	s.pos++
+	fmt.Fprintln(&s.out, line)
+	return line, nil
+}
+
+func (s *ScriptedIO) Print(args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprint(&s.out, args...)
+}
+
+func (s *ScriptedIO) Printf(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(&s.out, format, args...)
+}
+
+func (s *ScriptedIO) Println(args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(&s.out, args...)
+}
+
+// Output возвращает весь накопленный вывод вместе с эхом ввода.
+func (s *ScriptedIO) Output() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.String()
+}
+
+// Remaining сообщает, сколько строк ввода ещё не прочитано.
+func (s *ScriptedIO) Remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Inputs) - s.pos
+}
+
+// confirm читает ответ на вопрос «(y/n)»; согласие — только «y»
+func confirm(ui GameIO) (bool, error) {
+	answer, err := ui.ReadLine()
+	return strings.ToLower(answer) == "y", err
 }
 
 // ==================== РЕАЛИЗАЦИЯ МЕТОДОВ ====================
@@ -173,7 +802,7 @@ func (p *Player) GetMana() int {
 }
 
 func (p *Player) GetStrength() int {
-	totalStrength := p.BaseStrength + p.ActiveBuffs.AttackBuff
+	totalStrength := p.BaseStrength + p.Effects.AttackBonus() + p.AffixTotal(AffixAttack)
 	for _, item := range p.Equipment {
 		if item.Type == Weapon {
 			totalStrength += item.Attack
@@ -182,6 +811,43 @@ func (p *Player) GetStrength() int {
 	return totalStrength
 }
 
+// GetDefense — средняя защита по частям тела. Ею закрываются от
+// способностей, которые не целят в конкретную часть.
+func (p *Player) GetDefense() int {
+	total := 0
+	for part := Head; part <= Legs; part++ {
+		total += p.DefenseAt(part)
+	}
+	return total / 4
+}
+
+// DefenseAt — защита части тела: броня этой части, щит, украшения и баффы
+func (p *Player) DefenseAt(part BodyPart) int {
+	totalDefense := p.Effects.DefenseBonus() + p.AffixTotal(AffixDefense)
+	for _, item := range p.Equipment {
+		if item.Type != Armor {
+			continue
+		}
+		if covered, ok := item.EquipSlot().BodyPart(); !ok || covered == part {
+			totalDefense += item.Defence
+		}
+	}
+	return totalDefense
+}
+
+// AffixTotal суммирует свойство kind по всей надетой экипировке
+func (p *Player) AffixTotal(kind AffixKind) int {
+	total := 0
+	for _, item := range p.Equipment {
+		for _, affix := range item.Affixes {
+			if affix.Kind == kind {
+				total += affix.Value
+			}
+		}
+	}
+	return total
+}
+
 func (p *Player) SetHP(hp int) {
 	p.HP = hp
 	if p.HP > p.MaxHP {
@@ -196,41 +862,24 @@ func (p *Player) SetMana(mana int) {
 	}
 }
 
-func (p *Player) Hit() BodyPart {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("\nВыберите часть тела для удара:")
-	fmt.Println("0 - голова")
-	fmt.Println("1 - торс")
-	fmt.Println("2 - руки")
-	fmt.Println("3 - ноги")
+// promptBodyPart спрашивает у игрока часть тела; purpose — «удара» или «защиты»
+func promptBodyPart(ui GameIO, purpose string) (BodyPart, error) {
+	ui.Printf("\nВыберите часть тела для %s:\n", purpose)
+	ui.Println("0 - голова")
+	ui.Println("1 - торс")
+	ui.Println("2 - руки")
+	ui.Println("3 - ноги")
 	for {
-		fmt.Print("Ваш выбор: ")
-		input, _ := reader.ReadString('\n')
-		input = strings.TrimSpace(input)
-		choice, err := strconv.Atoi(input)
-		if err == nil && choice >= 0 && choice <= 3 {
-			return BodyPart(choice)
+		ui.Print("Ваш выбор: ")
+		input, err := ui.ReadLine()
+		if err != nil {
+			return 0, err
 		}
-		fmt.Println("Неверный выбор! Введите число от 0 до 3")
-	}
-}
-
-func (p *Player) Block() BodyPart {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("\nВыберите часть тела для защиты:")
-	fmt.Println("0 - голова")
-	fmt.Println("1 - торс")
-	fmt.Println("2 - руки")
-	fmt.Println("3 - ноги")
-	for {
-		fmt.Print("Ваш выбор: ")
-		input, _ := reader.ReadString('\n')
-		input = strings.TrimSpace(input)
 		choice, err := strconv.Atoi(input)
 		if err == nil && choice >= 0 && choice <= 3 {
-			return BodyPart(choice)
+			return BodyPart(choice), nil
 		}
-		fmt.Println("Неверный выбор! Введите число от 0 до 3")
+		ui.Println("Неверный выбор! Введите число от 0 до 3")
 	}
 }
 
@@ -238,28 +887,20 @@ func (p *Player) IsAlive() bool {
 	return p.HP > 0
 }
 
+func (p *Player) GetAbilities() []Ability {
+	return p.Abilities
+}
+
+func (p *Player) GetEffects() *StatusEffects {
+	return &p.Effects
+}
+
 func (p *Player) UseAbility(ability Ability, target Character) string {
 	if p.Mana < ability.ManaCost {
 		return "Недостаточно маны!"
 	}
 	p.Mana -= ability.ManaCost
-	result := ""
-	switch ability.Type {
-	case DamageAbility:
-		damage := ability.Damage + p.GetStrength()/2
-		target.SetHP(target.GetHP() - damage)
-		result = fmt.Sprintf("%s использует %s и наносит %d урона!", p.Name, ability.Name, damage)
-	case HealAbility:
-		heal := ability.Heal
-		p.SetHP(p.HP + heal)
-		result = fmt.Sprintf("%s использует %s и восстанавливает %d HP!", p.Name, ability.Name, heal)
-	case BuffAbility:
-		p.ActiveBuffs.AttackBuff += ability.BuffAttack
-		p.ActiveBuffs.DefenseBuff += ability.BuffDefense
-		result = fmt.Sprintf("%s использует %s! Атака +%d, Защита +%d",
-			p.Name, ability.Name, ability.BuffAttack, ability.BuffDefense)
-	}
-	return result
+	return applyAbility(p, ability, target)
 }
 
 func (e *Enemy) GetName() string {
@@ -275,11 +916,23 @@ func (e *Enemy) GetMana() int {
 }
 
 func (e *Enemy) GetStrength() int {
-	return e.Strength
+	return e.Strength + e.Effects.AttackBonus()
+}
+
+func (e *Enemy) GetDefense() int {
+	return e.Defense + e.Effects.DefenseBonus()
+}
+
+// DefenseAt — у противников защита одинакова для всего тела
+func (e *Enemy) DefenseAt(part BodyPart) int {
+	return e.GetDefense()
 }
 
 func (e *Enemy) SetHP(hp int) {
 	e.HP = hp
+	if e.MaxHP > 0 && e.HP > e.MaxHP {
+		e.HP = e.MaxHP
+	}
 }
 
 func (e *Enemy) SetMana(mana int) {
@@ -287,1315 +940,5587 @@ func (e *Enemy) SetMana(mana int) {
 }
 
 func (e *Enemy) Hit() BodyPart {
-	return BodyPart(rand.Intn(4))
+	if e.Tracker != nil && e.rng.Intn(100) < e.Difficulty {
+		return e.Tracker.PredictOpening(e.rng)
+	}
+	return BodyPart(e.rng.Intn(4))
 }
 
 func (e *Enemy) Block() BodyPart {
-	return BodyPart(rand.Intn(4))
+	if e.Tracker != nil && e.rng.Intn(100) < e.Difficulty {
+		return e.Tracker.PredictTarget(e.rng)
+	}
+	return BodyPart(e.rng.Intn(4))
+}
+
+func (e *Enemy) Observe(action CombatAction) {
+	if e.Tracker != nil {
+		e.Tracker.Record(action)
+	}
 }
 
 func (e *Enemy) IsAlive() bool {
 	return e.HP > 0
 }
 
+func (e *Enemy) GetAbilities() []Ability {
+	if e.Ability.Name == "" {
+		return nil
+	}
+	return []Ability{e.Ability}
+}
+
+func (e *Enemy) GetEffects() *StatusEffects {
+	return &e.Effects
+}
+
 func (e *Enemy) UseAbility(ability Ability, target Character) string {
 	if e.Mana < ability.ManaCost {
 		return "У противника недостаточно маны!"
 	}
 	e.Mana -= ability.ManaCost
+	return applyAbility(e, ability, target)
+}
+
+func applyAbility(caster Character, ability Ability, target Character) string {
 	result := ""
 	switch ability.Type {
 	case DamageAbility:
-		damage := ability.Damage + e.Strength/2
-		target.SetHP(target.GetHP() - damage)
-		result = fmt.Sprintf("%s использует %s и наносит %d урона!", e.Name, ability.Name, damage)
+		damage := mitigateDamage(ability.Damage+caster.GetStrength()/2, target.GetDefense())
+		damage = applyDamage(target, damage)
+		result = fmt.Sprintf("%s использует %s и наносит %d урона!", caster.GetName(), ability.Name, damage)
 	case HealAbility:
 		heal := ability.Heal
-		e.SetHP(e.HP + heal)
-		result = fmt.Sprintf("%s использует %s и восстанавливает %d HP!", e.Name, ability.Name, heal)
+		caster.SetHP(caster.GetHP() + heal)
+		result = fmt.Sprintf("%s использует %s и восстанавливает %d HP!", caster.GetName(), ability.Name, heal)
 	case BuffAbility:
-		result = fmt.Sprintf("%s использует %s!", e.Name, ability.Name)
+		effect := abilityEffect(ability)
+		caster.GetEffects().Add(effect)
+		result = fmt.Sprintf("%s использует %s! %s на %d р.",
+			caster.GetName(), ability.Name, effect.Describe(), effect.Duration)
+	case CurseAbility:
+		result = fmt.Sprintf("%s использует %s!", caster.GetName(), ability.Name)
+		if ability.Damage > 0 {
+			damage := mitigateDamage(ability.Damage+caster.GetStrength()/2, target.GetDefense())
+			damage = applyDamage(target, damage)
+			result += fmt.Sprintf(" Урон: %d.", damage)
+		}
+		effect := abilityEffect(ability)
+		target.GetEffects().Add(effect)
+		result += fmt.Sprintf(" %s поражён эффектом «%s» на %d р.", target.GetName(), effect.Name, effect.Duration)
 	}
 	return result
 }
 
-// ==================== ИНВЕНТАРЬ И ЭКИПИРОВКА ====================
-func (p *Player) TakeOff(i int) {
-	if i < 0 || i >= len(p.Equipment) {
-		fmt.Println("Неверный индекс предмета!")
-		return
-	}
-	item := p.Equipment[i]
-	p.Equipment = append(p.Equipment[:i], p.Equipment[i+1:]...)
-	p.Inventory = append(p.Inventory, item)
-	fmt.Printf("Вы сняли: %s\n", item.Name)
+// ==================== ИИ ПРОТИВНИКА ====================
+type EnemyAI interface {
+	ChooseAction(self *Enemy, target Character) CombatAction
 }
 
-func (p *Player) Equip(i int) {
-	if i < 0 || i >= len(p.Inventory) {
-		fmt.Println("Неверный индекс предмета!")
-		return
-	}
-	item := p.Inventory[i]
-	if item.Type == Consumable {
-		p.SetHP(p.HP + item.PlusHP)
-		p.SetMana(p.Mana + item.PlusMana)
-		p.Inventory = append(p.Inventory[:i], p.Inventory[i+1:]...)
-		fmt.Printf("Вы использовали %s!", item.Name)
-		if item.PlusHP > 0 {
-			fmt.Printf(" Восстановлено %d HP!", item.PlusHP)
-		}
-		if item.PlusMana > 0 {
-			fmt.Printf(" Восстановлено %d маны!", item.PlusMana)
-		}
-		fmt.Println()
-		return
-	}
-	for _, equipped := range p.Equipment {
-		if equipped.Type == item.Type {
-			fmt.Printf("У вас уже экипирован предмет типа %s! Сначала снимите его.\n", getItemTypeName(item.Type))
-			return
-		}
+// RandomAI применяет способность с заданной вероятностью (в процентах).
+type RandomAI struct {
+	AbilityChance int
+}
+
+// AggressiveAI тратит ману при первой возможности и добивает слабую цель.
+type AggressiveAI struct{}
+
+// DefensiveAI бережёт ману: лечится ниже порога HP (в процентах),
+// защищается от усиленного игрока и атакует способностью только для добивания.
+type DefensiveAI struct {
+	HealThreshold int
+}
+
+func (e *Enemy) ChooseAction(target Character) CombatAction {
+	ai := e.AI
+	if ai == nil {
+		ai = RandomAI{}
 	}
-	p.Inventory = append(p.Inventory[:i], p.Inventory[i+1:]...)
-	p.Equipment = append(p.Equipment, item)
-	fmt.Printf("Вы экипировали: %s\n", item.Name)
+	return ai.ChooseAction(e, target)
 }
 
-func (p *Player) ShowInventory() {
-	fmt.Println("\n=== ИНВЕНТАРЬ ===")
-	fmt.Printf("Золото: %d\n", p.Gold)
-	if len(p.Inventory) == 0 {
-		fmt.Println("Инвентарь пуст")
-		return
+func (e *Enemy) canCast() bool {
+	return e.Ability.Name != "" && e.Mana >= e.Ability.ManaCost
+}
+
+func (e *Enemy) hpPercent() int {
+	if e.MaxHP <= 0 {
+		return 100
 	}
-	for i, item := range p.Inventory {
-		fmt.Printf("%d. %s", i, item.Name)
-		switch item.Type {
-		case Weapon:
-			fmt.Printf(" (Оружие, +%d к атаке)", item.Attack)
-		case Armor:
-			fmt.Printf(" (Броня, +%d к защите)", item.Defence)
-		case Consumable:
-			fmt.Printf(" (Расходник")
-			if item.PlusHP > 0 {
-				fmt.Printf(", +%d HP", item.PlusHP)
-			}
-			if item.PlusMana > 0 {
-				fmt.Printf(", +%d маны", item.PlusMana)
-			}
-			fmt.Printf(")")
+	return e.HP * 100 / e.MaxHP
+}
+
+func hasEffect(c Character, name string) bool {
+	for _, effect := range *c.GetEffects() {
+		if effect.Name == name {
+			return true
 		}
-		fmt.Println()
 	}
+	return false
 }
 
-func (p *Player) ShowEquipment() {
-	fmt.Println("\n=== ЭКИПИРОВКА ===")
-	if len(p.Equipment) == 0 {
-		fmt.Println("Нет экипированных предметов")
-		return
+func abilityWouldKill(caster Character, ability Ability, target Character) bool {
+	if ability.Type != DamageAbility && ability.Type != CurseAbility {
+		return false
 	}
-	for i, item := range p.Equipment {
-		fmt.Printf("%d. %s", i, item.Name)
-		switch item.Type {
-		case Weapon:
-			fmt.Printf(" (Оружие, +%d к атаке)", item.Attack)
-		case Armor:
-			fmt.Printf(" (Броня, +%d к защите)", item.Defence)
+	damage := mitigateDamage(ability.Damage+caster.GetStrength()/2, target.GetDefense())
+	return ability.Damage > 0 && damage >= target.GetHP()
+}
+
+// effectIsUseful сообщает, изменит ли повторное наложение эффекта способности что-нибудь.
+func effectIsUseful(ability Ability, holder Character) bool {
+	effect := abilityEffect(ability)
+	for _, current := range *holder.GetEffects() {
+		if current.Name != effect.Name {
+			continue
 		}
-		fmt.Println()
+		return current.Stacking == StackIntensity && current.Stacks < current.MaxStacks
 	}
+	return true
 }
 
-func (p *Player) ShowAbilities() {
-	fmt.Println("\n=== СПОСОБНОСТИ ===")
-	for i, ability := range p.Abilities {
-		fmt.Printf("%d. %s - %s (Стоимость маны: %d)\n",
-			i, ability.Name, ability.Description, ability.ManaCost)
+func (ai RandomAI) ChooseAction(self *Enemy, target Character) CombatAction {
+	if self.canCast() && self.rng.Intn(100) < ai.AbilityChance {
+		return abilityAction(0, self.Block())
 	}
+	return attackAction(self.Hit(), self.Block())
 }
 
-// ==================== ТОРГОВЛЯ ====================
-func (m *Merchant) ShowItems(player *Player) {
-	fmt.Printf("\n=== ЛАВКА %s ===\n", m.Name)
-	fmt.Println(m.Dialogue)
-	fmt.Printf("Ваше золото: %d\n", player.Gold)
-	for i, item := range m.Items {
-		fmt.Printf("%d. %s", i, item.Name)
-		switch item.Type {
-		case Weapon:
-			fmt.Printf(" (Оружие, +%d к атаке)", item.Attack)
-		case Armor:
-			fmt.Printf(" (Броня, +%d к защите)", item.Defence)
-		case Consumable:
-			fmt.Printf(" (Расходник")
-			if item.PlusHP > 0 {
-				fmt.Printf(", +%d HP", item.PlusHP)
-			}
-			if item.PlusMana > 0 {
-				fmt.Printf(", +%d маны", item.PlusMana)
-			}
-			fmt.Printf(")")
+func (ai AggressiveAI) ChooseAction(self *Enemy, target Character) CombatAction {
+	if self.canCast() {
+		ability := self.Ability
+		cast := false
+		switch ability.Type {
+		case DamageAbility:
+			cast = true
+		case CurseAbility:
+			cast = effectIsUseful(ability, target) || abilityWouldKill(self, ability, target)
+		case BuffAbility:
+			cast = effectIsUseful(ability, self)
+		case HealAbility:
+			cast = self.hpPercent() < 25
+		}
+		if cast {
+			return abilityAction(0, self.Block())
 		}
-		fmt.Printf(" - %d золота\n", item.Price)
 	}
+	return attackAction(self.Hit(), self.Block())
 }
 
-func (m *Merchant) BuyItem(player *Player, itemIndex int) {
-	if itemIndex < 0 || itemIndex >= len(m.Items) {
-		fmt.Println("Неверный индекс предмета!")
-		return
-	}
-	item := m.Items[itemIndex]
-	if player.Gold < item.Price {
-		fmt.Println("Недостаточно золота!")
-		return
+func (ai DefensiveAI) ChooseAction(self *Enemy, target Character) CombatAction {
+	if self.canCast() {
+		ability := self.Ability
+		threatened := self.hpPercent() < ai.HealThreshold || target.GetEffects().AttackBonus() > 0
+		cast := false
+		switch ability.Type {
+		case HealAbility:
+			cast = self.hpPercent() < ai.HealThreshold
+		case BuffAbility:
+			cast = threatened && effectIsUseful(ability, self)
+		case CurseAbility:
+			cast = threatened && effectIsUseful(ability, target)
+		case DamageAbility:
+			cast = abilityWouldKill(self, ability, target)
+		}
+		if cast {
+			return abilityAction(0, self.Block())
+		}
 	}
-	player.Gold -= item.Price
-	player.Inventory = append(player.Inventory, item)
-	fmt.Printf("Вы купили %s за %d золота!\n", item.Name, item.Price)
+	return attackAction(self.Hit(), self.Block())
 }
 
-// ==================== ВСПОМОГАТЕЛЬНЫЕ ФУНКЦИИ ====================
-func getItemTypeName(itemType ItemType) string {
-	return []string{"Оружие", "Броня", "Расходник", "Особый"}[itemType]
+// ==================== МОДЕЛЬ ИГРОКА ====================
+// PatternTracker копит статистику выбора игрока. Один трекер живёт всю
+// кампанию, так что боссы помнят привычки игрока из прошлых боёв.
+type PatternTracker struct {
+	HitCounts   [4]int
+	BlockCounts [4]int
 }
 
-func createGameItems() []Item {
-	return []Item{
-		{Name: "Змеиный клык", Type: Weapon, Attack: 18, Price: 125},
-		{Name: "Ненасытный ятаган", Type: Weapon, Attack: 23, Price: 177},
-		{Name: "Расколотое небо", Type: Weapon, Attack: 80, Price: 300},
-		{Name: "Костолом", Type: Weapon, Attack: 40, Price: 200},
-		{Name: "Танец смерти", Type: Weapon, Attack: 55, Price: 250},
-		{Name: "Шипованный доспех", Type: Armor, Defence: 10, Price: 125},
-		{Name: "Сияние пустоты", Type: Armor, Defence: 15, Price: 150},
-		{Name: "Броня метревеца", Type: Armor, Defence: 20, Price: 177},
-		{Name: "Облачение духов", Type: Armor, Defence: 30, Price: 200},
-		{Name: "Кровавая кольчуга господина", Type: Armor, Defence: 50, Price: 300},
-		{Name: "Малое зелье здоровья", Type: Consumable, PlusHP: 20, Price: 20},
-		{Name: "Большое зелье здоровья", Type: Consumable, PlusHP: 50, Price: 45},
-		{Name: "Эликсир жизни", Type: Consumable, PlusHP: 100, Price: 80},
-		{Name: "Малое зелье маны", Type: Consumable, PlusMana: 15, Price: 15},
-		{Name: "Большое зелье маны", Type: Consumable, PlusMana: 30, Price: 30},
+func (t *PatternTracker) Record(action CombatAction) {
+	if action.IsAttack() {
+		t.HitCounts[action.HitPart]++
 	}
+	t.BlockCounts[action.BlockPart]++
 }
 
-func createAbilities() []Ability {
-	return []Ability{
-		{Name: "Последний вздох", Description: "Подбрасывает врага и наносит 3 быстрых удара", Type: DamageAbility, Damage: 100, ManaCost: 80},
-		{Name: "Стальная буря", Description: "Делает выпал вперёд и наносит урон", Type: DamageAbility, Damage: 10, ManaCost: 5},
-		{Name: "Вестник заката", Description: "Бросает теневой клинок, который наносит урон", Type: DamageAbility, Damage: 25, ManaCost: 15},
-		{Name: "Клеймо смерти", Description: "Помечает врага меткой, которая наносит урон", Type: DamageAbility, Damage: 40, ManaCost: 20},
-		{Name: "Знак бури", Description: "Увеличивает атаку", Type: BuffAbility, BuffAttack: 10, ManaCost: 10},
-		{Name: "Храбрость", Description: "Увеличивает защиту", Type: BuffAbility, BuffDefense: 10, ManaCost: 10},
-		{Name: "Золотая эгида", Description: "Увеличивает атаку и защиту", Type: BuffAbility, BuffAttack: 15, BuffDefense: 15, ManaCost: 20},
-		{Name: "Исцеление", Description: "Восстанавливает здоровье", Type: HealAbility, Heal: 25, ManaCost: 15},
-		{Name: "Божественное исцеление", Description: "Сильное восстановление здоровья", Type: HealAbility, Heal: 40, ManaCost: 30},
+// PredictTarget выбирает, что защищать: чем чаще игрок бьёт в часть тела,
+// тем вероятнее её закроют.
+func (t *PatternTracker) PredictTarget(r *rand.Rand) BodyPart {
+	var weights [4]int
+	for i, count := range t.HitCounts {
+		weights[i] = count + 1
 	}
+	return weightedBodyPart(r, weights)
 }
 
-func getStartingInventory() []Item {
-	return []Item{
-		{Name: "Меч паладина", Type: Weapon, Attack: 5},
-		{Name: "Доспех паладина", Type: Armor, Defence: 5},
-		{Name: "Малое зелье здоровья", Type: Consumable, PlusHP: 20},
-		{Name: "Малое зелье маны", Type: Consumable, PlusMana: 15},
+// PredictOpening выбирает, куда бить: реже защищаемые части тела вероятнее.
+func (t *PatternTracker) PredictOpening(r *rand.Rand) BodyPart {
+	maxCount := 0
+	for _, count := range t.BlockCounts {
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+	var weights [4]int
+	for i, count := range t.BlockCounts {
+		weights[i] = maxCount - count + 1
 	}
+	return weightedBodyPart(r, weights)
 }
 
-func generateLoot() []Item {
-	allItems := createGameItems()
-	lootCount := rand.Intn(3) + 2
-	loot := make([]Item, lootCount)
-	for i := 0; i < lootCount; i++ {
-		loot[i] = allItems[rand.Intn(len(allItems))]
+func weightedBodyPart(r *rand.Rand, weights [4]int) BodyPart {
+	total := 0
+	for _, weight := range weights {
+		total += weight
 	}
-	return loot
+	roll := r.Intn(total)
+	for i, weight := range weights {
+		if roll < weight {
+			return BodyPart(i)
+		}
+		roll -= weight
+	}
+	return Legs
 }
 
-// ==================== ОДИНОЧНАЯ ИГРА ====================
-func fight(player Character, enemy Character) bool {
-	reader := bufio.NewReader(os.Stdin)
-	round := 1
-	for player.IsAlive() && enemy.IsAlive() {
-		fmt.Printf("\n=== РАУНД %d ===\n", round)
-		fmt.Printf("%s: %d HP, %d маны\n", player.GetName(), player.GetHP(), player.GetMana())
-		fmt.Printf("%s: %d HP, %d маны\n", enemy.GetName(), enemy.GetHP(), enemy.GetMana())
-
-		fmt.Println("\n--- Ваш ход ---")
-		fmt.Println("1 - Обычная атака")
-		fmt.Println("2 - Использовать способность")
-		fmt.Println("3 - Показать способности")
-
-		var playerHit, playerBlock BodyPart
-		var abilityUsed bool
-
-		for {
-			fmt.Print("Ваш выбор: ")
-			input, _ := reader.ReadString('\n')
-			input = strings.TrimSpace(input)
-
-			switch input {
-			case "1":
-				playerHit = player.Hit()
-				playerBlock = player.Block()
-				abilityUsed = false
-				break
-			case "2":
-				if p, ok := player.(*Player); ok {
-					p.ShowAbilities()
-					if len(p.Abilities) > 0 {
-						fmt.Print("Выберите способность: ")
-						abilityInput, _ := reader.ReadString('\n')
-						abilityInput = strings.TrimSpace(abilityInput)
-						if idx, err := strconv.Atoi(abilityInput); err == nil && idx >= 0 && idx < len(p.Abilities) {
-							result := player.UseAbility(p.Abilities[idx], enemy)
-							fmt.Println(result)
-						}
-					}
-				}
-				playerBlock = player.Block()
-				abilityUsed = true
-				break
-			case "3":
-				if p, ok := player.(*Player); ok {
-					p.ShowAbilities()
-				}
-				continue
-			default:
-				fmt.Println("Неверный выбор!")
-				continue
-			}
-			break
+// ==================== ИНВЕНТАРЬ И ЭКИПИРОВКА ====================
+// equippedAt возвращает индекс в Equipment предмета, надетого в слот
+func (p *Player) equippedAt(slot EquipSlot) (int, bool) {
+	for i, item := range p.Equipment {
+		if item.EquipSlot() == slot {
+			return i, true
 		}
+	}
+	return 0, false
+}
 
-		if !abilityUsed {
-			enemyHit := enemy.Hit()
-			enemyBlock := enemy.Block()
-
-			fmt.Printf("\n%s бьет в %s и защищает %s\n",
-				player.GetName(), playerHit, playerBlock)
-			fmt.Printf("%s бьет в %s и защищает %s\n",
-				enemy.GetName(), enemyHit, enemyBlock)
+func (p *Player) TakeOff(ui GameIO, slot EquipSlot) {
+	i, ok := p.equippedAt(slot)
+	if !ok {
+		ui.Println("В этом слоте ничего нет!")
+		return
+	}
+	item := p.Equipment[i]
+	p.Equipment = append(p.Equipment[:i], p.Equipment[i+1:]...)
+	p.Inventory = append(p.Inventory, item)
+	ui.Printf("Вы сняли: %s\n", item.Name)
+}
 
-			if playerHit != enemyBlock {
-				damage := player.GetStrength()
-				enemy.SetHP(enemy.GetHP() - damage)
-				fmt.Printf("%s наносит %d урона по %s!\n",
-					player.GetName(), damage, enemy.GetName())
-			} else {
-				fmt.Printf("%s блокирует удар в %s!\n",
-					enemy.GetName(), enemyBlock)
-			}
+func (p *Player) Equip(ui GameIO, pack *ContentPack, i int) {
+	ui.Println(p.UseItem(pack, i, nil))
+}
 
-			if enemyHit != playerBlock {
-				damage := enemy.GetStrength()
-				player.SetHP(player.GetHP() - damage)
-				fmt.Printf("%s наносит %d урона по %s!\n",
-					enemy.GetName(), damage, player.GetName())
-			} else {
-				fmt.Printf("%s блокирует удар в %s!\n",
-					player.GetName(), playerBlock)
-			}
+// UseItem применяет или надевает предмет из инвентаря. target — противник
+// в бою; вне боя nil, и особые предметы, которым нужна цель, не срабатывают.
+// Способности свитков берутся из набора pack.
+func (p *Player) UseItem(pack *ContentPack, i int, target Character) string {
+	if i < 0 || i >= len(p.Inventory) {
+		return "Неверный индекс предмета!"
+	}
+	item := p.Inventory[i]
+	if item.Type == Special {
+		return p.useSpecial(pack, i, target)
+	}
+	if item.Type == Consumable {
+		p.SetHP(p.HP + item.PlusHP)
+		p.SetMana(p.Mana + item.PlusMana)
+		p.Inventory = append(p.Inventory[:i], p.Inventory[i+1:]...)
+		result := fmt.Sprintf("%s использует %s!", p.Name, item.Name)
+		if item.PlusHP > 0 {
+			result += fmt.Sprintf(" Восстановлено %d HP!", item.PlusHP)
 		}
-
-		round++
-
-		if player.IsAlive() && enemy.IsAlive() {
-			fmt.Print("\nНажмите Enter для продолжения...")
-			reader.ReadString('\n')
+		if item.PlusMana > 0 {
+			result += fmt.Sprintf(" Восстановлено %d маны!", item.PlusMana)
 		}
+		return result
 	}
-
-	if player.IsAlive() {
-		if e, ok := enemy.(*Enemy); ok && e.DeathQuote != "" {
-			fmt.Printf("\n%s (хрипя): «%s»\n", e.Name, e.DeathQuote)
-		}
-		fmt.Printf("\n%s побеждает!\n", player.GetName())
-		return true
-	} else {
-		fmt.Printf("\n%s побеждает!\n", enemy.GetName())
-		return false
+	if item.Type != Weapon && item.Type != Armor {
+		return fmt.Sprintf("%s нельзя надеть!", item.Name)
+	}
+	slot := item.EquipSlot()
+	if j, ok := p.equippedAt(slot); ok {
+		return fmt.Sprintf("Слот «%s» занят: %s. Сначала снимите его.", slot, p.Equipment[j].Name)
 	}
+	p.Inventory = append(p.Inventory[:i], p.Inventory[i+1:]...)
+	p.Equipment = append(p.Equipment, item)
+	return fmt.Sprintf("%s экипирует: %s", p.Name, item.Name)
 }
 
-// ==================== PVP (ГОРЯЧИЙ СТУЛ) ====================
-func pvpFight(players []*Player) {
-	reader := bufio.NewReader(os.Stdin)
-	round := 1
-	fmt.Println("\n=== НАЧАЛО PVP БИТВЫ ===")
-	fmt.Printf("%s VS %s\n", players[0].Name, players[1].Name)
-	fmt.Println("Битва идет до полной победы одного из игроков!")
-	fmt.Print("Нажмите Enter чтобы начать...")
-	reader.ReadString('\n')
-
-	for players[0].IsAlive() && players[1].IsAlive() {
-		fmt.Printf("\n========== РАУНД %d ==========\n", round)
-		fmt.Printf("%s: %d HP, %d маны | %s: %d HP, %d маны\n",
-			players[0].Name, players[0].HP, players[0].Mana,
-			players[1].Name, players[1].HP, players[1].Mana)
+func (p *Player) ShowInventory(ui GameIO, pack *ContentPack) {
+	ui.Println("\n=== ИНВЕНТАРЬ ===")
+	ui.Printf("Золото: %d\n", p.Gold)
+	if len(p.Inventory) == 0 {
+		ui.Println("Инвентарь пуст")
+		return
+	}
+	for i, item := range p.Inventory {
+		ui.Printf("%d. %s%s\n", i, item.Name, itemDetails(pack, item))
+	}
+}
 
-		// Ход первого игрока
-		fmt.Printf("\n--- Ход %s ---\n", players[0].Name)
-		fmt.Println("1 - Обычная атака")
-		fmt.Println("2 - Использовать способность")
-		fmt.Println("3 - Показать способности")
-		fmt.Println("4 - Показать инвентарь")
-		fmt.Println("5 - Использовать предмет")
-		fmt.Println("6 - Отправить сообщение в чат")
+func (p *Player) ShowEquipment(ui GameIO, pack *ContentPack) {
+	ui.Println("\n=== ЭКИПИРОВКА ===")
+	for slot := SlotHelmet; slot <= SlotRing; slot++ {
+		if i, ok := p.equippedAt(slot); ok {
+			item := p.Equipment[i]
+			ui.Printf("%d. %s: %s%s\n", slot, slot, item.Name, itemDetails(pack, item))
+		} else {
+			ui.Printf("%d. %s: —\n", slot, slot)
+		}
+	}
+	ui.Printf("Итого: атака %d, защита: голова %d, торс %d, руки %d, ноги %d\n", p.GetStrength(),
+		p.DefenseAt(Head), p.DefenseAt(Torso), p.DefenseAt(Arms), p.DefenseAt(Legs))
+}
 
-		var player0Hit, player0Block BodyPart
-		var player0AbilityUsed bool
+func (p *Player) ShowAbilities(ui GameIO) {
+	ui.Println("\n=== СПОСОБНОСТИ ===")
+	for i, ability := range p.Abilities {
+		ui.Printf("%d. %s - %s (Стоимость маны: %d)\n",
+			i, ability.Name, ability.Description, ability.ManaCost)
+	}
+}
 
-		for {
-			fmt.Printf("%s, ваш выбор: ", players[0].Name)
-			input, _ := reader.ReadString('\n')
-			input = strings.TrimSpace(input)
-
-			switch input {
-			case "1":
-				fmt.Printf("\n%s, выберите куда атаковать:\n", players[0].Name)
-				player0Hit = players[0].Hit()
-				fmt.Printf("\n%s, выберите что защищать:\n", players[0].Name)
-				player0Block = players[0].Block()
-				player0AbilityUsed = false
-				break
-			case "2":
-				players[0].ShowAbilities()
-				if len(players[0].Abilities) > 0 {
-					fmt.Print("Выберите способность: ")
-					abilityInput, _ := reader.ReadString('\n')
-					abilityInput = strings.TrimSpace(abilityInput)
-					if idx, err := strconv.Atoi(abilityInput); err == nil && idx >= 0 && idx < len(players[0].Abilities) {
-						if players[0].Mana >= players[0].Abilities[idx].ManaCost {
-							result := players[0].UseAbility(players[0].Abilities[idx], players[1])
-							fmt.Println(result)
-							player0AbilityUsed = true
-						} else {
-							fmt.Println("Недостаточно маны!")
-							continue
-						}
-					}
-				}
-				if !player0AbilityUsed {
-					fmt.Printf("\n%s, выберите что защищать:\n", players[0].Name)
-					player0Block = players[0].Block()
-				}
-				break
-			case "3":
-				players[0].ShowAbilities()
-				continue
-			case "4":
-				players[0].ShowInventory()
+// ==================== ОСОБЫЕ ПРЕДМЕТЫ ====================
+// useSpecial выполняет действия особого предмета. Предмет расходуется,
+// если сработало хотя бы одно действие; ключи и обереги срабатывают сами.
+// Способность свитка ищется в наборе pack той партии, где идёт бой.
+func (p *Player) useSpecial(pack *ContentPack, i int, target Character) string {
+	item := p.Inventory[i]
+	var results []string
+	used := false
+	for _, effect := range item.Effects {
+		switch effect.Kind {
+		case EffectCast, EffectSmoke:
+			if target == nil {
+				results = append(results, fmt.Sprintf("%s можно использовать только в бою.", item.Name))
 				continue
-			case "5":
-				players[0].ShowInventory()
-				if len(players[0].Inventory) > 0 {
-					fmt.Print("Введите номер предмета: ")
-					itemInput, _ := reader.ReadString('\n')
-					itemInput = strings.TrimSpace(itemInput)
-					if idx, err := strconv.Atoi(itemInput); err == nil {
-						players[0].Equip(idx)
-					}
+			}
+			if effect.Kind == EffectCast {
+				ability, ok := pack.abilities[effect.Ability]
+				if !ok {
+					results = append(results, fmt.Sprintf("Способность %q свитка неизвестна в этом наборе контента.", effect.Ability))
+					continue
 				}
-				fmt.Printf("\n%s, выберите что защищать:\n", players[0].Name)
-				player0Block = players[0].Block()
-				player0AbilityUsed = false
-				break
-			case "6":
-				fmt.Print("Введите сообщение: ")
-				msg, _ := reader.ReadString('\n')
-				msg = strings.TrimSpace(msg)
-				fmt.Printf("%s: %s\n", players[0].Name, msg)
-				continue
-			default:
-				fmt.Println("Неверный выбор!")
+				used = true
+				results = append(results, applyAbility(p, ability, target))
 				continue
 			}
-			break
+			used = true
+			rounds := smokeRounds(effect)
+			target.GetEffects().Add(StatusEffect{Name: item.Name, Duration: rounds, Stacking: StackIgnore, Stun: true})
+			results = append(results, fmt.Sprintf("%s скрывается в дыму — %s теряет раундов: %d!", p.Name, target.GetName(), rounds))
+		case EffectRevive:
+			results = append(results, fmt.Sprintf("%s сработает сам, если вы погибнете.", item.Name))
+		case EffectUnlock:
+			results = append(results, fmt.Sprintf("%s пригодится у запертой двери.", item.Name))
 		}
+	}
+	if !used {
+		return strings.Join(results, " ")
+	}
+	p.Inventory = append(p.Inventory[:i], p.Inventory[i+1:]...)
+	return fmt.Sprintf("%s использует %s! %s", p.Name, item.Name, strings.Join(results, " "))
+}
 
-		fmt.Print("\nНажмите Enter для передачи хода второму игроку...")
-		reader.ReadString('\n')
-
-		// Ход второго игрока
-		fmt.Printf("\n--- Ход %s ---\n", players[1].Name)
-		fmt.Println("1 - Обычная атака")
-		fmt.Println("2 - Использовать способность")
-		fmt.Println("3 - Показать способности")
-		fmt.Println("4 - Показать инвентарь")
-		fmt.Println("5 - Использовать предмет")
-		fmt.Println("6 - Отправить сообщение в чат")
-
-		var player1Hit, player1Block BodyPart
-		var player1AbilityUsed bool
-
-		for {
-			fmt.Printf("%s, ваш выбор: ", players[1].Name)
-			input, _ := reader.ReadString('\n')
-			input = strings.TrimSpace(input)
-
-			switch input {
-			case "1":
-				fmt.Printf("\n%s, выберите куда атаковать:\n", players[1].Name)
-				player1Hit = players[1].Hit()
-				fmt.Printf("\n%s, выберите что защищать:\n", players[1].Name)
-				player1Block = players[1].Block()
-				player1AbilityUsed = false
-				break
-			case "2":
-				players[1].ShowAbilities()
-				if len(players[1].Abilities) > 0 {
-					fmt.Print("Выберите способность: ")
-					abilityInput, _ := reader.ReadString('\n')
-					abilityInput = strings.TrimSpace(abilityInput)
-					if idx, err := strconv.Atoi(abilityInput); err == nil && idx >= 0 && idx < len(players[1].Abilities) {
-						if players[1].Mana >= players[1].Abilities[idx].ManaCost {
-							result := players[1].UseAbility(players[1].Abilities[idx], players[0])
-							fmt.Println(result)
-							player1AbilityUsed = true
-						} else {
-							fmt.Println("Недостаточно маны!")
-							continue
-						}
-					}
-				}
-				if !player1AbilityUsed {
-					fmt.Printf("\n%s, выберите что защищать:\n", players[1].Name)
-					player1Block = players[1].Block()
-				}
-				break
-			case "3":
-				players[1].ShowAbilities()
-				continue
-			case "4":
-				players[1].ShowInventory()
-				continue
-			case "5":
-				players[1].ShowInventory()
-				if len(players[1].Inventory) > 0 {
-					fmt.Print("Введите номер предмета: ")
-					itemInput, _ := reader.ReadString('\n')
-					itemInput = strings.TrimSpace(itemInput)
-					if idx, err := strconv.Atoi(itemInput); err == nil {
-						players[1].Equip(idx)
-					}
-				}
-				fmt.Printf("\n%s, выберите что защищать:\n", players[1].Name)
-				player1Block = players[1].Block()
-				player1AbilityUsed = false
-				break
-			case "6":
-				fmt.Print("Введите сообщение: ")
-				msg, _ := reader.ReadString('\n')
-				msg = strings.TrimSpace(msg)
-				fmt.Printf("%s: %s\n", players[1].Name, msg)
-				continue
-			default:
-				fmt.Println("Неверный выбор!")
-				continue
+// findEffect ищет в инвентаре предмет с действием kind; для ключей
+// chapter задаёт главу
+func (p *Player) findEffect(kind EffectKind, chapter string) (int, ItemEffect, bool) {
+	for i, item := range p.Inventory {
+		for _, effect := range item.Effects {
+			if effect.Kind == kind && effect.Chapter == chapter {
+				return i, effect, true
 			}
-			break
 		}
+	}
+	return 0, ItemEffect{}, false
+}
 
-		// Обработка хода
-		fmt.Println("\n========== РЕЗУЛЬТАТЫ ХОДА ==========")
+// tryRevive тратит оберег из инвентаря, чтобы вернуть павшего игрока
+func (p *Player) tryRevive() string {
+	i, effect, ok := p.findEffect(EffectRevive, "")
+	if !ok {
+		return ""
+	}
+	item := p.Inventory[i]
+	p.Inventory = append(p.Inventory[:i], p.Inventory[i+1:]...)
+	hp := p.MaxHP * effect.Value / 100
+	if hp < 1 {
+		hp = 1
+	}
+	p.HP = 0
+	p.SetHP(hp)
+	return fmt.Sprintf("✨ %s рассыпается в прах, и %s возвращается к жизни с %d HP!", item.Name, p.Name, p.HP)
+}
 
-		if !player0AbilityUsed {
-			fmt.Printf("\n%s атакует %s в %s\n", players[0].Name, players[1].Name, player0Hit)
-			fmt.Printf("%s защищает %s\n", players[1].Name, player1Block)
+// openChapter решает, попадёт ли игрок в закрытую главу: нужен ключ,
+// который при этом расходуется
+func openChapter(ui GameIO, player *Player, chapter Chapter) (bool, error) {
+	i, _, ok := player.findEffect(EffectUnlock, chapter.ID)
+	if !ok {
+		ui.Println("\nВы проходите мимо запертой двери. Может быть, где-то найдётся ключ...")
+		return false, nil
+	}
+	key := player.Inventory[i]
+	ui.Printf("\nПеред вами запертая дверь. Открыть её (%s)? (y/n): ", key.Name)
+	if ok, err := confirm(ui); !ok {
+		return false, err
+	}
+	player.Inventory = append(player.Inventory[:i], player.Inventory[i+1:]...)
+	ui.Printf("%s со скрежетом поворачивается в замке.\n", key.Name)
+	return true, nil
+}
 
-			if player0Hit != player1Block {
-				damage := players[0].GetStrength()
-				players[1].SetHP(players[1].GetHP() - damage)
-				fmt.Printf("💥 Удар достиг цели! %s наносит %d урона %s!\n",
-					players[0].Name, damage, players[1].Name)
-			} else {
-				fmt.Printf("🛡️ %s блокирует удар в %s!\n", players[1].Name, player1Block)
-			}
+// ==================== ТОРГОВЛЯ ====================
+// itemDetails — краткое описание свойств предмета в скобках, а за ним
+// редкость и дополнительные свойства. Имена способностей свитков берутся
+// из набора pack.
+func itemDetails(pack *ContentPack, item Item) string {
+	var details string
+	switch item.Type {
+	case Weapon:
+		details = fmt.Sprintf(" (Оружие, +%d к атаке)", item.Attack)
+		if item.EquipSlot() == SlotOffHand {
+			details = fmt.Sprintf(" (Оружие, левая рука, +%d к атаке)", item.Attack)
 		}
-
-		if !player1AbilityUsed {
-			fmt.Printf("\n%s атакует %s в %s\n", players[1].Name, players[0].Name, player1Hit)
-			fmt.Printf("%s защищает %s\n", players[0].Name, player0Block)
-
-			if player1Hit != player0Block {
-				damage := players[1].GetStrength()
-				players[0].SetHP(players[0].GetHP() - damage)
-				fmt.Printf("💥 Удар достиг цели! %s наносит %d урона %s!\n",
-					players[1].Name, damage, players[0].Name)
-			} else {
-				fmt.Printf("🛡️ %s блокирует удар в %s!\n", players[0].Name, player0Block)
+	case Armor:
+		kind := "Броня"
+		switch item.EquipSlot() {
+		case SlotOffHand:
+			kind = "Щит"
+		case SlotAmulet, SlotRing:
+			kind = "Украшение"
+		}
+		details = fmt.Sprintf(" (%s, %s", kind, item.EquipSlot())
+		if item.Defence > 0 {
+			details += fmt.Sprintf(", +%d к защите", item.Defence)
+		}
+		details += ")"
+	case Special:
+		effects := make([]string, len(item.Effects))
+		for i, effect := range item.Effects {
+			name := effect.Ability
+			if ability, ok := pack.abilities[effect.Ability]; ok {
+				name = ability.Name
 			}
+			effects[i] = effect.Describe(name)
 		}
+		details = fmt.Sprintf(" (%s: %s)", getItemTypeName(item.Type), strings.Join(effects, ", "))
+	case Consumable:
+		details = " (Расходник"
+		if item.PlusHP > 0 {
+			details += fmt.Sprintf(", +%d HP", item.PlusHP)
+		}
+		if item.PlusMana > 0 {
+			details += fmt.Sprintf(", +%d маны", item.PlusMana)
+		}
+		details += ")"
+	}
+	if item.Rarity == Common && len(item.Affixes) == 0 {
+		return details
+	}
+	affixes := make([]string, len(item.Affixes))
+	for i, affix := range item.Affixes {
+		affixes[i] = affix.String()
+	}
+	if len(affixes) == 0 {
+		return fmt.Sprintf("%s [%s]", details, item.Rarity)
+	}
+	return fmt.Sprintf("%s [%s: %s]", details, item.Rarity, strings.Join(affixes, ", "))
+}
 
-		fmt.Printf("\n--- ИТОГИ РАУНДА %d ---\n", round)
-		fmt.Printf("%s: %d HP | %s: %d HP\n",
-			players[0].Name, players[0].HP,
-			players[1].Name, players[1].HP)
-
-		round++
+// Greet приветствует игрока: при первой встрече — Dialogue, потом — Lines по кругу
+func (m *Merchant) Greet(ui GameIO) {
+	m.Visits++
+	if m.Visits == 1 || len(m.Lines) == 0 {
+		ui.Printf("%s: «%s»\n", m.Name, m.Dialogue)
+		return
+	}
+	ui.Printf("%s: «%s»\n", m.Name, m.Lines[(m.Visits-2)%len(m.Lines)])
+}
 
-		if players[0].IsAlive() && players[1].IsAlive() {
-			fmt.Print("\nНажмите Enter для следующего раунда...")
-			reader.ReadString('\n')
-		}
+// supplyPercent — доля цены предмета, когда у торговца скопилось supply
+// проданных игроком экземпляров: чем больше избыток, тем дешевле товар
+func supplyPercent(supply int) int {
+	percent := 100 - supply*SUPPLY_STEP
+	if percent < SUPPLY_MIN_PERCENT {
+		percent = SUPPLY_MIN_PERCENT
 	}
+	return percent
+}
 
-	fmt.Println("\n========== БИТВА ЗАВЕРШЕНА ==========")
-	if players[0].IsAlive() {
-		fmt.Printf("\n🏆 %s ПОБЕЖДАЕТ В PVP БИТВЕ! 🏆\n", players[0].Name)
-		fmt.Printf("%s повержен!\n", players[1].Name)
-	} else {
-		fmt.Printf("\n🏆 %s ПОБЕЖДАЕТ В PVP БИТВЕ! 🏆\n", players[1].Name)
-		fmt.Printf("%s повержен!\n", players[0].Name)
+// Discount — скидка постоянному покупателю в процентах
+func (m *Merchant) Discount() int {
+	discount := m.Reputation * REPUTATION_STEP
+	if discount > REPUTATION_MAX {
+		discount = REPUTATION_MAX
 	}
+	return discount
 }
 
-func createPlayer(index int) *Player {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("Введите имя %d-го игрока: ", index)
-	name, _ := reader.ReadString('\n')
-	name = strings.TrimSpace(name)
-	return &Player{
-		Name:         name,
-		HP:           START_HP,
-		MaxHP:        START_HP,
-		Mana:         START_MANA,
-		MaxMana:      START_MANA,
-		BaseStrength: 10,
-		Strength:     10,
-		Gold:         START_GOLD,
-		Inventory:    getStartingInventory(),
-		Equipment:    []Item{},
-		Abilities:    []Ability{},
+// BuyPrice — сколько торговец просит за предмет
+func (m *Merchant) BuyPrice(item Item) int {
+	return item.Price * supplyPercent(m.Supply[item.ID]) * (100 - m.Discount()) / 10000
+}
+
+// changeSupply учитывает проданные (delta > 0) или купленные (delta < 0) экземпляры
+func (m *Merchant) changeSupply(item Item, delta int) {
+	if m.Supply == nil {
+		m.Supply = make(map[string]int)
+	}
+	m.Supply[item.ID] += delta
+	if m.Supply[item.ID] <= 0 {
+		delete(m.Supply, item.ID)
 	}
 }
 
-// ==================== СЕТЕВЫЕ ФУНКЦИИ ====================
-func playerToPlayerData(p *Player) *PlayerData {
-	return &PlayerData{
-		Name:         p.Name,
-		HP:           p.HP,
-		MaxHP:        p.MaxHP,
-		Mana:         p.Mana,
-		MaxMana:      p.MaxMana,
-		BaseStrength: p.BaseStrength,
-		Gold:         p.Gold,
-		Inventory:    p.Inventory,
-		Equipment:    p.Equipment,
-		Abilities:    p.Abilities,
+func (m *Merchant) ShowItems(ui GameIO, pack *ContentPack, player *Player) {
+	ui.Printf("\n=== ЛАВКА %s ===\n", m.Name)
+	ui.Printf("Ваше золото: %d\n", player.Gold)
+	if discount := m.Discount(); discount > 0 {
+		ui.Printf("Скидка постоянного покупателя: %d%%\n", discount)
+	}
+	for i, item := range m.Items {
+		price := m.BuyPrice(item)
+		ui.Printf("%d. %s%s - %d золота", i, item.Name, itemDetails(pack, item), price)
+		if price != item.Price {
+			ui.Printf(" (обычно %d)", item.Price)
+		}
+		if m.Stock[i] > 0 {
+			ui.Printf(" (в наличии: %d)\n", m.Stock[i])
+		} else {
+			ui.Println(" (нет в наличии)")
+		}
 	}
 }
 
-func playerDataToPlayer(pd *PlayerData) *Player {
-	return &Player{
-		Name:         pd.Name,
-		HP:           pd.HP,
-		MaxHP:        pd.MaxHP,
-		Mana:         pd.Mana,
-		MaxMana:      pd.MaxMana,
-		BaseStrength: pd.BaseStrength,
-		Strength:     pd.BaseStrength,
-		Gold:         pd.Gold,
-		Inventory:    pd.Inventory,
-		Equipment:    pd.Equipment,
-		Abilities:    pd.Abilities,
+func (m *Merchant) BuyItem(ui GameIO, player *Player, itemIndex int) error {
+	if itemIndex < 0 || itemIndex >= len(m.Items) {
+		ui.Println("Неверный индекс предмета!")
+		return nil
+	}
+	item := m.Items[itemIndex]
+	if m.Stock[itemIndex] <= 0 {
+		ui.Println("Этот товар закончился. Загляните в следующей главе!")
+		return nil
+	}
+	price := m.BuyPrice(item)
+	if player.Gold < price {
+		ui.Println("Недостаточно золота!")
+		return nil
 	}
+	if price >= CONFIRM_PRICE {
+		ui.Printf("%s стоит %d золота, у вас останется %d. Купить? (y/n): ",
+			item.Name, price, player.Gold-price)
+		if ok, err := confirm(ui); !ok {
+			return err
+		}
+	}
+	m.Stock[itemIndex]--
+	m.changeSupply(item, -1)
+	m.Reputation++
+	player.Gold -= price
+	player.Inventory = append(player.Inventory, item)
+	ui.Printf("Вы купили %s за %d золота!\n", item.Name, price)
+	return nil
 }
 
-// Серверная часть
-func runServer() {
-	rand.Seed(time.Now().UnixNano())
-	fmt.Println("=== ЗАПУСК СЕРВЕРА ===")
-	fmt.Printf("Сервер запущен на порту %s. Ожидание подключения...\n", SERVER_PORT)
+// SellPrice — сколько торговец заплатит за предмет. Избыток считается уже
+// с продаваемым экземпляром: покупка уменьшает избыток, и без этого только
+// что купленный предмет можно было бы сдать дороже, чем он обошёлся.
+func (m *Merchant) SellPrice(item Item) int {
+	return item.Price * supplyPercent(m.Supply[item.ID]+1) * m.SellPercent / 10000
+}
 
-	ln, err := net.Listen("tcp", ":"+SERVER_PORT)
-	if err != nil {
-		fmt.Println("Ошибка запуска сервера:", err)
-		return
+// ShowSellable показывает, что игрок может продать: сначала инвентарь,
+// затем надетые предметы, в одной нумерации
+func (m *Merchant) ShowSellable(ui GameIO, pack *ContentPack, player *Player) int {
+	ui.Printf("\n=== ПРОДАЖА (торговец платит %d%% цены) ===\n", m.SellPercent)
+	i := 0
+	for _, item := range player.Inventory {
+		ui.Printf("%d. %s%s - %d золота\n", i, item.Name, itemDetails(pack, item), m.SellPrice(item))
+		i++
+	}
+	for _, item := range player.Equipment {
+		ui.Printf("%d. %s%s [надето] - %d золота\n", i, item.Name, itemDetails(pack, item), m.SellPrice(item))
+		i++
 	}
-	defer ln.Close()
+	if i == 0 {
+		ui.Println("Вам нечего продать")
+	}
+	return i
+}
 
-	conn, err := ln.Accept()
-	if err != nil {
-		fmt.Println("Ошибка принятия подключения:", err)
+func (m *Merchant) SellItem(ui GameIO, player *Player, index int) {
+	var item Item
+	switch {
+	case index >= 0 && index < len(player.Inventory):
+		item = player.Inventory[index]
+	case index >= len(player.Inventory) && index < len(player.Inventory)+len(player.Equipment):
+		item = player.Equipment[index-len(player.Inventory)]
+	default:
+		ui.Println("Неверный индекс предмета!")
+		return
+	}
+	price := m.SellPrice(item)
+	if price <= 0 {
+		ui.Printf("%s не интересует торговца.\n", item.Name)
 		return
 	}
-	defer conn.Close()
-
-	fmt.Println("Клиент подключился!")
-	encoder := gob.NewEncoder(conn)
-	decoder := gob.NewDecoder(conn)
 
-	fmt.Print("Введите ваше имя: ")
-	reader := bufio.NewReader(os.Stdin)
-	name, _ := reader.ReadString('\n')
-	name = strings.TrimSpace(name)
+	if index < len(player.Inventory) {
+		player.Inventory = append(player.Inventory[:index], player.Inventory[index+1:]...)
+	} else {
+		index -= len(player.Inventory)
+		player.Equipment = append(player.Equipment[:index], player.Equipment[index+1:]...)
+	}
+	player.Gold += price
+	m.changeSupply(item, 1)
 
-	player1 := &Player{
-		Name:         name,
-		HP:           START_HP,
-		MaxHP:        START_HP,
-		Mana:         START_MANA,
-		MaxMana:      START_MANA,
-		BaseStrength: 10,
-		Strength:     10,
-		Gold:         START_GOLD,
-		Inventory:    getStartingInventory(),
-		Equipment:    []Item{},
-		Abilities:    []Ability{},
+	// Выкупить можно только несколько последних проданных предметов
+	m.BuyBack = append(m.BuyBack, SoldItem{Item: item, Price: price})
+	if len(m.BuyBack) > BUYBACK_LIMIT {
+		m.BuyBack = m.BuyBack[len(m.BuyBack)-BUYBACK_LIMIT:]
 	}
+	ui.Printf("Вы продали %s за %d золота.\n", item.Name, price)
+}
 
-	allAbilities := createAbilities()
-	player1.Abilities = append(player1.Abilities, allAbilities[1], allAbilities[4], allAbilities[7])
+func (m *Merchant) ShowBuyBack(ui GameIO, pack *ContentPack) {
+	ui.Println("\n=== ВЫКУП ПРОДАННОГО ===")
+	if len(m.BuyBack) == 0 {
+		ui.Println("Вы ещё ничего не продали этому торговцу")
+		return
+	}
+	for i, sold := range m.BuyBack {
+		ui.Printf("%d. %s%s - %d золота\n", i, sold.Item.Name, itemDetails(pack, sold.Item), sold.Price)
+	}
+}
+
+// BuyBackItem возвращает проданный предмет за ту же цену, что заплатил торговец
+func (m *Merchant) BuyBackItem(ui GameIO, player *Player, index int) {
+	if index < 0 || index >= len(m.BuyBack) {
+		ui.Println("Неверный индекс предмета!")
+		return
+	}
+	sold := m.BuyBack[index]
+	if player.Gold < sold.Price {
+		ui.Println("Недостаточно золота!")
+		return
+	}
+	m.BuyBack = append(m.BuyBack[:index], m.BuyBack[index+1:]...)
+	m.changeSupply(sold.Item, -1)
+	player.Gold -= sold.Price
+	player.Inventory = append(player.Inventory, sold.Item)
+	ui.Printf("Вы выкупили %s за %d золота.\n", sold.Item.Name, sold.Price)
+}
+
+// Restock пополняет запас товаров; вызывается между главами. За это время
+// торговец успевает распродать половину скупленного, и цены отходят.
+func (m *Merchant) Restock() {
+	for i := range m.Stock {
+		m.Stock[i] = m.MaxStock
+	}
+	for id, count := range m.Supply {
+		if count /= 2; count > 0 {
+			m.Supply[id] = count
+		} else {
+			delete(m.Supply, id)
+		}
+	}
+}
+
+func (m *Merchant) State() MerchantState {
+	return MerchantState{
+		Stock:      m.Stock,
+		BuyBack:    m.BuyBack,
+		Supply:     m.Supply,
+		Reputation: m.Reputation,
+		Visits:     m.Visits,
+	}
+}
+
+// Restore возвращает торговцу сохранённое состояние. Запас переносится
+// только если набор товаров не изменился.
+func (m *Merchant) Restore(state MerchantState) {
+	if len(state.Stock) == len(m.Items) {
+		m.Stock = state.Stock
+	}
+	m.BuyBack = state.BuyBack
+	m.Supply = state.Supply
+	m.Reputation = state.Reputation
+	m.Visits = state.Visits
+}
+
+// ==================== ВСПОМОГАТЕЛЬНЫЕ ФУНКЦИИ ====================
+func getItemTypeName(itemType ItemType) string {
+	return []string{"Оружие", "Броня", "Расходник", "Особый"}[itemType]
+}
+
+func createGameItems() []Item {
+	return []Item{
+		{ID: "serpent_fang", Name: "Змеиный клык", Type: Weapon, Attack: 18, Price: 125},
+		{ID: "insatiable_scimitar", Name: "Ненасытный ятаган", Type: Weapon, Attack: 23, Price: 177},
+		{ID: "shattered_sky", Name: "Расколотое небо", Type: Weapon, Attack: 80, Price: 300},
+		{ID: "bonebreaker", Name: "Костолом", Type: Weapon, Attack: 40, Price: 200},
+		{ID: "death_dance", Name: "Танец смерти", Type: Weapon, Attack: 55, Price: 250},
+		{ID: "spiked_armor", Name: "Шипованный доспех", Type: Armor, Defence: 10, Price: 125},
+		{ID: "void_radiance", Name: "Сияние пустоты", Type: Armor, Defence: 15, Price: 150},
+		{ID: "metrevets_armor", Name: "Броня метревеца", Type: Armor, Defence: 20, Price: 177},
+		{ID: "spirit_garb", Name: "Облачение духов", Type: Armor, Defence: 30, Price: 200},
+		{ID: "lords_blood_mail", Name: "Кровавая кольчуга господина", Type: Armor, Defence: 50, Price: 300},
+		{ID: "iron_helm", Name: "Железный шлем", Type: Armor, Slot: SlotHelmet, Defence: 6, Price: 60},
+		{ID: "ebony_visor", Name: "Эбеновое забрало", Type: Armor, Slot: SlotHelmet, Defence: 18, Price: 160},
+		{ID: "chain_gauntlets", Name: "Кольчужные рукавицы", Type: Armor, Slot: SlotGauntlets, Defence: 5, Price: 55},
+		{ID: "bone_bracers", Name: "Костяные наручи", Type: Armor, Slot: SlotGauntlets, Defence: 14, Price: 140},
+		{ID: "leather_greaves", Name: "Кожаные поножи", Type: Armor, Slot: SlotGreaves, Defence: 5, Price: 50},
+		{ID: "sighing_sabatons", Name: "Сабатоны вздохов", Type: Armor, Slot: SlotGreaves, Defence: 16, Price: 150},
+		{ID: "tower_shield", Name: "Ростовой щит", Type: Armor, Slot: SlotOffHand, Defence: 8, Price: 150},
+		{ID: "parrying_dagger", Name: "Кинжал для парирования", Type: Weapon, Slot: SlotOffHand, Attack: 8, Price: 90},
+		{ID: "silver_amulet", Name: "Серебряный амулет", Type: Armor, Slot: SlotAmulet, Defence: 3, Price: 110,
+			Rarity: Rare, Affixes: []Affix{{Kind: AffixHPOnHit, Value: 2}, {Kind: AffixManaOnHit, Value: 2}}},
+		{ID: "bloodstone_ring", Name: "Кольцо кровавика", Type: Armor, Slot: SlotRing, Price: 220,
+			Rarity: Epic, Affixes: []Affix{{Kind: AffixLifesteal, Value: 8}, {Kind: AffixCrit, Value: 6}, {Kind: AffixAttack, Value: 4}}},
+		{ID: "small_health_potion", Name: "Малое зелье здоровья", Type: Consumable, PlusHP: 20, Price: 20},
+		{ID: "large_health_potion", Name: "Большое зелье здоровья", Type: Consumable, PlusHP: 50, Price: 45},
+		{ID: "elixir_of_life", Name: "Эликсир жизни", Type: Consumable, PlusHP: 100, Price: 80},
+		{ID: "small_mana_potion", Name: "Малое зелье маны", Type: Consumable, PlusMana: 15, Price: 15},
+		{ID: "large_mana_potion", Name: "Большое зелье маны", Type: Consumable, PlusMana: 30, Price: 30},
+		{ID: "scroll_of_renewal", Name: "Свиток обновления", Type: Special, Price: 60,
+			Effects: []ItemEffect{{Kind: EffectCast, Ability: "renewal"}}},
+		{ID: "scroll_of_verdict", Name: "Свиток приговора", Type: Special, Price: 90,
+			Effects: []ItemEffect{{Kind: EffectCast, Ability: "verdict"}}},
+		{ID: "smoke_bomb", Name: "Дымовая шашка", Type: Special, Price: 70,
+			Effects: []ItemEffect{{Kind: EffectSmoke, Value: 1}}},
+		{ID: "last_breath_charm", Name: "Оберег последнего вздоха", Type: Special, Price: 200,
+			Effects: []ItemEffect{{Kind: EffectRevive, Value: 30}}},
+		{ID: "archive_key", Name: "Ржавый ключ архива", Type: Special, Price: 120,
+			Effects: []ItemEffect{{Kind: EffectUnlock, Chapter: "sunken_archive"}}},
+	}
+}
+
+func createAbilities() []Ability {
+	return []Ability{
+		{ID: "last_breath", Name: "Последний вздох", Description: "Подбрасывает врага и наносит 3 быстрых удара", Type: DamageAbility, Damage: 100, ManaCost: 80},
+		{ID: "steel_storm", Name: "Стальная буря", Description: "Делает выпал вперёд и наносит урон", Type: DamageAbility, Damage: 10, ManaCost: 5},
+		{ID: "sunset_herald", Name: "Вестник заката", Description: "Бросает теневой клинок, который наносит урон", Type: DamageAbility, Damage: 25, ManaCost: 15},
+		{ID: "death_brand", Name: "Клеймо смерти", Description: "Помечает врага меткой, которая наносит урон", Type: DamageAbility, Damage: 40, ManaCost: 20},
+		{ID: "storm_sign", Name: "Знак бури", Description: "Увеличивает атаку", Type: BuffAbility, BuffAttack: 10, ManaCost: 10},
+		{ID: "courage", Name: "Храбрость", Description: "Увеличивает защиту", Type: BuffAbility, BuffDefense: 10, ManaCost: 10},
+		{ID: "golden_aegis", Name: "Золотая эгида", Description: "Увеличивает атаку и защиту", Type: BuffAbility, BuffAttack: 15, BuffDefense: 15, ManaCost: 20},
+		{ID: "healing", Name: "Исцеление", Description: "Восстанавливает здоровье", Type: HealAbility, Heal: 25, ManaCost: 15},
+		{ID: "divine_healing", Name: "Божественное исцеление", Description: "Сильное восстановление здоровья", Type: HealAbility, Heal: 40, ManaCost: 30},
+		{ID: "poison_blade", Name: "Ядовитый клинок", Description: "Отравляет врага, яд накапливается", Type: CurseAbility, ManaCost: 10,
+			Effect: &StatusEffect{Name: "Яд", Duration: 3, MaxStacks: 3, Stacking: StackIntensity, DamagePerTurn: 6}},
+		{ID: "rending_wound", Name: "Рваная рана", Description: "Наносит урон и вызывает кровотечение", Type: CurseAbility, Damage: 10, ManaCost: 15,
+			Effect: &StatusEffect{Name: "Кровотечение", Duration: 4, Stacking: StackRefresh, DamagePerTurn: 5}},
+		{ID: "stunning_blow", Name: "Оглушающий удар", Description: "Оглушает врага на один раунд", Type: CurseAbility, ManaCost: 25,
+			Effect: &StatusEffect{Name: "Оглушение", Duration: 1, Stacking: StackIgnore, Stun: true}},
+		{ID: "holy_shield", Name: "Святой щит", Description: "Щит, поглощающий урон", Type: BuffAbility, ManaCost: 20,
+			Effect: &StatusEffect{Name: "Святой щит", Duration: 3, Stacking: StackRefresh, Shield: 30}},
+		{ID: "renewal", Name: "Обновление", Description: "Постепенно восстанавливает здоровье", Type: BuffAbility, ManaCost: 15,
+			Effect: &StatusEffect{Name: "Обновление", Duration: 4, Stacking: StackRefresh, HealPerTurn: 8}},
+	}
+}
+
+func createBossAbilities() []Ability {
+	return []Ability{
+		{ID: "order_oath", Name: "Клятва ордена", Description: "Прикрывается щитом ордена", Type: BuffAbility, ManaCost: 10,
+			Effect: &StatusEffect{Name: "Клятва ордена", Duration: 2, Stacking: StackRefresh, Shield: 15}},
+		{ID: "pus_blight", Name: "Гнойная скверна", Description: "Заражает врага гноем", Type: CurseAbility, ManaCost: 10,
+			Effect: &StatusEffect{Name: "Скверна", Duration: 3, MaxStacks: 3, Stacking: StackIntensity, DamagePerTurn: 4}},
+		{ID: "verdict", Name: "Приговор", Description: "Обрушивает на врага тяжёлый удар", Type: DamageAbility, Damage: 20, ManaCost: 25},
+		{ID: "discord", Name: "Раздор", Description: "Режет врага двумя клинками", Type: CurseAbility, Damage: 10, ManaCost: 20,
+			Effect: &StatusEffect{Name: "Кровотечение", Duration: 3, Stacking: StackRefresh, DamagePerTurn: 6}},
+		{ID: "silence", Name: "Безмолвие", Description: "Лишает врага голоса и воли", Type: CurseAbility, ManaCost: 30,
+			Effect: &StatusEffect{Name: "Оглушение", Duration: 1, Stacking: StackIgnore, Stun: true}},
+		{ID: "chronicle_edit", Name: "Правка летописи", Description: "Переписывает свои раны", Type: HealAbility, Heal: 40, ManaCost: 35},
+		{ID: "mirror_aegis", Name: "Зеркальная эгида", Description: "Отражает силу противника", Type: BuffAbility, BuffAttack: 15, BuffDefense: 15, ManaCost: 30},
+	}
+}
+
+func createStarterItems() []Item {
+	return []Item{
+		{ID: "paladin_sword", Name: "Меч паладина", Type: Weapon, Attack: 5},
+		{ID: "paladin_armor", Name: "Доспех паладина", Type: Armor, Defence: 5},
+	}
+}
+
+// generateLoot выбирает трофеи главы chapter из набора партии. Одна
+// запись таблицы не выпадает дважды, а снаряжение получает редкость и свойства.
+func generateLoot(game *GameSession, chapter int) []Item {
+	r, pack := game.Rand, game.Content
+	lootTable := pack.LootTable
+	lootCount := r.Intn(3) + 2
+	if lootCount > len(lootTable) {
+		lootCount = len(lootTable)
+	}
+	loot := make([]Item, lootCount)
+	for i, index := range r.Perm(len(lootTable))[:lootCount] {
+		loot[i] = rollItem(r, pack.items[lootTable[index]], chapter, pack.storyLength())
+	}
+	return loot
+}
+
+// ==================== РЕДКОСТЬ И СВОЙСТВА ====================
+const (
+	RARITY_CHAPTER_BONUS = 30 // прибавка к броску редкости в последней главе
+	RARITY_PRICE_STEP    = 50 // на сколько процентов дорожает предмет за ступень редкости
+	RARITY_VALUE_STEP    = 25 // на сколько процентов растут свойства за ступень редкости
+)
+
+// rarityThresholds — границы броска 0-99 (плюс бонус главы) между
+// соседними ступенями редкости
+var rarityThresholds = [...]int{55, 80, 95, 110}
+
+// affixRanges — разброс значений свойств у необычного предмета
+var affixRanges = [...]struct{ Min, Max int }{
+	AffixAttack:    {2, 6},
+	AffixDefense:   {2, 5},
+	AffixHPOnHit:   {1, 4},
+	AffixManaOnHit: {1, 3},
+	AffixLifesteal: {3, 8},
+	AffixCrit:      {3, 8},
+}
+
+// rollRarity бросает редкость; к последней главе редкие предметы
+// выпадают заметно чаще. chapter — номер главы по счёту игрока, с нуля,
+// story — число глав в сюжете.
+func rollRarity(r *rand.Rand, chapter, story int) Rarity {
+	roll := r.Intn(100)
+	if story > 1 {
+		if chapter > story-1 {
+			chapter = story - 1
+		}
+		roll += RARITY_CHAPTER_BONUS * chapter / (story - 1)
+	}
+	rarity := Common
+	for _, threshold := range rarityThresholds {
+		if roll < threshold {
+			break
+		}
+		rarity++
+	}
+	return rarity
+}
+
+// rollItem делает из шаблона снаряжения предмет случайной редкости:
+// каждая ступень выше обычной добавляет одно свойство без повторов.
+// Расходники и предметы, редкость которых задана в наборе, не меняются.
+func rollItem(r *rand.Rand, item Item, chapter, story int) Item {
+	if item.Type != Weapon && item.Type != Armor || item.Rarity != Common || len(item.Affixes) > 0 {
+		return item
+	}
+	item.Rarity = rollRarity(r, chapter, story)
+	for _, kind := range r.Perm(len(affixRanges))[:item.Rarity] {
+		bounds := affixRanges[kind]
+		value := bounds.Min + r.Intn(bounds.Max-bounds.Min+1)
+		value = value * (100 + RARITY_VALUE_STEP*(int(item.Rarity)-1)) / 100
+		item.Affixes = append(item.Affixes, Affix{Kind: AffixKind(kind), Value: value})
+	}
+	item.Price = item.Price * (100 + RARITY_PRICE_STEP*int(item.Rarity)) / 100
+	return item
+}
+
+// ==================== ЭФФЕКТЫ СОСТОЯНИЯ ====================
+// abilityEffect строит эффект способности; для простых баффов он
+// собирается из BuffAttack/BuffDefense.
+func abilityEffect(ability Ability) StatusEffect {
+	var effect StatusEffect
+	if ability.Effect != nil {
+		effect = *ability.Effect
+	} else {
+		effect = StatusEffect{
+			Name:         ability.Name,
+			AttackBonus:  ability.BuffAttack,
+			DefenseBonus: ability.BuffDefense,
+			Stacking:     StackRefresh,
+		}
+	}
+	if effect.Name == "" {
+		effect.Name = ability.Name
+	}
+	if effect.Duration == 0 {
+		effect.Duration = ability.Duration
+	}
+	if effect.Duration == 0 {
+		effect.Duration = BUFF_DURATION
+	}
+	return effect
+}
+
+func (effects *StatusEffects) Add(effect StatusEffect) {
+	if effect.Stacks == 0 {
+		effect.Stacks = 1
+	}
+	effect.Fresh = true
+	for i := range *effects {
+		current := &(*effects)[i]
+		if current.Name != effect.Name {
+			continue
+		}
+		switch current.Stacking {
+		case StackIgnore:
+			return
+		case StackIntensity:
+			if current.Stacks < current.MaxStacks {
+				current.Stacks++
+			}
+		}
+		current.Duration = effect.Duration
+		current.Shield = effect.Shield
+		current.Fresh = true
+		return
+	}
+	*effects = append(*effects, effect)
+}
+
+func (effects StatusEffects) AttackBonus() int {
+	total := 0
+	for _, effect := range effects {
+		total += effect.AttackBonus * effect.Stacks
+	}
+	return total
+}
+
+func (effects StatusEffects) DefenseBonus() int {
+	total := 0
+	for _, effect := range effects {
+		total += effect.DefenseBonus * effect.Stacks
+	}
+	return total
+}
+
+func (effects StatusEffects) IsStunned() bool {
+	for _, effect := range effects {
+		if effect.Stun {
+			return true
+		}
+	}
+	return false
+}
+
+// AbsorbDamage списывает урон с щитов и возвращает оставшийся урон.
+// Исчерпанные щиты снимаются.
+func (effects *StatusEffects) AbsorbDamage(damage int) int {
+	kept := (*effects)[:0]
+	for _, effect := range *effects {
+		if effect.Shield > 0 && damage > 0 {
+			absorbed := damage
+			if absorbed > effect.Shield {
+				absorbed = effect.Shield
+			}
+			effect.Shield -= absorbed
+			damage -= absorbed
+			if effect.Shield == 0 {
+				continue
+			}
+		}
+		kept = append(kept, effect)
+	}
+	*effects = kept
+	return damage
+}
+
+func (effects StatusEffects) String() string {
+	parts := make([]string, 0, len(effects))
+	for _, effect := range effects {
+		part := effect.Name
+		if effect.Stacks > 1 {
+			part += fmt.Sprintf(" x%d", effect.Stacks)
+		}
+		if effect.Shield > 0 {
+			part += fmt.Sprintf(" %d", effect.Shield)
+		}
+		parts = append(parts, fmt.Sprintf("%s (%dр.)", part, effect.Duration))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (effect StatusEffect) Describe() string {
+	var parts []string
+	if effect.AttackBonus != 0 {
+		parts = append(parts, fmt.Sprintf("Атака +%d", effect.AttackBonus))
+	}
+	if effect.DefenseBonus != 0 {
+		parts = append(parts, fmt.Sprintf("Защита +%d", effect.DefenseBonus))
+	}
+	if effect.DamagePerTurn > 0 {
+		parts = append(parts, fmt.Sprintf("%d урона за раунд", effect.DamagePerTurn))
+	}
+	if effect.HealPerTurn > 0 {
+		parts = append(parts, fmt.Sprintf("+%d HP за раунд", effect.HealPerTurn))
+	}
+	if effect.Shield > 0 {
+		parts = append(parts, fmt.Sprintf("щит на %d урона", effect.Shield))
+	}
+	if effect.Stun {
+		parts = append(parts, "оглушение")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// tickEffects применяет периодические эффекты в конце раунда и снимает
+// истёкшие. Прибавки и щит действуют уже в раунде наложения, и он идёт в
+// счёт длительности; тики и оглушение начинаются со следующего раунда.
+func tickEffects(c Character) []string {
+	effects := c.GetEffects()
+	var log []string
+	kept := (*effects)[:0]
+	for _, effect := range *effects {
+		if effect.Fresh {
+			effect.Fresh = false
+			if effect.Stun || effect.DamagePerTurn > 0 || effect.HealPerTurn > 0 {
+				kept = append(kept, effect)
+				continue
+			}
+		}
+		if effect.DamagePerTurn > 0 {
+			damage := effect.DamagePerTurn * effect.Stacks
+			c.SetHP(c.GetHP() - damage)
+			log = append(log, fmt.Sprintf("%s получает %d урона от эффекта «%s»", c.GetName(), damage, effect.Name))
+		}
+		if effect.HealPerTurn > 0 {
+			heal := effect.HealPerTurn * effect.Stacks
+			c.SetHP(c.GetHP() + heal)
+			log = append(log, fmt.Sprintf("%s восстанавливает %d HP от эффекта «%s»", c.GetName(), heal, effect.Name))
+		}
+		effect.Duration--
+		if effect.Duration <= 0 {
+			log = append(log, fmt.Sprintf("Эффект «%s» на %s закончился", effect.Name, c.GetName()))
+			continue
+		}
+		kept = append(kept, effect)
+	}
+	*effects = kept
+	return log
+}
+
+func formatEffects(c Character) string {
+	effects := *c.GetEffects()
+	if len(effects) == 0 {
+		return ""
+	}
+	return " [" + effects.String() + "]"
+}
+
+func applyDamage(target Character, damage int) int {
+	damage = target.GetEffects().AbsorbDamage(damage)
+	target.SetHP(target.GetHP() - damage)
+	return damage
+}
+
+// ==================== БОЕВОЙ ДВИЖОК ====================
+const NoChoice = -1
+
+type CombatAction struct {
+	HitPart   BodyPart
+	BlockPart BodyPart
+	AbilityID int
+	ItemID    int
+}
+
+type SideResult struct {
+	Name     string
+	Action   CombatAction
+	Effect   string
+	Attacked bool
+	Stunned  bool
+	Blocked  bool
+	Damage   int
+	Absorbed int
+	Critical bool   `json:",omitempty"`
+	Healed   int    `json:",omitempty"` // здоровье, восстановленное свойствами оружия
+	Restored int    `json:",omitempty"` // мана, восстановленная свойствами оружия
+	Revived  string `json:",omitempty"`
+	Shielded int
+	Ticks    []string
+}
+
+type RoundResult struct {
+	Sides [2]SideResult
+	Dead  [2]bool
+}
+
+// Draw — оба бойца пали в одном раунде
+func (r RoundResult) Draw() bool {
+	return r.Dead[0] && r.Dead[1]
+}
+
+func attackAction(hit, block BodyPart) CombatAction {
+	return CombatAction{HitPart: hit, BlockPart: block, AbilityID: NoChoice, ItemID: NoChoice}
+}
+
+func abilityAction(abilityID int, block BodyPart) CombatAction {
+	return CombatAction{BlockPart: block, AbilityID: abilityID, ItemID: NoChoice}
+}
+
+func itemAction(itemID int, block BodyPart) CombatAction {
+	return CombatAction{BlockPart: block, AbilityID: NoChoice, ItemID: itemID}
+}
+
+// idleAction — пропуск хода: без удара, только защита
+func idleAction(block BodyPart) CombatAction {
+	return CombatAction{HitPart: NoChoice, BlockPart: block, AbilityID: NoChoice, ItemID: NoChoice}
+}
+
+func (a CombatAction) IsPass() bool {
+	return a.HitPart == NoChoice && a.AbilityID == NoChoice && a.ItemID == NoChoice
+}
+
+func (a CombatAction) IsAttack() bool {
+	return a.HitPart != NoChoice && a.AbilityID == NoChoice && a.ItemID == NoChoice
+}
+
+func (a CombatAction) Kind() string {
+	switch {
+	case a.AbilityID != NoChoice:
+		return "ability"
+	case a.ItemID != NoChoice:
+		return "item"
+	case a.HitPart == NoChoice:
+		return "pass"
+	}
+	return "hit"
+}
+
+// rollCrits бросает критические удары на раунд. Бросок делается только
+// для бойцов с шансом крита, так что без таких вещей генератор не тратится.
+func rollCrits(r *rand.Rand, first, second Character) [2]bool {
+	var crits [2]bool
+	for i, c := range []Character{first, second} {
+		if p, ok := c.(*Player); ok {
+			if chance := p.AffixTotal(AffixCrit); chance > 0 {
+				crits[i] = r.Intn(100) < chance
+			}
+		}
+	}
+	return crits
+}
+
+// resolveRound разыгрывает один раунд: сначала способности и предметы,
+// затем одновременный обмен ударами и в конце тик эффектов. Криты
+// бросаются заранее (rollCrits) и срабатывают, только если удар прошёл.
+// Ничего не печатает и не читает ввод; pack нужен свиткам со способностями.
+func resolveRound(pack *ContentPack, first, second Character, firstAction, secondAction CombatAction, crits [2]bool) RoundResult {
+	fighters := [2]Character{first, second}
+	actions := [2]CombatAction{firstAction, secondAction}
+
+	var result RoundResult
+	for i := range fighters {
+		result.Sides[i] = SideResult{
+			Name:    fighters[i].GetName(),
+			Action:  actions[i],
+			Stunned: fighters[i].GetEffects().IsStunned(),
+		}
+	}
+
+	for i := range fighters {
+		if result.Sides[i].Stunned {
+			result.Sides[i].Effect = fmt.Sprintf("%s оглушён и пропускает ход!", fighters[i].GetName())
+			continue
+		}
+		switch {
+		case actions[i].IsPass():
+			result.Sides[i].Effect = fmt.Sprintf("⌛ %s пропускает ход!", fighters[i].GetName())
+		case !actions[i].IsAttack():
+			result.Sides[i].Effect = applySpecialAction(pack, fighters[i], fighters[1-i], actions[i])
+		}
+	}
+
+	for i := range fighters {
+		if result.Sides[i].Stunned || !actions[i].IsAttack() {
+			continue
+		}
+		side := &result.Sides[i]
+		side.Attacked = true
+		if !result.Sides[1-i].Stunned && actions[i].HitPart == actions[1-i].BlockPart {
+			side.Blocked = true
+			continue
+		}
+		raw := fighters[i].GetStrength()
+		if crits[i] {
+			side.Critical = true
+			raw = raw * CRIT_PERCENT / 100
+		}
+		side.Damage = mitigateDamage(raw, fighters[1-i].DefenseAt(actions[i].HitPart))
+		side.Absorbed = raw - side.Damage
+	}
+
+	for i := range fighters {
+		side := &result.Sides[i]
+		if side.Damage > 0 {
+			dealt := applyDamage(fighters[1-i], side.Damage)
+			side.Shielded = side.Damage - dealt
+			side.Damage = dealt
+		}
+	}
+
+	for i := range fighters {
+		if p, ok := fighters[i].(*Player); ok && result.Sides[i].Damage > 0 && p.IsAlive() {
+			applyOnHit(p, &result.Sides[i])
+		}
+	}
+
+	for i := range fighters {
+		result.Sides[i].Ticks = tickEffects(fighters[i])
+	}
+
+	for i := range fighters {
+		if p, ok := fighters[i].(*Player); ok && !p.IsAlive() {
+			result.Sides[i].Revived = p.tryRevive()
+		}
+		result.Dead[i] = !fighters[i].IsAlive()
+	}
+	return result
+}
+
+// applyOnHit восстанавливает здоровье и ману за попавший удар
+func applyOnHit(p *Player, side *SideResult) {
+	hp, mana := p.HP, p.Mana
+	p.SetHP(p.HP + p.AffixTotal(AffixHPOnHit) + side.Damage*p.AffixTotal(AffixLifesteal)/100)
+	p.SetMana(p.Mana + p.AffixTotal(AffixManaOnHit))
+	side.Healed = p.HP - hp
+	side.Restored = p.Mana - mana
+}
+
+// mitigateDamage снижает урон пропорционально защите цели:
+// при защите DEFENSE_SCALE проходит половина урона, но не меньше MIN_DAMAGE.
+func mitigateDamage(damage, defense int) int {
+	if damage <= 0 {
+		return 0
+	}
+	if defense < 0 {
+		defense = 0
+	}
+	mitigated := damage * DEFENSE_SCALE / (DEFENSE_SCALE + defense)
+	if mitigated < MIN_DAMAGE {
+		mitigated = MIN_DAMAGE
+	}
+	return mitigated
+}
+
+func applySpecialAction(pack *ContentPack, actor, target Character, action CombatAction) string {
+	if action.AbilityID != NoChoice {
+		abilities := actor.GetAbilities()
+		if action.AbilityID < 0 || action.AbilityID >= len(abilities) {
+			return "Неверная способность!"
+		}
+		return actor.UseAbility(abilities[action.AbilityID], target)
+	}
+	p, ok := actor.(*Player)
+	if !ok {
+		return fmt.Sprintf("%s не может использовать предметы!", actor.GetName())
+	}
+	return p.UseItem(pack, action.ItemID, target)
+}
+
+func printRoundEffects(ui GameIO, result RoundResult) {
+	for _, side := range result.Sides {
+		if side.Effect != "" {
+			ui.Println(side.Effect)
+		}
+	}
+}
+
+func printDamageDetails(ui GameIO, side, defender SideResult) {
+	if side.Critical {
+		ui.Println("⚡ Критический удар!")
+	}
+	if side.Absorbed > 0 {
+		ui.Printf("Броня %s поглощает %d урона\n", defender.Name, side.Absorbed)
+	}
+	if side.Shielded > 0 {
+		ui.Printf("Щит %s поглощает %d урона\n", defender.Name, side.Shielded)
+	}
+	if side.Healed > 0 {
+		ui.Printf("%s восстанавливает %d HP\n", side.Name, side.Healed)
+	}
+	if side.Restored > 0 {
+		ui.Printf("%s восстанавливает %d маны\n", side.Name, side.Restored)
+	}
+}
+
+func printRoundTicks(ui GameIO, result RoundResult) {
+	for _, side := range result.Sides {
+		for _, tick := range side.Ticks {
+			ui.Println(tick)
+		}
+	}
+	for _, side := range result.Sides {
+		if side.Revived != "" {
+			ui.Println(side.Revived)
+		}
+	}
+}
+
+func printRoundResults(ui GameIO, result RoundResult) {
+	ui.Println("\n========== РЕЗУЛЬТАТЫ ХОДА ==========")
+	printRoundEffects(ui, result)
+
+	for i, side := range result.Sides {
+		if !side.Attacked {
+			continue
+		}
+		defender := result.Sides[1-i]
+		ui.Printf("\n%s атакует %s в %s\n", side.Name, defender.Name, side.Action.HitPart)
+		if defender.Stunned || defender.Action.BlockPart == NoChoice {
+			ui.Printf("%s не может защищаться\n", defender.Name)
+		} else {
+			ui.Printf("%s защищает %s\n", defender.Name, defender.Action.BlockPart)
+		}
+		if side.Blocked {
+			ui.Printf("🛡️ %s блокирует удар в %s!\n", defender.Name, defender.Action.BlockPart)
+		} else {
+			ui.Printf("💥 Удар достиг цели! %s наносит %d урона %s!\n",
+				side.Name, side.Damage, defender.Name)
+			printDamageDetails(ui, side, defender)
+		}
+	}
+	printRoundTicks(ui, result)
+}
+
+func printFightRound(ui GameIO, result RoundResult) {
+	ui.Println()
+	printRoundEffects(ui, result)
+	for _, side := range result.Sides {
+		switch {
+		case side.Stunned:
+		case side.Attacked:
+			ui.Printf("%s бьет в %s и защищает %s\n",
+				side.Name, side.Action.HitPart, side.Action.BlockPart)
+		default:
+			ui.Printf("%s защищает %s\n", side.Name, side.Action.BlockPart)
+		}
+	}
+	for i, side := range result.Sides {
+		if !side.Attacked {
+			continue
+		}
+		defender := result.Sides[1-i]
+		if side.Blocked {
+			ui.Printf("%s блокирует удар в %s!\n",
+				defender.Name, defender.Action.BlockPart)
+		} else {
+			ui.Printf("%s наносит %d урона по %s!\n",
+				side.Name, side.Damage, defender.Name)
+			printDamageDetails(ui, side, defender)
+		}
+	}
+	printRoundTicks(ui, result)
+}
+
+func promptCombatAction(ui GameIO, pack *ContentPack, player *Player, sendChat func(string)) (CombatAction, error) {
+	ui.Println("1 - Обычная атака")
+	ui.Println("2 - Использовать способность")
+	ui.Println("3 - Показать способности")
+	ui.Println("4 - Показать инвентарь")
+	ui.Println("5 - Использовать предмет")
+	ui.Println("6 - Отправить сообщение в чат")
+
+	// promptBlock спрашивает защиту, которой завершается любое действие
+	promptBlock := func() (BodyPart, error) {
+		ui.Printf("\n%s, выберите что защищать:\n", player.Name)
+		return promptBodyPart(ui, "защиты")
+	}
+
+	for {
+		ui.Printf("%s, ваш выбор: ", player.Name)
+		input, err := ui.ReadLine()
+		if err != nil {
+			return CombatAction{}, err
+		}
+
+		switch input {
+		case "1":
+			ui.Printf("\n%s, выберите куда атаковать:\n", player.Name)
+			hit, err := promptBodyPart(ui, "удара")
+			if err != nil {
+				return CombatAction{}, err
+			}
+			block, err := promptBlock()
+			return attackAction(hit, block), err
+		case "2":
+			player.ShowAbilities(ui)
+			if len(player.Abilities) == 0 {
+				continue
+			}
+			ui.Print("Выберите способность: ")
+			abilityInput, err := ui.ReadLine()
+			if err != nil {
+				return CombatAction{}, err
+			}
+			idx, err := strconv.Atoi(abilityInput)
+			if err != nil || idx < 0 || idx >= len(player.Abilities) {
+				ui.Println("Неверный выбор!")
+				continue
+			}
+			if player.Mana < player.Abilities[idx].ManaCost {
+				ui.Println("Недостаточно маны!")
+				continue
+			}
+			block, err := promptBlock()
+			return abilityAction(idx, block), err
+		case "3":
+			player.ShowAbilities(ui)
+		case "4":
+			player.ShowInventory(ui, pack)
+		case "5":
+			player.ShowInventory(ui, pack)
+			if len(player.Inventory) == 0 {
+				continue
+			}
+			ui.Print("Введите номер предмета: ")
+			itemInput, err := ui.ReadLine()
+			if err != nil {
+				return CombatAction{}, err
+			}
+			idx, err := strconv.Atoi(itemInput)
+			if err != nil || idx < 0 || idx >= len(player.Inventory) {
+				ui.Println("Неверный индекс предмета!")
+				continue
+			}
+			if !player.Inventory[idx].UsableInBattle() {
+				ui.Printf("%s срабатывает сам, тратить на него ход не нужно.\n", player.Inventory[idx].Name)
+				continue
+			}
+			block, err := promptBlock()
+			return itemAction(idx, block), err
+		case "6":
+			ui.Print("Введите сообщение: ")
+			msg, err := ui.ReadLine()
+			if err != nil {
+				return CombatAction{}, err
+			}
+			if sendChat != nil {
+				sendChat(msg)
+			}
+			ui.Printf("%s: %s\n", player.Name, msg)
+		default:
+			ui.Println("Неверный выбор!")
+		}
+	}
+}
+
+// validateAction проверяет действие, пришедшее по сети, против состояния
+// игрока на сервере
+func validateAction(player *Player, action CombatAction) error {
+	validPart := func(part BodyPart) bool { return part >= Head && part <= Legs }
+	if !validPart(action.BlockPart) {
+		return fmt.Errorf("неверная часть тела для защиты")
+	}
+	if action.AbilityID != NoChoice && action.ItemID != NoChoice {
+		return fmt.Errorf("нельзя одновременно применить способность и предмет")
+	}
+	switch {
+	case action.AbilityID != NoChoice:
+		if action.AbilityID < 0 || action.AbilityID >= len(player.Abilities) {
+			return fmt.Errorf("нет способности с номером %d", action.AbilityID)
+		}
+		if player.Mana < player.Abilities[action.AbilityID].ManaCost {
+			return fmt.Errorf("недостаточно маны для %s", player.Abilities[action.AbilityID].Name)
+		}
+	case action.ItemID != NoChoice:
+		if action.ItemID < 0 || action.ItemID >= len(player.Inventory) {
+			return fmt.Errorf("нет предмета с номером %d", action.ItemID)
+		}
+		if item := player.Inventory[action.ItemID]; !item.UsableInBattle() {
+			return fmt.Errorf("%s не используется в бою: он срабатывает сам", item.Name)
+		}
+	default:
+		if !validPart(action.HitPart) {
+			return fmt.Errorf("неверная часть тела для удара")
+		}
+	}
+	return nil
+}
+
+// ==================== КОНТЕНТ ====================
+type EnemyDef struct {
+	ID         string
+	Name       string
+	HP         int
+	Mana       int
+	Strength   int
+	Defense    int
+	GoldDrop   int
+	Ability    string
+	AI         string
+	AIParam    int
+	DeathQuote string
+}
+
+type MerchantDef struct {
+	ID          string
+	Name        string
+	Dialogue    string
+	Lines       []string
+	Items       []string
+	Stock       int // экземпляров каждого товара, 0 — MERCHANT_STOCK
+	SellPercent int // 0 — SELL_PERCENT
+}
+
+type ChapterDef struct {
+	ID          string
+	StoryBefore string
+	Enemy       string
+	Merchant    string
+	NewAbility  string
+	StoryAfter  string
+	Locked      bool // глава открывается только ключом (действие unlock)
+}
+
+// ContentPack описывает весь игровой контент. Ссылки между разделами
+// задаются по ID, а не по индексу в срезе.
+type ContentPack struct {
+	Name              string
+	Items             []Item
+	Abilities         []Ability
+	Enemies           []EnemyDef
+	Merchants         []MerchantDef
+	Chapters          []ChapterDef
+	StartingInventory []string
+	StartingAbilities []string
+	LootTable         []string
+
+	items     map[string]Item
+	abilities map[string]Ability
+	enemies   map[string]EnemyDef
+	merchants map[string]MerchantDef
+}
+
+func mustValidate(pack *ContentPack) *ContentPack {
+	if err := pack.Validate(); err != nil {
+		panic(err)
+	}
+	return pack
+}
+
+func itemIDs(items []Item) []string {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+	}
+	return ids
+}
+
+func defaultContentPack() *ContentPack {
+	catalogue := createGameItems()
+	return &ContentPack{
+		Name:      "Энтрос",
+		Items:     append(catalogue, createStarterItems()...),
+		Abilities: append(createAbilities(), createBossAbilities()...),
+		Enemies: []EnemyDef{
+			{ID: "aldrich", Name: "Сир Алдрих Немигающий", HP: 50, Mana: 20, Strength: 8, GoldDrop: 25, Ability: "order_oath", AI: "defensive", AIParam: 50, DeathQuote: "Тьма, которую я выбрал... была милосерднее."},
+			{ID: "pus_mother", Name: "Мать Гноя", HP: 80, Mana: 40, Strength: 12, Defense: 4, GoldDrop: 50, Ability: "pus_blight", AI: "aggressive", DeathQuote: "Теперь... они наконец уснут."},
+			{ID: "judge_varek", Name: "Судья Варек", HP: 110, Mana: 50, Strength: 18, Defense: 8, GoldDrop: 70, Ability: "verdict", AI: "aggressive", DeathQuote: "Наконец-то... тишина внутри."},
+			{ID: "discord_twins", Name: "Близнецы Раздора", HP: 140, Mana: 60, Strength: 22, Defense: 12, GoldDrop: 100, Ability: "discord", AI: "random", AIParam: 50, DeathQuote: "Свободен... как же холодно."},
+			{ID: "jeremiah", Name: "Иеремия Безмолвный", HP: 170, Mana: 80, Strength: 28, Defense: 16, GoldDrop: 130, Ability: "silence", AI: "defensive", AIParam: 40, DeathQuote: "Убей меня... вырежи мое имя."},
+			{ID: "consul_malakai", Name: "Консул Малакай", HP: 210, Mana: 100, Strength: 35, Defense: 22, GoldDrop: 200, Ability: "chronicle_edit", AI: "defensive", AIParam: 40, DeathQuote: "Ты... всего лишь лишняя запятая."},
+			{ID: "drowned_archivist", Name: "Утонувший архивариус", HP: 160, Mana: 70, Strength: 26, Defense: 14, GoldDrop: 180, Ability: "pus_blight", AI: "random", AIParam: 40, DeathQuote: "Запиши... что я был."},
+			{ID: "reflection", Name: "Отражение", HP: 300, Mana: 150, Strength: 45, Defense: 30, GoldDrop: 500, Ability: "mirror_aegis", AI: "aggressive", DeathQuote: "Ты победил. Ты один."},
+		},
+		Merchants: []MerchantDef{
+			{ID: "old_trader", Name: "Старый торговец", Dialogue: "Ты чего тут забыл?",
+				Lines: []string{"Опять ты? Ну, смотри, раз пришёл.", "Серебро у ворот нынче не в цене. Только сталь."},
+				Items: []string{"serpent_fang", "spiked_armor", "iron_helm", "leather_greaves", "smoke_bomb", "small_health_potion", "small_mana_potion"}},
+			{ID: "drowned_apothecary", Name: "Утопленница-аптекарь", Dialogue: "Вода всё помнит... и всё лечит.",
+				Lines: []string{"Пей, пока тёплое.", "Приюты забирают многих. Тебя — пока нет."},
+				Items: []string{"insatiable_scimitar", "chain_gauntlets", "scroll_of_renewal", "archive_key", "small_health_potion", "large_health_potion", "small_mana_potion", "large_mana_potion"}},
+			{ID: "ebony_smith", Name: "Эбеновый кузнец", Dialogue: "Судья платил мне за цепи. Ты заплатишь за клинки.",
+				Lines: []string{"Металл не лжёт. В отличие от твоих врагов.", "Береги доспех — второго такого я не скую."},
+				Items: []string{"insatiable_scimitar", "bonebreaker", "parrying_dagger", "void_radiance", "metrevets_armor",
+					"ebony_visor", "bone_bracers", "tower_shield", "scroll_of_verdict", "large_health_potion", "large_mana_potion"},
+				Stock: 1, SellPercent: 60},
+			{ID: "rose_collector", Name: "Собиратель роз", Dialogue: "Каждый шип — чьё-то имя. Хочешь купить имя?",
+				Lines: []string{"Розы снова цветут. Значит, ты снова убивал.", "Не торгуйся. Лепестки не торгуются."},
+				Items: []string{"death_dance", "spirit_garb", "sighing_sabatons", "silver_amulet", "last_breath_charm", "elixir_of_life", "large_health_potion", "large_mana_potion"},
+				Stock: 1, SellPercent: 40},
+			{ID: "sky_keeper", Name: "Хранитель Немого Неба", Dialogue: "Здесь нечего продавать. Кроме последнего шанса.",
+				Lines: []string{"Звёзды молчат. Говори ты.", "Трон ждёт. Я тоже."},
+				Items: []string{"shattered_sky", "lords_blood_mail", "bloodstone_ring", "last_breath_charm", "elixir_of_life", "large_health_potion", "large_mana_potion"},
+				Stock: 1},
+		},
+		Chapters: []ChapterDef{
+			{ID: "silver_gates", StoryBefore: "Вы достигаете Врат Опустевшего серебра.", Enemy: "aldrich", Merchant: "old_trader", NewAbility: "last_breath", StoryAfter: "Врата открыты."},
+			{ID: "flooded_shelters", StoryBefore: "Затопленные приюты Нижнего Города.", Enemy: "pus_mother", Merchant: "drowned_apothecary", NewAbility: "healing", StoryAfter: "Тишина приюта пугает."},
+			{ID: "ebony_hall", StoryBefore: "Пиршественный зал Эбеновой Крепости.", Enemy: "judge_varek", Merchant: "ebony_smith", NewAbility: "sunset_herald", StoryAfter: "Вы переступаете через объедки."},
+			{ID: "bridge_of_sighs", StoryBefore: "Мост Вздохов. Близнецы Раздора.", Enemy: "discord_twins", Merchant: "ebony_smith", NewAbility: "golden_aegis", StoryAfter: "Они наконец едины в смерти."},
+			{ID: "flayed_roses", StoryBefore: "Сад Освежеванных Роз.", Enemy: "jeremiah", Merchant: "rose_collector", NewAbility: "divine_healing", StoryAfter: "Лепестки роз пропитались кровью."},
+			{ID: "observatory", StoryBefore: "Обсерватория Шепотов.", Enemy: "consul_malakai", Merchant: "sky_keeper", NewAbility: "death_brand", StoryAfter: "Книги сгорели."},
+			{ID: "sunken_archive", StoryBefore: "Под Обсерваторией — Затонувший архив. Вода хранит то, что сгорело наверху.", Enemy: "drowned_archivist", Merchant: "drowned_apothecary", StoryAfter: "Страницы всплывают одна за другой.", Locked: true},
+			{ID: "mute_throne", StoryBefore: "Трон Немого Неба.", Enemy: "reflection", Merchant: "sky_keeper", NewAbility: "last_breath", StoryAfter: "Мир замер в ожидании финала."},
+		},
+		StartingInventory: []string{"paladin_sword", "paladin_armor", "small_health_potion", "small_mana_potion"},
+		StartingAbilities: []string{"steel_storm", "storm_sign", "healing"},
+		LootTable:         itemIDs(catalogue),
+	}
+}
+
+func loadContentPack(path string) (*ContentPack, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	var pack ContentPack
+	if err := decoder.Decode(&pack); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := pack.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &pack, nil
+}
+
+func newEnemyAI(kind string, param int) (EnemyAI, error) {
+	switch kind {
+	case "", "random":
+		return RandomAI{AbilityChance: param}, nil
+	case "aggressive":
+		return AggressiveAI{}, nil
+	case "defensive":
+		return DefensiveAI{HealThreshold: param}, nil
+	}
+	return nil, fmt.Errorf("неизвестный ИИ %q, допустимо: random, aggressive, defensive", kind)
+}
+
+// Validate проверяет схему набора и перекрёстные ссылки по ID, после чего
+// строит индексы для поиска. Возвращает все найденные ошибки сразу.
+func (pack *ContentPack) Validate() error {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	checkID := func(section string, index int, id string, seen map[string]bool) {
+		switch {
+		case id == "":
+			fail("%s #%d: не задан ID", section, index)
+		case seen[id]:
+			fail("%s %q: повторяющийся ID", section, id)
+		}
+		seen[id] = true
+	}
+
+	pack.items = make(map[string]Item)
+	seen := make(map[string]bool)
+	for i, item := range pack.Items {
+		checkID("предмет", i, item.ID, seen)
+		if item.Name == "" {
+			fail("предмет %q: не задано имя", item.ID)
+		}
+		if item.Attack < 0 || item.Defence < 0 || item.PlusHP < 0 || item.PlusMana < 0 || item.Price < 0 {
+			fail("предмет %q: характеристики не могут быть отрицательными", item.ID)
+		}
+		_, slotErr := item.Slot.MarshalText()
+		switch {
+		case slotErr != nil:
+			fail("предмет %q: %v", item.ID, slotErr)
+		case item.Type == Weapon && item.Slot != SlotAuto && item.Slot != SlotMainHand && item.Slot != SlotOffHand:
+			fail("предмет %q: оружие держат только в руках", item.ID)
+		case item.Type == Armor && item.Slot == SlotMainHand:
+			fail("предмет %q: броню нельзя взять в правую руку", item.ID)
+		case item.Type != Weapon && item.Type != Armor && item.Slot != SlotAuto:
+			fail("предмет %q: слот задаётся только оружию и броне", item.ID)
+		}
+		if _, err := item.Rarity.MarshalText(); err != nil {
+			fail("предмет %q: %v", item.ID, err)
+		}
+		for _, affix := range item.Affixes {
+			if _, err := affix.Kind.MarshalText(); err != nil {
+				fail("предмет %q: %v", item.ID, err)
+			}
+			if affix.Value < 0 {
+				fail("предмет %q: значение свойства не может быть отрицательным", item.ID)
+			}
+		}
+		pack.items[item.ID] = item
+	}
+
+	pack.abilities = make(map[string]Ability)
+	seen = make(map[string]bool)
+	for i, ability := range pack.Abilities {
+		checkID("способность", i, ability.ID, seen)
+		if ability.Name == "" {
+			fail("способность %q: не задано имя", ability.ID)
+		}
+		if ability.ManaCost < 0 || ability.Damage < 0 || ability.Heal < 0 || ability.Duration < 0 {
+			fail("способность %q: характеристики не могут быть отрицательными", ability.ID)
+		}
+		if ability.Type == CurseAbility && ability.Effect == nil {
+			fail("способность %q: проклятию нужен Effect", ability.ID)
+		}
+		if effect := ability.Effect; effect != nil {
+			if effect.Duration < 0 || effect.DamagePerTurn < 0 || effect.HealPerTurn < 0 || effect.Shield < 0 {
+				fail("способность %q: характеристики эффекта не могут быть отрицательными", ability.ID)
+			}
+			if effect.Stacking == StackIntensity && effect.MaxStacks < 1 {
+				fail("способность %q: для режима intensity нужен MaxStacks", ability.ID)
+			}
+		}
+		pack.abilities[ability.ID] = ability
+	}
+
+	pack.enemies = make(map[string]EnemyDef)
+	seen = make(map[string]bool)
+	for i, enemy := range pack.Enemies {
+		checkID("противник", i, enemy.ID, seen)
+		if enemy.Name == "" {
+			fail("противник %q: не задано имя", enemy.ID)
+		}
+		if enemy.HP <= 0 {
+			fail("противник %q: HP должно быть больше нуля", enemy.ID)
+		}
+		if enemy.Mana < 0 || enemy.Strength < 0 || enemy.Defense < 0 || enemy.GoldDrop < 0 {
+			fail("противник %q: характеристики не могут быть отрицательными", enemy.ID)
+		}
+		if _, ok := pack.abilities[enemy.Ability]; enemy.Ability != "" && !ok {
+			fail("противник %q: неизвестная способность %q", enemy.ID, enemy.Ability)
+		}
+		if _, err := newEnemyAI(enemy.AI, enemy.AIParam); err != nil {
+			fail("противник %q: %v", enemy.ID, err)
+		}
+		pack.enemies[enemy.ID] = enemy
+	}
+
+	pack.merchants = make(map[string]MerchantDef)
+	seen = make(map[string]bool)
+	for i, merchant := range pack.Merchants {
+		checkID("торговец", i, merchant.ID, seen)
+		if merchant.Name == "" {
+			fail("торговец %q: не задано имя", merchant.ID)
+		}
+		if merchant.Stock < 0 {
+			fail("торговец %q: отрицательный запас", merchant.ID)
+		}
+		// Выше этой доли перепродажа со скидкой постоянного покупателя приносит золото
+		if merchant.SellPercent < 0 || merchant.SellPercent > 100-REPUTATION_MAX {
+			fail("торговец %q: доля цены при продаже должна быть от 0 до %d", merchant.ID, 100-REPUTATION_MAX)
+		}
+		if len(merchant.Items) == 0 {
+			fail("торговец %q: нечего продавать", merchant.ID)
+		}
+		for _, id := range merchant.Items {
+			if _, ok := pack.items[id]; !ok {
+				fail("торговец %q: неизвестный предмет %q", merchant.ID, id)
+			}
+		}
+		pack.merchants[merchant.ID] = merchant
+	}
+
+	if len(pack.Chapters) == 0 {
+		fail("нет ни одной главы")
+	}
+	seen = make(map[string]bool)
+	for i, chapter := range pack.Chapters {
+		checkID("глава", i, chapter.ID, seen)
+		if _, ok := pack.enemies[chapter.Enemy]; !ok {
+			fail("глава %q: неизвестный противник %q", chapter.ID, chapter.Enemy)
+		}
+		if _, ok := pack.merchants[chapter.Merchant]; chapter.Merchant != "" && !ok {
+			fail("глава %q: неизвестный торговец %q", chapter.ID, chapter.Merchant)
+		}
+		if _, ok := pack.abilities[chapter.NewAbility]; chapter.NewAbility != "" && !ok {
+			fail("глава %q: неизвестная способность %q", chapter.ID, chapter.NewAbility)
+		}
+		if chapter.Locked && i == len(pack.Chapters)-1 {
+			fail("глава %q: последняя глава не может быть закрытой", chapter.ID)
+		}
+	}
+
+	// Действия предметов проверяются после глав: ключи ссылаются на главы
+	for _, item := range pack.Items {
+		switch {
+		case item.Type == Special && len(item.Effects) == 0:
+			fail("предмет %q: особому предмету нужно хотя бы одно действие", item.ID)
+		case item.Type != Special && len(item.Effects) > 0:
+			fail("предмет %q: действия бывают только у особых предметов", item.ID)
+		}
+		for _, effect := range item.Effects {
+			switch effect.Kind {
+			case EffectCast:
+				if _, ok := pack.abilities[effect.Ability]; !ok {
+					fail("предмет %q: неизвестная способность %q", item.ID, effect.Ability)
+				}
+			case EffectSmoke:
+				if effect.Value < 0 {
+					fail("предмет %q: отрицательное число раундов", item.ID)
+				}
+			case EffectRevive:
+				if effect.Value < 1 || effect.Value > 100 {
+					fail("предмет %q: доля здоровья при воскрешении должна быть от 1 до 100", item.ID)
+				}
+			case EffectUnlock:
+				if !seen[effect.Chapter] {
+					fail("предмет %q: неизвестная глава %q", item.ID, effect.Chapter)
+				}
+			default:
+				_, err := effect.Kind.MarshalText()
+				fail("предмет %q: %v", item.ID, err)
+			}
+		}
+	}
+
+	for _, id := range pack.StartingInventory {
+		if _, ok := pack.items[id]; !ok {
+			fail("стартовый инвентарь: неизвестный предмет %q", id)
+		}
+	}
+	for _, id := range pack.StartingAbilities {
+		if _, ok := pack.abilities[id]; !ok {
+			fail("стартовые способности: неизвестная способность %q", id)
+		}
+	}
+	if len(pack.LootTable) == 0 {
+		fail("таблица добычи пуста")
+	}
+	for _, id := range pack.LootTable {
+		if _, ok := pack.items[id]; !ok {
+			fail("таблица добычи: неизвестный предмет %q", id)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("ошибки в наборе контента %q:\n  %s", pack.Name, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Hash — отпечаток набора контента. Сетевые игроки должны играть на
+// одинаковом наборе, иначе номера способностей и предметов разойдутся.
+func (pack *ContentPack) Hash() string {
+	data, err := json.Marshal(pack)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (pack *ContentPack) startingInventory() []Item {
+	items := make([]Item, 0, len(pack.StartingInventory))
+	for _, id := range pack.StartingInventory {
+		items = append(items, pack.items[id])
+	}
+	return items
+}
+
+func (pack *ContentPack) startingAbilities() []Ability {
+	abilities := make([]Ability, 0, len(pack.StartingAbilities))
+	for _, id := range pack.StartingAbilities {
+		abilities = append(abilities, pack.abilities[id])
+	}
+	return abilities
+}
+
+func (pack *ContentPack) newEnemy(id string, r *rand.Rand) *Enemy {
+	def := pack.enemies[id]
+	ai, _ := newEnemyAI(def.AI, def.AIParam)
+	enemy := &Enemy{
+		Name:       def.Name,
+		HP:         def.HP,
+		MaxHP:      def.HP,
+		Mana:       def.Mana,
+		Strength:   def.Strength,
+		Defense:    def.Defense,
+		GoldDrop:   def.GoldDrop,
+		DeathQuote: def.DeathQuote,
+		AI:         ai,
+		rng:        r,
+	}
+	if def.Ability != "" {
+		enemy.Ability = pack.abilities[def.Ability]
+	}
+	return enemy
+}
+
+func (pack *ContentPack) newMerchant(id string) *Merchant {
+	def := pack.merchants[id]
+	merchant := &Merchant{
+		ID:          def.ID,
+		Name:        def.Name,
+		Dialogue:    def.Dialogue,
+		Lines:       def.Lines,
+		MaxStock:    def.Stock,
+		SellPercent: def.SellPercent,
+	}
+	if merchant.MaxStock == 0 {
+		merchant.MaxStock = MERCHANT_STOCK
+	}
+	if merchant.SellPercent == 0 {
+		merchant.SellPercent = SELL_PERCENT
+	}
+	for _, itemID := range def.Items {
+		merchant.Items = append(merchant.Items, pack.items[itemID])
+	}
+	merchant.Stock = make([]int, len(merchant.Items))
+	merchant.Restock()
+	return merchant
+}
+
+// sessionMerchant возвращает торговца партии, создавая его при первой встрече
+func (pack *ContentPack) sessionMerchant(game *GameSession, id string) *Merchant {
+	if game.Merchants[id] == nil {
+		game.Merchants[id] = pack.newMerchant(id)
+	}
+	return game.Merchants[id]
+}
+
+// storyLength — сколько глав проходит любой игрок. Запертые главы
+// открываются не всегда и в счёт не идут.
+func (pack *ContentPack) storyLength() int {
+	length := 0
+	for _, chapter := range pack.Chapters {
+		if !chapter.Locked {
+			length++
+		}
+	}
+	if length == 0 {
+		return 1
+	}
+	return length
+}
+
+func (pack *ContentPack) buildChapters(game *GameSession) []Chapter {
+	chapters := make([]Chapter, len(pack.Chapters))
+	for i, def := range pack.Chapters {
+		chapters[i] = Chapter{
+			ID:          def.ID,
+			Locked:      def.Locked,
+			StoryBefore: def.StoryBefore,
+			Enemy:       pack.newEnemy(def.Enemy, game.Rand),
+			StoryAfter:  def.StoryAfter,
+		}
+		// Один и тот же торговец в разных главах — один человек со своим запасом
+		if def.Merchant != "" {
+			chapters[i].Merchant = pack.sessionMerchant(game, def.Merchant)
+		}
+		if def.NewAbility != "" {
+			chapters[i].NewAbility = pack.abilities[def.NewAbility]
+		}
+	}
+	return chapters
+}
+
+// ==================== ОДИНОЧНАЯ ИГРА ====================
+func fight(game *GameSession, player *Player, enemy *Enemy) (bool, error) {
+	ui := game.IO
+	// Своё зерно у каждого боя позволяет в точности повторить его в записи
+	seed := game.Reseed()
+	replay := startReplay(game.Config.Record, "campaign", seed, player, enemy)
+
+	round := 1
+	for player.IsAlive() && enemy.IsAlive() {
+		ui.Printf("\n=== РАУНД %d ===\n", round)
+		ui.Printf("%s: %d HP, %d маны, защита %d%s\n",
+			player.GetName(), player.GetHP(), player.GetMana(), player.GetDefense(), formatEffects(player))
+		ui.Printf("%s: %d HP, %d маны, защита %d%s\n",
+			enemy.GetName(), enemy.GetHP(), enemy.GetMana(), enemy.GetDefense(), formatEffects(enemy))
+
+		ui.Println("\n--- Ваш ход ---")
+		// Предметы применяются к врагу: свитки бьют его, дым его ослепляет
+		playerAction, err := promptCombatAction(ui, game.Content, player, nil)
+		if err != nil {
+			return false, err
+		}
+		enemyAction := enemy.ChooseAction(player)
+
+		result := resolveRound(game.Content, player, enemy, playerAction, enemyAction, rollCrits(game.Rand, player, enemy))
+		enemy.Observe(playerAction)
+		replay.Record(result)
+
+		printFightRound(ui, result)
+
+		round++
+
+		if player.IsAlive() && enemy.IsAlive() {
+			ui.Print("\nНажмите Enter для продолжения...")
+			if _, err := ui.ReadLine(); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	player.Effects = nil
+	enemy.Effects = nil
+
+	if player.IsAlive() {
+		if enemy.DeathQuote != "" {
+			ui.Printf("\n%s (хрипя): «%s»\n", enemy.Name, enemy.DeathQuote)
+		}
+		ui.Printf("\n%s побеждает!\n", player.GetName())
+		replay.Finish(ui, fmt.Sprintf("%s побеждает!", player.GetName()))
+		return true, nil
+	}
+	ui.Printf("\n%s побеждает!\n", enemy.GetName())
+	replay.Finish(ui, fmt.Sprintf("%s побеждает!", enemy.GetName()))
+	return false, nil
+}
+
+// ==================== PVP (ГОРЯЧИЙ СТУЛ) ====================
+func pvpFight(game *GameSession, players []*Player) error {
+	ui := game.IO
+	replay := startReplay(game.Config.Record, "hotseat", game.Seed, players[0], players[1])
+	round := 1
+	ui.Println("\n=== НАЧАЛО PVP БИТВЫ ===")
+	ui.Printf("%s VS %s\n", players[0].Name, players[1].Name)
+	ui.Println("Битва идет до полной победы одного из игроков!")
+	ui.Print("Нажмите Enter чтобы начать...")
+	if _, err := ui.ReadLine(); err != nil {
+		return err
+	}
+
+	var result RoundResult
+	for players[0].IsAlive() && players[1].IsAlive() {
+		ui.Printf("\n========== РАУНД %d ==========\n", round)
+		ui.Printf("%s: %d HP, %d маны%s | %s: %d HP, %d маны%s\n",
+			players[0].Name, players[0].HP, players[0].Mana, formatEffects(players[0]),
+			players[1].Name, players[1].HP, players[1].Mana, formatEffects(players[1]))
+
+		// Ход первого игрока
+		ui.Printf("\n--- Ход %s ---\n", players[0].Name)
+		player0Action, err := promptCombatAction(ui, game.Content, players[0], nil)
+		if err != nil {
+			return err
+		}
+
+		ui.Print("\nНажмите Enter для передачи хода второму игроку...")
+		if _, err := ui.ReadLine(); err != nil {
+			return err
+		}
+
+		// Ход второго игрока
+		ui.Printf("\n--- Ход %s ---\n", players[1].Name)
+		player1Action, err := promptCombatAction(ui, game.Content, players[1], nil)
+		if err != nil {
+			return err
+		}
+
+		// Обработка хода
+		result = resolveRound(game.Content, players[0], players[1], player0Action, player1Action,
+			rollCrits(game.Rand, players[0], players[1]))
+		replay.Record(result)
+		printRoundResults(ui, result)
+
+		ui.Printf("\n--- ИТОГИ РАУНДА %d ---\n", round)
+		ui.Printf("%s: %d HP | %s: %d HP\n",
+			players[0].Name, players[0].HP,
+			players[1].Name, players[1].HP)
+
+		round++
+
+		if players[0].IsAlive() && players[1].IsAlive() {
+			ui.Print("\nНажмите Enter для следующего раунда...")
+			if _, err := ui.ReadLine(); err != nil {
+				return err
+			}
+		}
+	}
+
+	ui.Println("\n========== БИТВА ЗАВЕРШЕНА ==========")
+	if result.Draw() {
+		ui.Println("\nНичья! Оба бойца пали.")
+		replay.Finish(ui, matchOutcomeText("", "", ""))
+		return nil
+	}
+	winner, loser := players[0], players[1]
+	if !winner.IsAlive() {
+		winner, loser = loser, winner
+	}
+	ui.Printf("\n🏆 %s ПОБЕЖДАЕТ В PVP БИТВЕ! 🏆\n", winner.Name)
+	ui.Printf("%s повержен!\n", loser.Name)
+	replay.Finish(ui, matchOutcomeText(winner.Name, loser.Name, ""))
+	return nil
+}
+
+// runHotseat создаёт двух игроков и проводит бой между ними. Пустые имена
+// запрашиваются у игроков.
+func runHotseat(game *GameSession, names []string) error {
+	ui := game.IO
+	ui.Println("\n=== РЕЖИМ ГОРЯЧИЙ СТУЛ ===")
+	players := make([]*Player, 2)
+	for i := 0; i < 2; i++ {
+		player, err := createPlayer(ui, game.Content, i+1, names[i])
+		if err != nil {
+			return err
+		}
+		player.Abilities = append(player.Abilities, game.Content.startingAbilities()...)
+		players[i] = player
+	}
+
+	ui.Println("\n=== ИГРОКИ СОЗДАНЫ ===")
+	ui.Printf("1. %s - HP: %d, Мана: %d, Сила: %d, Защита: %d\n", players[0].Name, players[0].HP, players[0].Mana, players[0].GetStrength(), players[0].GetDefense())
+	ui.Printf("2. %s - HP: %d, Мана: %d, Сила: %d, Защита: %d\n", players[1].Name, players[1].HP, players[1].Mana, players[1].GetStrength(), players[1].GetDefense())
+
+	for i := 0; i < 2; i++ {
+		ui.Printf("\n--- Управление инвентарем для %s ---\n", players[i].Name)
+		ui.Print("Хотите управлять инвентарем перед боем? (y/n): ")
+		ok, err := confirm(ui)
+		if err == nil && ok {
+			err = manageInventory(ui, game.Content, players[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return pvpFight(game, players)
+}
+
+func createPlayer(ui GameIO, pack *ContentPack, index int, name string) (*Player, error) {
+	if name == "" {
+		ui.Printf("Введите имя %d-го игрока: ", index)
+		var err error
+		if name, err = ui.ReadLine(); err != nil {
+			return nil, err
+		}
+	}
+	return &Player{
+		Name:         name,
+		HP:           START_HP,
+		MaxHP:        START_HP,
+		Mana:         START_MANA,
+		MaxMana:      START_MANA,
+		BaseStrength: 10,
+		Strength:     10,
+		Gold:         START_GOLD,
+		Inventory:    pack.startingInventory(),
+		Equipment:    []Item{},
+		Abilities:    []Ability{},
+	}, nil
+}
+
+// ==================== СОЕДИНЕНИЕ ====================
+const MESSAGE_BUFFER = 16
+
+// errQueueOverflow — другая сторона прислала больше ходов или состояний,
+// чем успели разобрать: честный клиент или сервер так не делает
+var errQueueOverflow = errors.New("слишком много непрочитанных сообщений")
+
+// Connection — сетевое соединение с единственным читателем. Горутина чтения
+// раскладывает входящие сообщения по типу в отдельные каналы, а запись
+// сериализуется мьютексом, так что слать можно из любой горутины.
+type Connection struct {
+	conn    net.Conn
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+	writeMu sync.Mutex
+
+	Actions chan GameMessage // PlayerAction
+	State   chan GameMessage // GameStateMsg, ActionRejected
+	Chat    chan GameMessage // ChatMessage
+	Notices chan GameMessage // LobbyNotice, TurnStart
+	Control chan GameMessage // остальные управляющие сообщения
+
+	err      error
+	lastSeen atomic.Int64 // время последнего входящего сообщения, UnixNano
+	silent   atomic.Bool  // соединение закрыто из-за молчания другой стороны
+	closed   chan struct{}
+}
+
+func NewConnection(conn net.Conn) *Connection {
+	c := &Connection{
+		conn:    conn,
+		encoder: gob.NewEncoder(conn),
+		decoder: gob.NewDecoder(conn),
+		Actions: make(chan GameMessage, MESSAGE_BUFFER),
+		State:   make(chan GameMessage, MESSAGE_BUFFER),
+		Chat:    make(chan GameMessage, MESSAGE_BUFFER),
+		Notices: make(chan GameMessage, MESSAGE_BUFFER),
+		Control: make(chan GameMessage, MESSAGE_BUFFER),
+		closed:  make(chan struct{}),
+	}
+	c.lastSeen.Store(time.Now().UnixNano())
+	go c.readLoop()
+	go c.heartbeat()
+	return c
+}
+
+func (c *Connection) readLoop() {
+	defer func() {
+		close(c.Actions)
+		close(c.State)
+		close(c.Chat)
+		close(c.Notices)
+		close(c.Control)
+		close(c.closed)
+	}()
+
+	for {
+		var msg GameMessage
+		if err := c.decoder.Decode(&msg); err != nil {
+			c.err = err
+			return
+		}
+		c.lastSeen.Store(time.Now().UnixNano())
+
+		switch msg.Type {
+		case Heartbeat:
+			// Нужен только для отметки времени
+		case PlayerAction, GameStateMsg, ActionRejected,
+			PlayerReady, Disconnect, LobbyCommand, LobbyReply, MatchStart, MatchCancelled, MatchEnd, Hello, MatchResume:
+			// Ходы, состояние и управление нельзя терять молча, но и ждать
+			// читателя нельзя: вместе с чтением встанет сердцебиение.
+			// Переполнение считается нарушением протокола.
+			target := c.Control
+			switch msg.Type {
+			case PlayerAction:
+				target = c.Actions
+			case GameStateMsg, ActionRejected:
+				target = c.State
+			}
+			select {
+			case target <- msg:
+			default:
+				c.err = errQueueOverflow
+				c.conn.Close()
+				return
+			}
+		case ChatMessage, LobbyNotice, TurnStart:
+			// Чат и объявления не должны останавливать чтение: если их никто
+			// не читает, лишние сообщения отбрасываются
+			target := c.Notices
+			if msg.Type == ChatMessage {
+				target = c.Chat
+			}
+			select {
+			case target <- msg:
+			default:
+			}
+		default:
+			// Типы из более новых версий протокола пропускаются
+		}
+	}
+}
+
+// heartbeat шлёт пустые сообщения, пока соединение живо, и закрывает его,
+// если другая сторона молчит дольше HEARTBEAT_TIMEOUT
+func (c *Connection) heartbeat() {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, c.lastSeen.Load())) > HEARTBEAT_TIMEOUT {
+				c.silent.Store(true)
+				c.conn.Close()
+				return
+			}
+			c.Send(GameMessage{Type: Heartbeat})
+		}
+	}
+}
+
+func (c *Connection) Send(msg GameMessage) error {
+	return c.SendTimeout(msg, WRITE_TIMEOUT)
+}
+
+// SendTimeout отправляет сообщение, ожидая получателя не дольше timeout.
+// После неудачи соединение лучше закрыть: сообщение могло уйти частично.
+func (c *Connection) SendTimeout(msg GameMessage, timeout time.Duration) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	return c.encoder.Encode(msg)
+}
+
+// Err возвращает причину, по которой остановилось чтение. Имеет смысл
+// только после закрытия каналов.
+func (c *Connection) Err() error {
+	if c.silent.Load() {
+		return errors.New("другая сторона не отвечает")
+	}
+	if c.err == nil || errors.Is(c.err, io.EOF) {
+		return errors.New("соединение закрыто")
+	}
+	return c.err
+}
+
+// Next возвращает следующее сообщение о состоянии или управлении. Состояние
+// проверяется первым: сервер шлёт итог раунда раньше Disconnect, и порядок
+// должен сохраниться.
+func (c *Connection) Next() (GameMessage, error) {
+	state := c.State
+	select {
+	case msg, ok := <-state:
+		if ok {
+			return msg, nil
+		}
+		// Канал закрыт, но в Control могут остаться последние сообщения
+		state = nil
+	default:
+	}
+
+	select {
+	case msg, ok := <-state:
+		if !ok {
+			return c.nextControl()
+		}
+		return msg, nil
+	case msg, ok := <-c.Control:
+		if !ok {
+			return GameMessage{}, c.Err()
+		}
+		return msg, nil
+	}
+}
+
+func (c *Connection) nextControl() (GameMessage, error) {
+	msg, ok := <-c.Control
+	if !ok {
+		return GameMessage{}, c.Err()
+	}
+	return msg, nil
+}
+
+// Expect ждёт сообщение конкретного типа
+func (c *Connection) Expect(t GameMessageType) (GameMessage, error) {
+	msg, err := c.Next()
+	if err != nil {
+		return msg, err
+	}
+	if msg.Type != t {
+		return msg, fmt.Errorf("неожиданное сообщение типа %d", msg.Type)
+	}
+	return msg, nil
+}
+
+func (c *Connection) Close() error {
+	return c.conn.Close()
+}
+
+// ==================== ПРОТОКОЛ ====================
+// errRejected — другая сторона явно отказала в подключении
+var errRejected = errors.New("подключение отклонено")
+
+// errPasswordRequired — сервер закрыт паролем, а клиент его не знает
+var errPasswordRequired = errors.New("сервер требует пароль")
+
+// localHello — наше приветствие; по хэшу набора pack стороны убеждаются,
+// что играют по одним правилам
+func localHello(pack *ContentPack, session string) *HelloData {
+	return &HelloData{
+		Protocol:    PROTOCOL_VERSION,
+		Build:       GAME_BUILD,
+		ContentHash: pack.Hash(),
+		Session:     session,
+	}
+}
+
+// checkHello сравнивает приветствие другой стороны с нашим и объясняет,
+// что именно не совпало
+func checkHello(pack *ContentPack, remote *HelloData) error {
+	if remote == nil {
+		return errors.New("другая сторона не прислала приветствие — вероятно, это старая версия игры без поддержки протокола")
+	}
+	if remote.Protocol != PROTOCOL_VERSION {
+		return fmt.Errorf("несовместимая версия протокола: у нас %d, у другой стороны %d (сборка %s)",
+			PROTOCOL_VERSION, remote.Protocol, remote.Build)
+	}
+	if local := pack.Hash(); remote.ContentHash != local {
+		return fmt.Errorf("наборы контента различаются: у нас %s, у другой стороны %s — используйте одинаковый %s",
+			shortHash(local), shortHash(remote.ContentHash), CONTENT_FILE)
+	}
+	return nil
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// readHello ждёт приветствие не дольше HANDSHAKE_TIMEOUT
+func readHello(c *Connection) (*HelloData, error) {
+	c.conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	msg, err := c.Next()
+	if err != nil {
+		return nil, err
+	}
+	switch msg.Type {
+	case Hello:
+		return msg.Hello, nil
+	case Disconnect:
+		return nil, fmt.Errorf("%w: %s", errRejected, msg.Text)
+	}
+	return nil, nil
+}
+
+// serverHandshake принимает и проверяет приветствие клиента, а на
+// закрытом сервере — и пароль. При несовпадении клиент получает Disconnect
+// с причиной. Ответное приветствие с токеном сессии отправляет вызывающий.
+func serverHandshake(c *Connection, pack *ContentPack, password string) (*HelloData, error) {
+	remote, err := readHello(c)
+	if err == nil {
+		err = checkHello(pack, remote)
+	}
+	if err == nil && password != "" {
+		err = checkPassword(c, pack, password)
+	}
+	if err != nil {
+		c.Send(GameMessage{Type: Disconnect, Text: "Сервер: " + err.Error()})
+		return nil, err
+	}
+	return remote, nil
+}
+
+// checkPassword отправляет клиенту случайный вызов и проверяет ответ. Сам
+// пароль по сети не передаётся, но без TLS подслушавший вызов и ответ может
+// подбирать пароль по словарю у себя, сколько угодно раз. Поэтому пароль
+// без -tls защищает только от случайных гостей.
+func checkPassword(c *Connection, pack *ContentPack, password string) error {
+	challenge := make([]byte, 16)
+	if _, err := cryptorand.Read(challenge); err != nil {
+		return err
+	}
+	hello := localHello(pack, "")
+	hello.Challenge = challenge
+	if err := c.Send(GameMessage{Type: Hello, Hello: hello}); err != nil {
+		return err
+	}
+
+	reply, err := readHello(c)
+	if err != nil {
+		return err
+	}
+	if reply == nil || !hmac.Equal(reply.Proof, passwordProof(password, challenge)) {
+		return errors.New("неверный пароль")
+	}
+	return nil
+}
+
+func passwordProof(password string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// clientHandshake представляется серверу. Непустой session просит вернуть
+// клиента в прерванный бой, password нужен для закрытого сервера.
+func clientHandshake(c *Connection, pack *ContentPack, session, password string) (*HelloData, error) {
+	hello := localHello(pack, session)
+	if err := c.Send(GameMessage{Type: Hello, Hello: hello}); err != nil {
+		return nil, err
+	}
+	remote, err := readHello(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if remote != nil && remote.Challenge != nil {
+		if password == "" {
+			return nil, errPasswordRequired
+		}
+		hello.Proof = passwordProof(password, remote.Challenge)
+		if err := c.Send(GameMessage{Type: Hello, Hello: hello}); err != nil {
+			return nil, err
+		}
+		if remote, err = readHello(c); err != nil {
+			return nil, err
+		}
+	}
+	return remote, checkHello(pack, remote)
+}
+
+// ==================== ШИФРОВАНИЕ ====================
+// Сервер сам выпускает себе сертификат, поэтому проверить его по цепочке
+// доверия нельзя. Клиент запоминает отпечаток при первом подключении и
+// дальше сверяет его — так же, как это делает ssh. Интернет не нужен.
+
+// serverTLSConfig загружает сертификат сервера, при первом запуске создаёт его
+func serverTLSConfig(ui GameIO) (*tls.Config, string, error) {
+	certPath := filepath.Join(TLS_DIR, "server.crt")
+	keyPath := filepath.Join(TLS_DIR, "server.key")
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if err = createCertificate(certPath, keyPath); err != nil {
+			return nil, "", err
+		}
+		ui.Printf("Создан самоподписанный сертификат: %s\n", certPath)
+		cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return config, certFingerprint(cert.Certificate[0]), nil
+}
+
+func createCertificate(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := cryptorand.Int(cryptorand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "4ver server"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(TLS_CERT_YEARS, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(TLS_DIR, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+}
+
+// certFingerprint — SHA-256 сертификата группами по 4 символа, чтобы его
+// было удобно сверять глазами
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexSum := hex.EncodeToString(sum[:])
+	groups := make([]string, 0, len(hexSum)/4)
+	for i := 0; i < len(hexSum); i += 4 {
+		groups = append(groups, hexSum[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
+
+// dialTLS подключается к серверу и проверяет отпечаток его сертификата.
+// Незнакомый сервер добавляется в known_hosts только с согласия игрока.
+func dialTLS(ui GameIO, address string) (net.Conn, error) {
+	conn, fingerprint, err := dialTLSOnce(address)
+	if err != nil {
+		return nil, err
+	}
+
+	known, err := loadKnownHosts()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if pinned, ok := known[address]; ok {
+		if pinned != fingerprint {
+			conn.Close()
+			return nil, fmt.Errorf("отпечаток сертификата сервера %s изменился!\nОжидался: %s\nПолучен:  %s\n"+
+				"Возможна подмена сервера. Если сертификат действительно пересоздан, удалите строку сервера из %s",
+				address, pinned, fingerprint, knownHostsPath())
+		}
+		return conn, nil
+	}
+
+	// Сервер ждёт приветствие не дольше HANDSHAKE_TIMEOUT, а игрок может
+	// сверять отпечаток сколько угодно. Поэтому соединение закрывается до
+	// вопроса, а после согласия открывается заново.
+	conn.Close()
+	ui.Printf("\n🔒 Сервер %s подключается впервые.\n", address)
+	ui.Printf("Отпечаток сертификата: %s\n", fingerprint)
+	ui.Println("Сверьте его с отпечатком, который сервер показал при запуске.")
+	ui.Print("Доверять этому серверу? (y/n): ")
+	if ok, err := confirm(ui); !ok {
+		if err == nil {
+			err = errors.New("сертификат сервера не принят")
+		}
+		return nil, err
+	}
+
+	conn, again, err := dialTLSOnce(address)
+	if err != nil {
+		return nil, err
+	}
+	if again != fingerprint {
+		conn.Close()
+		return nil, fmt.Errorf("сервер %s сменил сертификат во время подключения", address)
+	}
+	if err := rememberHost(address, fingerprint); err != nil {
+		ui.Println("Ошибка сохранения отпечатка:", err)
+	}
+	return conn, nil
+}
+
+// dialTLSOnce подключается к серверу и возвращает отпечаток его сертификата
+func dialTLSOnce(address string) (net.Conn, string, error) {
+	dialer := &net.Dialer{Timeout: HANDSHAKE_TIMEOUT}
+	// Цепочку не проверяем: сертификат самоподписанный, его проверяет отпечаток
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, certFingerprint(conn.ConnectionState().PeerCertificates[0].Raw), nil
+}
+
+func knownHostsPath() string {
+	return filepath.Join(TLS_DIR, "known_hosts")
+}
+
+// loadKnownHosts читает запомненные отпечатки: по строке "адрес отпечаток"
+func loadKnownHosts() (map[string]string, error) {
+	known := make(map[string]string)
+	data, err := os.ReadFile(knownHostsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			known[fields[0]] = fields[1]
+		}
+	}
+	return known, nil
+}
+
+func rememberHost(address, fingerprint string) error {
+	if err := os.MkdirAll(TLS_DIR, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(knownHostsPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s\n", address, fingerprint)
+	return err
+}
+
+// ==================== СЕТЕВЫЕ ФУНКЦИИ ====================
+func playerToPlayerData(p *Player) *PlayerData {
+	return &PlayerData{
+		Name:         p.Name,
+		HP:           p.HP,
+		MaxHP:        p.MaxHP,
+		Mana:         p.Mana,
+		MaxMana:      p.MaxMana,
+		BaseStrength: p.BaseStrength,
+		Gold:         p.Gold,
+		Inventory:    p.Inventory,
+		Equipment:    p.Equipment,
+		Abilities:    p.Abilities,
+		Effects:      p.Effects,
+	}
+}
+
+func playerDataToPlayer(pd *PlayerData) *Player {
+	return &Player{
+		Name:         pd.Name,
+		HP:           pd.HP,
+		MaxHP:        pd.MaxHP,
+		Mana:         pd.Mana,
+		MaxMana:      pd.MaxMana,
+		BaseStrength: pd.BaseStrength,
+		Strength:     pd.BaseStrength,
+		Gold:         pd.Gold,
+		Inventory:    pd.Inventory,
+		Equipment:    pd.Equipment,
+		Abilities:    pd.Abilities,
+		Effects:      pd.Effects,
+	}
+}
+
+func newNetworkPlayer(pack *ContentPack, name string) *Player {
+	player := newCampaignPlayer(pack, name)
+	player.Abilities = append(player.Abilities, pack.startingAbilities()...)
+	return player
+}
+
+// sanitizeLoadout собирает игрока клиента по правилам сервера. От клиента
+// берутся только имя и выбор экипировки из стартового набора, всё остальное
+// (HP, мана, сила, золото, способности) сервер выставляет сам по набору pack.
+func sanitizeLoadout(pack *ContentPack, claimed *PlayerData) *Player {
+	name := ""
+	if claimed != nil {
+		name = strings.TrimSpace(claimed.Name)
+	}
+	if name == "" {
+		name = "Игрок"
+	}
+	if runes := []rune(name); len(runes) > 32 {
+		name = string(runes[:32])
+	}
+
+	player := newNetworkPlayer(pack, name)
+	if claimed == nil {
+		return player
+	}
+	for _, wanted := range claimed.Equipment {
+		for i, owned := range player.Inventory {
+			if owned.ID == wanted.ID && (owned.Type == Weapon || owned.Type == Armor) {
+				player.UseItem(pack, i, nil)
+				break
+			}
+		}
+	}
+	return player
+}
+
+// ==================== СЕТЕВАЯ БИТВА ====================
+func actionToMessage(action CombatAction, round int) GameMessage {
+	return GameMessage{
+		Type:      PlayerAction,
+		Round:     round,
+		Action:    action.Kind(),
+		HitPart:   action.HitPart,
+		BlockPart: action.BlockPart,
+		AbilityID: action.AbilityID,
+		ItemID:    action.ItemID,
+	}
+}
+
+func messageToAction(msg GameMessage) CombatAction {
+	return CombatAction{
+		HitPart:   msg.HitPart,
+		BlockPart: msg.BlockPart,
+		AbilityID: msg.AbilityID,
+		ItemID:    msg.ItemID,
+	}
+}
+
+func printNetworkRoundHeader(ui GameIO, round int, me, opponent *Player) {
+	ui.Printf("\n========== РАУНД %d ==========\n", round)
+	ui.Printf("%s: %d HP, %d маны%s | %s: %d HP, %d маны%s\n",
+		me.Name, me.HP, me.Mana, formatEffects(me),
+		opponent.Name, opponent.HP, opponent.Mana, formatEffects(opponent))
+}
+
+func printMatchOutcome(ui GameIO, winner, loser, reason string) {
+	ui.Println("\n========== БИТВА ЗАВЕРШЕНА ==========")
+	if reason != "" {
+		ui.Println(reason)
+	}
+	if winner == "" {
+		ui.Println("\nНичья! Оба бойца пали.")
+		return
+	}
+	ui.Printf("\n🏆 %s ПОБЕЖДАЕТ! 🏆\n", winner)
+	if reason == "" {
+		ui.Printf("%s повержен!\n", loser)
+	}
+}
+
+// Seat — место бойца в сетевом матче с точки зрения сервера
+type Seat interface {
+	Player() *Player
+	// StartTurn сообщает игроку, до какого момента ждётся его ход
+	StartTurn(round int, deadline time.Time)
+	// RequestAction ждёт скрытый выбор игрока не дольше deadline
+	RequestAction(round int, opponent *Player, deadline time.Time) (CombatAction, error)
+	RejectAction(reason string)
+	SendRound(round int, result RoundResult, opponent *Player)
+	Finish(winner, loser, reason string)
+}
+
+// Session — сессия игрока на сервере. Она переживает обрыв соединения:
+// клиент может вернуться с тем же токеном и продолжить бой.
+type Session struct {
+	Token   string
+	mu      sync.Mutex
+	conn    *Connection
+	resumed chan *Connection
+}
+
+func newSession(conn *Connection) *Session {
+	return &Session{
+		Token:   newSessionToken(),
+		conn:    conn,
+		resumed: make(chan *Connection, 1),
+	}
+}
+
+func newSessionToken() string {
+	buf := make([]byte, 16)
+	cryptorand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (s *Session) Conn() *Connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// Resume подменяет соединение после переподключения клиента
+func (s *Session) Resume(conn *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.Close()
+	s.conn = conn
+	// В канале держим только самое свежее соединение
+	select {
+	case <-s.resumed:
+	default:
+	}
+	s.resumed <- conn
+}
+
+// RemoteSeat — игрок на другом конце соединения. От него принимаются только
+// намерения (PlayerAction), состояние боя он получает от сервера.
+type RemoteSeat struct {
+	ui      GameIO // консоль сервера
+	player  *Player
+	session *Session
+	notify  func(string) // сообщение сопернику
+}
+
+func newRemoteSeat(ui GameIO, player *Player, session *Session, notify func(string)) *RemoteSeat {
+	return &RemoteSeat{ui: ui, player: player, session: session, notify: notify}
+}
+
+func (r *RemoteSeat) Player() *Player {
+	return r.player
+}
+
+func (r *RemoteSeat) RequestAction(round int, opponent *Player, deadline time.Time) (CombatAction, error) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	conn := r.session.Conn()
+	for {
+		select {
+		case conn = <-r.session.resumed:
+			r.sendResume(conn, round, opponent, deadline)
+		case msg, ok := <-conn.Actions:
+			if !ok {
+				if conn, ok = r.awaitReconnect(round, opponent, deadline); !ok {
+					return CombatAction{}, fmt.Errorf("%s не вернулся после обрыва связи", r.player.Name)
+				}
+				continue
+			}
+			// Ход, отправленный после таймаута, относится к уже сыгранному раунду
+			if msg.Round != round {
+				continue
+			}
+			return messageToAction(msg), nil
+		case msg, ok := <-conn.Control:
+			if !ok {
+				if conn, ok = r.awaitReconnect(round, opponent, deadline); !ok {
+					return CombatAction{}, fmt.Errorf("%s не вернулся после обрыва связи", r.player.Name)
+				}
+				continue
+			}
+			if msg.Type == Disconnect {
+				return CombatAction{}, errors.New("игрок отключился")
+			}
+		case <-timer.C:
+			return CombatAction{}, errTurnTimeout
+		}
+	}
+}
+
+// awaitReconnect держит место игрока RECONNECT_GRACE после обрыва связи
+func (r *RemoteSeat) awaitReconnect(round int, opponent *Player, deadline time.Time) (*Connection, bool) {
+	grace := int(RECONNECT_GRACE / time.Second)
+	r.ui.Printf("[лобби] %s потерял связь, место держится %d секунд\n", r.player.Name, grace)
+	r.notify(fmt.Sprintf("%s потерял связь. Ждём его возвращения до %d секунд...", r.player.Name, grace))
+
+	timer := time.NewTimer(RECONNECT_GRACE)
+	defer timer.Stop()
+
+	select {
+	case conn := <-r.session.resumed:
+		r.sendResume(conn, round, opponent, deadline)
+		return conn, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+// sendResume возвращает переподключившегося игрока в текущий раунд
+func (r *RemoteSeat) sendResume(conn *Connection, round int, opponent *Player, deadline time.Time) {
+	conn.Send(GameMessage{
+		Type:     MatchResume,
+		Round:    round,
+		Seconds:  secondsUntil(deadline),
+		Player:   playerToPlayerData(r.player),
+		Opponent: playerToPlayerData(opponent),
+	})
+	r.ui.Printf("[лобби] %s вернулся в бой\n", r.player.Name)
+	r.notify(fmt.Sprintf("%s вернулся в бой!", r.player.Name))
+}
+
+func (r *RemoteSeat) StartTurn(round int, deadline time.Time) {
+	r.session.Conn().Send(GameMessage{Type: TurnStart, Round: round, Seconds: secondsUntil(deadline)})
+}
+
+func secondsUntil(deadline time.Time) int {
+	return int(time.Until(deadline).Round(time.Second) / time.Second)
+}
+
+func (r *RemoteSeat) RejectAction(reason string) {
+	r.session.Conn().Send(GameMessage{Type: ActionRejected, Text: reason})
+}
+
+func (r *RemoteSeat) SendRound(round int, result RoundResult, opponent *Player) {
+	r.session.Conn().Send(GameMessage{
+		Type:     GameStateMsg,
+		Round:    round,
+		Player:   playerToPlayerData(r.player),
+		Opponent: playerToPlayerData(opponent),
+		Result:   &result,
+	})
+}
+
+func (r *RemoteSeat) Finish(winner, loser, reason string) {
+	r.session.Conn().Send(GameMessage{Type: MatchEnd, Text: reason})
+}
+
+// Audience — зрители боя. Они получают только раскрытые итоги раундов,
+// полоски HP и маны и чат, но никогда не видят скрытый выбор до вскрытия.
+type Audience struct {
+	mu       sync.Mutex
+	conns    []*Connection
+	snapshot GameMessage
+	timeout  time.Duration // ожидание медленного зрителя, по умолчанию SPECTATOR_TIMEOUT
+}
+
+// snapshotData копирует состояние бойца, чтобы его можно было отправить
+// зрителю из другой горутины, пока бой идёт дальше
+func snapshotData(p *Player) *PlayerData {
+	data := playerToPlayerData(p)
+	data.Inventory = append([]Item(nil), p.Inventory...)
+	data.Equipment = append([]Item(nil), p.Equipment...)
+	data.Abilities = append([]Ability(nil), p.Abilities...)
+	data.Effects = append(StatusEffects(nil), p.Effects...)
+	return data
+}
+
+func (a *Audience) Add(conn *Connection) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	start := a.snapshot
+	a.mu.Unlock()
+	// До первого снимка зритель получит начало боя вместе с остальными.
+	// Раунд, разосланный до добавления, он пропустит, но следующий снимок
+	// всё равно содержит бой целиком.
+	if start.Player != nil {
+		start.Type = MatchStart
+		start.Result = nil
+		if conn.SendTimeout(start, a.sendTimeout()) != nil {
+			conn.Close()
+			return
+		}
+	}
+	a.mu.Lock()
+	a.conns = append(a.conns, conn)
+	a.mu.Unlock()
+}
+
+func (a *Audience) Remove(conn *Connection) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, c := range a.conns {
+		if c == conn {
+			a.conns = append(a.conns[:i], a.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (a *Audience) Count() int {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.conns)
+}
+
+// Round возвращает номер последнего сыгранного раунда
+func (a *Audience) Round() int {
+	if a == nil {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.snapshot.Round
+}
+
+func (a *Audience) sendTimeout() time.Duration {
+	if a.timeout > 0 {
+		return a.timeout
+	}
+	return SPECTATOR_TIMEOUT
+}
+
+// Broadcast рассылает сообщение всем зрителям сразу и ждёт не дольше
+// sendTimeout. Зритель, который не успел принять сообщение, отключается.
+func (a *Audience) Broadcast(msg GameMessage) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	conns := append([]*Connection(nil), a.conns...)
+	a.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Connection) {
+			defer wg.Done()
+			if c.SendTimeout(msg, a.sendTimeout()) != nil {
+				c.Close()
+				a.Remove(c)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// Update запоминает состояние после раунда и рассылает его зрителям.
+// Без результата рассылает начало боя.
+func (a *Audience) Update(round int, first, second *Player, result *RoundResult) {
+	if a == nil {
+		return
+	}
+	msg := GameMessage{
+		Type:     GameStateMsg,
+		Round:    round,
+		Player:   snapshotData(first),
+		Opponent: snapshotData(second),
+		Result:   result,
+	}
+	a.mu.Lock()
+	a.snapshot = msg
+	a.mu.Unlock()
+	if result == nil {
+		msg.Type = MatchStart
+	}
+	a.Broadcast(msg)
+}
+
+func (a *Audience) Finish(winner, loser, reason string) {
+	a.Broadcast(GameMessage{Type: MatchEnd, Text: matchOutcomeText(winner, loser, reason)})
+}
+
+// matchOutcomeText — итог боя одной строкой для зрителей и записей
+func matchOutcomeText(winner, loser, reason string) string {
+	switch {
+	case winner == "":
+		return strings.TrimSpace(reason + " Ничья!")
+	case reason == "":
+		return fmt.Sprintf("🏆 %s побеждает! %s повержен!", winner, loser)
+	}
+	return fmt.Sprintf("%s 🏆 %s побеждает!", reason, winner)
+}
+
+// requestValidAction спрашивает ход, пока игрок не пришлёт допустимое
+// действие или не выйдет время
+func requestValidAction(seat Seat, round int, opponent *Player, deadline time.Time) (CombatAction, error) {
+	for {
+		action, err := seat.RequestAction(round, opponent, deadline)
+		if err != nil {
+			return action, err
+		}
+		if err := validateAction(seat.Player(), action); err != nil {
+			seat.RejectAction(err.Error())
+			continue
+		}
+		return action, nil
+	}
+}
+
+type seatChoice struct {
+	action CombatAction
+	err    error
+}
+
+// MatchRules — настройки сетевого боя на сервере
+type MatchRules struct {
+	TurnTimeout time.Duration // время на ход
+	AFKLimit    int           // сколько таймаутов подряд до технического поражения, 0 — без ограничения
+}
+
+// collectActions собирает скрытые выборы обоих мест одновременно. Кто не
+// успел до конца таймера, получает действие по умолчанию: защиту случайной
+// части тела без атаки.
+func collectActions(game *GameSession, seats [2]Seat, round int, timeout time.Duration) ([2]CombatAction, [2]bool, [2]error) {
+	deadline := time.Now().Add(timeout)
+	var choices [2]chan seatChoice
+	for i, seat := range seats {
+		seat.StartTurn(round, deadline)
+		choices[i] = make(chan seatChoice, 1)
+		go func(i int, seat Seat) {
+			action, err := requestValidAction(seat, round, seats[1-i].Player(), deadline)
+			choices[i] <- seatChoice{action, err}
+		}(i, seat)
+	}
+
+	var actions [2]CombatAction
+	var timedOut [2]bool
+	var errs [2]error
+	for i := range seats {
+		choice := <-choices[i]
+		switch {
+		case errors.Is(choice.err, errTurnTimeout):
+			actions[i] = idleAction(BodyPart(game.Rand.Intn(4)))
+			timedOut[i] = true
+		case choice.err != nil:
+			errs[i] = choice.err
+		default:
+			actions[i] = choice.action
+		}
+	}
+	return actions, timedOut, errs
+}
+
+// runMatch — авторитетный цикл боя на сервере: собирает скрытые действия
+// обоих мест, разыгрывает раунд и одновременно раскрывает результат
+func runMatch(game *GameSession, seats [2]Seat, rules MatchRules, audience *Audience) {
+	first, second := seats[0].Player(), seats[1].Player()
+	var idle [2]int
+	audience.Update(0, first, second, nil)
+
+	for round := 1; first.IsAlive() && second.IsAlive(); round++ {
+		actions, timedOut, errs := collectActions(game, seats, round, rules.TurnTimeout)
+		for i := range seats {
+			if errs[i] != nil {
+				leaver, stayer := seats[i].Player(), seats[1-i].Player()
+				reason := fmt.Sprintf("%s покинул бой — техническое поражение.", leaver.Name)
+				seats[1-i].Finish(stayer.Name, leaver.Name, reason)
+				audience.Finish(stayer.Name, leaver.Name, reason)
+				return
+			}
+		}
+
+		result := resolveRound(game.Content, first, second, actions[0], actions[1], rollCrits(game.Rand, first, second))
+		seats[0].SendRound(round, result, second)
+		seats[1].SendRound(round, result, first)
+		audience.Update(round, first, second, &result)
+
+		for i := range seats {
+			if timedOut[i] {
+				idle[i]++
+			} else {
+				idle[i] = 0
+			}
+		}
+		if rules.AFKLimit <= 0 || (idle[0] < rules.AFKLimit && idle[1] < rules.AFKLimit) {
+			continue
+		}
+
+		winner, loser := "", ""
+		reason := "Оба бойца бездействуют — бой прекращён."
+		for i := range seats {
+			if idle[i] >= rules.AFKLimit && idle[1-i] < rules.AFKLimit {
+				winner, loser = seats[1-i].Player().Name, seats[i].Player().Name
+				reason = fmt.Sprintf("%s бездействует (пропущено ходов подряд: %d) — техническое поражение.", loser, idle[i])
+			}
+		}
+		for _, seat := range seats {
+			seat.Finish(winner, loser, reason)
+		}
+		audience.Finish(winner, loser, reason)
+		return
+	}
+
+	winner, loser := first.Name, second.Name
+	switch {
+	case !first.IsAlive() && !second.IsAlive():
+		winner, loser = "", ""
+	case !first.IsAlive():
+		winner, loser = second.Name, first.Name
+	}
+	for _, seat := range seats {
+		seat.Finish(winner, loser, "")
+	}
+	audience.Finish(winner, loser, "")
+}
+
+// networkFight — бой на стороне клиента. Клиент отправляет только свои
+// действия, а HP, ману и эффекты обоих бойцов берёт из ответа сервера.
+// Ошибка возвращается, только если связь потеряна и вернуться не удалось.
+func networkFight(myPlayer, opponentPlayer *Player, session *clientSession) error {
+	ui := session.ui
+	round := 1
+	defer session.stopCountdown()
+	replay := startReplay(session.record, "network", 0, myPlayer, opponentPlayer)
+
+	sendChat := func(text string) {
+		session.conn.Send(GameMessage{Type: ChatMessage, Text: text})
+	}
+
+	for myPlayer.IsAlive() && opponentPlayer.IsAlive() {
+		printNetworkRoundHeader(ui, round, myPlayer, opponentPlayer)
+
+		ui.Printf("\n--- Ваш ход (%s) ---\n", myPlayer.Name)
+		action, err := promptCombatAction(ui, session.pack, myPlayer, sendChat)
+		if err != nil {
+			return err
+		}
+		if session.roundPassed(round) {
+			// Пока игрок думал, время хода вышло: итог раунда уже в пути,
+			// а действие для следующего раунда он выберет заново
+			ui.Println("\n⌛ Ход не успел: раунд разыгран без вас.")
+		} else {
+			session.conn.Send(actionToMessage(action, round))
+		}
+
+		ui.Println("\n⏳ Ожидание хода противника...")
+		msg, err := session.conn.Next()
+		if err != nil {
+			if msg, err = session.reconnect(); err != nil {
+				return err
+			}
+		}
+
+		switch msg.Type {
+		case MatchResume:
+			*myPlayer = *playerDataToPlayer(msg.Player)
+			*opponentPlayer = *playerDataToPlayer(msg.Opponent)
+			round = msg.Round
+			ui.Printf("✅ Связь восстановлена! Бой продолжается с раунда %d\n", round)
+			if replay != nil {
+				// Раунды, сыгранные без связи, до клиента не дошли
+				ui.Println("Запись боя прервана: часть раундов прошла без вас.")
+				replay = nil
+			}
+			session.startCountdown(round, msg.Seconds)
+			continue
+		case ActionRejected:
+			ui.Println("Сервер отклонил действие:", msg.Text)
+			continue
+		case MatchEnd:
+			session.stopCountdown()
+			ui.Println("\n========== БИТВА ЗАВЕРШЕНА ==========")
+			ui.Println(msg.Text)
+			replay.Finish(ui, msg.Text)
+			return nil
+		case Disconnect:
+			return errors.New(msg.Text)
+		case GameStateMsg:
+		default:
+			continue
+		}
+
+		session.stopCountdownThrough(msg.Round)
+		if msg.Player == nil || msg.Opponent == nil || msg.Result == nil {
+			return errors.New("неполное состояние от сервера")
+		}
+		*myPlayer = *playerDataToPlayer(msg.Player)
+		*opponentPlayer = *playerDataToPlayer(msg.Opponent)
+		replay.Record(*msg.Result)
+		printRoundResults(ui, *msg.Result)
+		round = msg.Round + 1
+	}
+
+	var winner, loser string
+	switch {
+	case !myPlayer.IsAlive() && !opponentPlayer.IsAlive():
+	case myPlayer.IsAlive():
+		winner, loser = myPlayer.Name, opponentPlayer.Name
+	default:
+		winner, loser = opponentPlayer.Name, myPlayer.Name
+	}
+	printMatchOutcome(ui, winner, loser, "")
+	replay.Finish(ui, matchOutcomeText(winner, loser, ""))
+
+	// Сервер закрывает бой сообщением MatchEnd, после него игрок снова в лобби
+	for {
+		msg, err := session.conn.Next()
+		if err != nil {
+			return err
+		}
+		if msg.Type == MatchEnd {
+			return nil
+		}
+	}
+}
+
+// ==================== ЛОББИ ====================
+type clientState int
+
+const (
+	clientIdle clientState = iota
+	clientWaiting
+	clientPlaying
+)
+
+func (s clientState) String() string {
+	return []string{"свободен", "ждёт соперника", "в бою"}[s]
+}
+
+// LobbyClient — игрок, подключённый к серверу
+type LobbyClient struct {
+	*Session
+	Name      string
+	loadout   *PlayerData
+	state     clientState
+	challenge string // кого игрок вызвал на бой
+	match     *Match
+	matched   chan *Match
+}
+
+// Match — бой, идущий на сервере в своей горутине
+type Match struct {
+	ID       int
+	Seed     int64
+	Clients  [2]*LobbyClient
+	audience *Audience
+	done     chan struct{}
+}
+
+// Lobby хранит подключённых игроков, очередь и идущие бои. Каждый клиент
+// обслуживается своей горутиной, бои — отдельными горутинами.
+type Lobby struct {
+	mu       sync.Mutex
+	clients  map[string]*LobbyClient
+	sessions map[string]*LobbyClient
+	queue    []*LobbyClient
+	matches  map[int]*Match
+	nextID   int
+	closing  bool
+	running  sync.WaitGroup
+	rules    MatchRules
+	password string       // пустой — сервер открыт для всех
+	game     *GameSession // раздаёт зёрна боям
+}
+
+func NewLobby(game *GameSession, rules MatchRules, password string) *Lobby {
+	return &Lobby{
+		rules:    rules,
+		password: password,
+		game:     game,
+		clients:  make(map[string]*LobbyClient),
+		sessions: make(map[string]*LobbyClient),
+		matches:  make(map[int]*Match),
+	}
+}
+
+// Serve принимает подключения, пока слушатель не закрыт
+func (l *Lobby) Serve(ln net.Listener) {
+	for {
+		netConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go l.serveClient(netConn)
+	}
+}
+
+func (l *Lobby) serveClient(netConn net.Conn) {
+	ui := l.game.IO
+	conn := NewConnection(netConn)
+	defer conn.Close()
+
+	hello, err := serverHandshake(conn, l.game.Content, l.password)
+	if err != nil {
+		ui.Printf("[лобби] Отклонено подключение %s: %v\n", netConn.RemoteAddr(), err)
+		return
+	}
+
+	var client *LobbyClient
+	if hello.Session != "" {
+		client, err = l.resume(hello.Session, conn)
+		if err != nil {
+			conn.Send(GameMessage{Type: Disconnect, Text: err.Error()})
+			return
+		}
+	} else {
+		session := newSession(conn)
+		conn.Send(GameMessage{Type: Hello, Hello: localHello(l.game.Content, session.Token)})
+
+		msg, err := conn.Next()
+		if err != nil {
+			return
+		}
+		// Зритель вместо данных игрока сразу присылает команду
+		if msg.Type == LobbyCommand {
+			l.serveSpectator(conn, msg)
+			return
+		}
+		if msg.Type != GameStateMsg {
+			return
+		}
+		client, err = l.join(msg.Player, session)
+		if err != nil {
+			conn.Send(GameMessage{Type: Disconnect, Text: err.Error()})
+			return
+		}
+		ui.Printf("[лобби] %s подключился\n", client.Name)
+		conn.Send(GameMessage{
+			Type:   LobbyReply,
+			Text:   fmt.Sprintf("Добро пожаловать в лобби, %s!", client.Name),
+			Player: client.loadout,
+		})
+	}
+
+	// Если клиент переподключился, этим соединением больше никто не владеет
+	defer func() {
+		if client.Conn() == conn {
+			l.leave(client)
+		}
+	}()
+
+	go l.relayChat(client, conn)
+
+	// Вернувшийся игрок сначала доигрывает бой
+	l.mu.Lock()
+	m := client.match
+	l.mu.Unlock()
+	if m != nil {
+		<-m.done
+	}
+
+	for {
+		msg, err := conn.Next()
+		if err != nil || msg.Type == Disconnect {
+			return
+		}
+		if msg.Type == LobbyCommand && !l.handleCommand(client, msg) {
+			return
+		}
+	}
+}
+
+// resume возвращает клиента в идущий бой по токену сессии
+func (l *Lobby) resume(token string, conn *Connection) (*LobbyClient, error) {
+	l.mu.Lock()
+	client := l.sessions[token]
+	playing := client != nil && client.state == clientPlaying
+	l.mu.Unlock()
+
+	if !playing {
+		return nil, errors.New("сессия не найдена или бой уже завершён")
+	}
+	conn.Send(GameMessage{Type: Hello, Hello: localHello(l.game.Content, token)})
+	client.Resume(conn)
+	return client, nil
+}
+
+// handleCommand выполняет команду лобби. Возвращает false, если клиент
+// отключился во время ожидания боя.
+func (l *Lobby) handleCommand(c *LobbyClient, msg GameMessage) bool {
+	reply := func(text string) {
+		c.Conn().Send(GameMessage{Type: LobbyReply, Text: text})
+	}
+
+	switch msg.Action {
+	case "list":
+		reply(l.Describe())
+	case "challenge":
+		if err := l.challenge(c, strings.TrimSpace(msg.Text)); err != nil {
+			reply(err.Error())
+			return true
+		}
+		return l.awaitMatch(c)
+	case "queue":
+		if err := l.enqueue(c); err != nil {
+			reply(err.Error())
+			return true
+		}
+		return l.awaitMatch(c)
+	default:
+		reply("Неизвестная команда: " + msg.Action)
+	}
+	return true
+}
+
+func (l *Lobby) join(claimed *PlayerData, session *Session) (*LobbyClient, error) {
+	player := sanitizeLoadout(l.game.Content, claimed)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return nil, errors.New("сервер останавливается")
+	}
+
+	name := player.Name
+	for n := 2; l.clients[name] != nil; n++ {
+		name = fmt.Sprintf("%s (%d)", player.Name, n)
+	}
+	player.Name = name
+
+	client := &LobbyClient{
+		Session: session,
+		Name:    name,
+		loadout: playerToPlayerData(player),
+		matched: make(chan *Match, 1),
+	}
+	l.clients[name] = client
+	l.sessions[session.Token] = client
+	return client, nil
+}
+
+func (l *Lobby) leave(c *LobbyClient) {
+	ui := l.game.IO
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.removeFromQueueLocked(c)
+	delete(l.clients, c.Name)
+	delete(l.sessions, c.Token)
+	ui.Printf("[лобби] %s отключился\n", c.Name)
+}
+
+func (l *Lobby) removeFromQueueLocked(c *LobbyClient) {
+	for i, queued := range l.queue {
+		if queued == c {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// Describe возвращает список игроков и идущих боёв
+func (l *Lobby) Describe() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	names := make([]string, 0, len(l.clients))
+	for name := range l.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("=== ИГРОКИ В ЛОББИ ===\n")
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("  %s (%s)\n", name, l.clients[name].state))
+	}
+
+	ids := make([]int, 0, len(l.matches))
+	for id := range l.matches {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	sb.WriteString("=== ИДУЩИЕ БОИ ===\n")
+	if len(ids) == 0 {
+		sb.WriteString("  нет\n")
+	}
+	for _, id := range ids {
+		m := l.matches[id]
+		sb.WriteString(fmt.Sprintf("  #%d: %s VS %s (зрителей: %d)\n",
+			id, m.Clients[0].Name, m.Clients[1].Name, m.audience.Count()))
+	}
+	return sb.String()
+}
+
+// challenge вызывает игрока на бой. Если тот уже вызвал нас, бой начинается сразу.
+func (l *Lobby) challenge(c *LobbyClient, target string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	opponent := l.clients[target]
+	switch {
+	case l.closing:
+		return errors.New("сервер останавливается")
+	case opponent == nil:
+		return fmt.Errorf("игрок %q не найден", target)
+	case opponent == c:
+		return errors.New("нельзя вызвать самого себя")
+	case opponent.state == clientPlaying:
+		return fmt.Errorf("%s сейчас в бою", target)
+	}
+
+	l.removeFromQueueLocked(c)
+	c.state = clientWaiting
+	c.challenge = target
+
+	if opponent.state == clientWaiting && opponent.challenge == c.Name {
+		l.startMatchLocked(opponent, c)
+		return nil
+	}
+	opponent.Conn().Send(GameMessage{
+		Type: LobbyNotice,
+		Text: fmt.Sprintf("%s вызывает вас на бой! Вызовите %s в ответ, чтобы принять.", c.Name, c.Name),
+	})
+	c.Conn().Send(GameMessage{Type: LobbyNotice, Text: fmt.Sprintf("Вызов отправлен игроку %s", target)})
+	return nil
+}
+
+// enqueue ставит игрока в очередь и сводит первых двух ожидающих
+func (l *Lobby) enqueue(c *LobbyClient) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closing {
+		return errors.New("сервер останавливается")
+	}
+
+	c.state = clientWaiting
+	c.challenge = ""
+	l.queue = append(l.queue, c)
+	if len(l.queue) >= 2 {
+		l.startMatchLocked(l.queue[0], l.queue[1])
+	}
+	return nil
+}
+
+// cancelWait снимает игрока с ожидания. false — бой уже начался.
+func (l *Lobby) cancelWait(c *LobbyClient) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c.state != clientWaiting {
+		return false
+	}
+	c.state = clientIdle
+	c.challenge = ""
+	l.removeFromQueueLocked(c)
+	return true
+}
+
+// awaitMatch держит обработчик клиента, пока тот ждёт соперника или играет.
+// Возвращает false, если клиент отключился.
+func (l *Lobby) awaitMatch(c *LobbyClient) bool {
+	timer := time.NewTimer(LOBBY_WAIT_TIMEOUT)
+	defer timer.Stop()
+
+	for {
+		select {
+		case m := <-c.matched:
+			<-m.done
+			return true
+		case <-timer.C:
+			if l.cancelWait(c) {
+				c.Conn().Send(GameMessage{Type: MatchCancelled, Text: "Соперник не найден, ожидание отменено"})
+				return true
+			}
+		case msg, ok := <-c.Conn().Control:
+			if ok && msg.Type != Disconnect {
+				continue
+			}
+			if !l.cancelWait(c) {
+				// Бой уже начался — поражение ему засчитает runMatch
+				m := <-c.matched
+				<-m.done
+			}
+			return false
+		}
+	}
+}
+
+func (l *Lobby) startMatchLocked(a, b *LobbyClient) {
+	l.nextID++
+	m := &Match{
+		ID:       l.nextID,
+		Seed:     l.game.Rand.Int63(),
+		Clients:  [2]*LobbyClient{a, b},
+		audience: &Audience{},
+		done:     make(chan struct{}),
+	}
+	for _, c := range m.Clients {
+		l.removeFromQueueLocked(c)
+		c.state = clientPlaying
+		c.challenge = ""
+		c.match = m
+	}
+	l.matches[m.ID] = m
+
+	l.running.Add(1)
+	go l.runLobbyMatch(m)
+	a.matched <- m
+	b.matched <- m
+}
+
+func (l *Lobby) runLobbyMatch(m *Match) {
+	ui := l.game.IO
+	defer l.running.Done()
+	ui.Printf("[лобби] Бой #%d: %s VS %s (зерно %d)\n", m.ID, m.Clients[0].Name, m.Clients[1].Name, m.Seed)
+
+	// Каждый бой начинается с полного здоровья и выбранной в лобби экипировки
+	var fighters [2]*Player
+	for i, c := range m.Clients {
+		fighters[i] = sanitizeLoadout(l.game.Content, c.loadout)
+		fighters[i].Name = c.Name
+	}
+	var seats [2]Seat
+	for i, c := range m.Clients {
+		c.Conn().Send(GameMessage{
+			Type:     MatchStart,
+			Player:   playerToPlayerData(fighters[i]),
+			Opponent: playerToPlayerData(fighters[1-i]),
+		})
+		other := m.Clients[1-i]
+		seats[i] = newRemoteSeat(ui, fighters[i], c.Session, func(text string) {
+			other.Conn().Send(GameMessage{Type: LobbyNotice, Text: text})
+		})
+	}
+
+	game := NewGameSession(ui, l.game.Content, m.Seed)
+	game.Config = l.game.Config
+	runMatch(game, seats, l.rules, m.audience)
+	l.endMatch(m)
+}
+
+func (l *Lobby) endMatch(m *Match) {
+	ui := l.game.IO
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.matches, m.ID)
+	for _, c := range m.Clients {
+		c.state = clientIdle
+		c.match = nil
+		if l.closing {
+			c.Conn().Send(GameMessage{Type: Disconnect, Text: "Сервер остановлен"})
+			c.Conn().Close()
+		}
+	}
+	close(m.done)
+	ui.Printf("[лобби] Бой #%d завершён\n", m.ID)
+}
+
+// relayChat пересылает чат игрока его сопернику по текущему бою
+func (l *Lobby) relayChat(c *LobbyClient, conn *Connection) {
+	for msg := range conn.Chat {
+		l.mu.Lock()
+		m := c.match
+		l.mu.Unlock()
+		if m == nil {
+			continue
+		}
+		chat := GameMessage{Type: ChatMessage, Sender: c.Name, Text: msg.Text}
+		for _, other := range m.Clients {
+			if other != c {
+				other.Conn().Send(chat)
+			}
+		}
+		m.audience.Broadcast(chat)
+	}
+}
+
+// serveSpectator обслуживает зрителя: показывает список боёв и
+// подключает к выбранному
+func (l *Lobby) serveSpectator(conn *Connection, msg GameMessage) {
+	ui := l.game.IO
+	for {
+		if msg.Type == Disconnect {
+			return
+		}
+		if msg.Type == LobbyCommand {
+			switch msg.Action {
+			case "matches":
+				conn.Send(GameMessage{Type: LobbyReply, Matches: l.matchList()})
+			case "watch":
+				id, _ := strconv.Atoi(strings.TrimSpace(msg.Text))
+				l.mu.Lock()
+				m := l.matches[id]
+				l.mu.Unlock()
+				if m == nil {
+					conn.Send(GameMessage{Type: LobbyReply, Text: "Бой не найден или уже завершён"})
+					break
+				}
+				ui.Printf("[лобби] Зритель %s смотрит бой #%d\n", conn.conn.RemoteAddr(), m.ID)
+				m.audience.Add(conn)
+				select {
+				case <-m.done:
+				case <-conn.closed:
+				}
+				m.audience.Remove(conn)
+				return
+			}
+		}
+
+		var err error
+		if msg, err = conn.Next(); err != nil {
+			return
+		}
+	}
+}
+
+func (l *Lobby) matchList() []MatchInfo {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := make([]MatchInfo, 0, len(l.matches))
+	for _, m := range l.matches {
+		list = append(list, MatchInfo{
+			ID:         m.ID,
+			Players:    [2]string{m.Clients[0].Name, m.Clients[1].Name},
+			Round:      m.audience.Round(),
+			Spectators: m.audience.Count(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Shutdown отключает игроков в лобби и ждёт окончания идущих боёв не
+// дольше timeout, после чего обрывает оставшиеся соединения
+func (l *Lobby) Shutdown(timeout time.Duration) {
+	ui := l.game.IO
+	l.mu.Lock()
+	l.closing = true
+	var idle []*Connection
+	for _, c := range l.clients {
+		if c.state != clientPlaying {
+			idle = append(idle, c.Conn())
+		}
+	}
+	active := len(l.matches)
+	l.mu.Unlock()
+
+	// Отправка без блокировки лобби и параллельно: зависший клиент
+	// задержит остановку не дольше WRITE_TIMEOUT
+	var notified sync.WaitGroup
+	for _, conn := range idle {
+		notified.Add(1)
+		go func(conn *Connection) {
+			defer notified.Done()
+			conn.Send(GameMessage{Type: Disconnect, Text: "Сервер остановлен"})
+			conn.Close()
+		}(conn)
+	}
+	notified.Wait()
+
+	if active > 0 {
+		ui.Printf("Ожидание завершения боёв: %d...\n", active)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		ui.Println("Время ожидания истекло, оставшиеся бои прерваны")
+		l.mu.Lock()
+		for _, c := range l.clients {
+			c.Conn().Close()
+		}
+		l.mu.Unlock()
+		<-done
+	}
+}
+
+// plainPasswordWarning — предупреждение о пароле без шифрования, см. checkPassword
+const plainPasswordWarning = "⚠️ Пароль используется без -tls: перехватив вход, его можно подобрать по словарю. Включите -tls."
+
+// Серверная часть
+func runServer(game *GameSession, addr string) {
+	ui := game.IO
+	ui.Println("=== ЗАПУСК СЕРВЕРА ===")
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		ui.Println("Ошибка запуска сервера:", err)
+		return
+	}
+	if game.Config.TLS {
+		config, fingerprint, err := serverTLSConfig(ui)
+		if err != nil {
+			ln.Close()
+			ui.Println("Ошибка подготовки сертификата:", err)
+			return
+		}
+		ln = tls.NewListener(ln, config)
+		ui.Printf("🔒 Шифрование включено. Отпечаток сертификата:\n%s\n", fingerprint)
+		ui.Println("Сообщите его игрокам, чтобы они могли сверить его при первом подключении.")
+	}
+
+	rules := MatchRules{TurnTimeout: game.Config.TurnTimeout, AFKLimit: game.Config.AFKLimit}
+	if rules.TurnTimeout < 5*time.Second {
+		rules.TurnTimeout = 5 * time.Second
+	}
+	lobby := NewLobby(game, rules, game.Config.Password)
+	go lobby.Serve(ln)
+
+	ui.Printf("Сервер слушает %s, зерно %d\n", ln.Addr(), game.Seed)
+	ui.Printf("Время на ход: %d секунд, техническое поражение после %d пропусков подряд\n",
+		int(rules.TurnTimeout/time.Second), rules.AFKLimit)
+	if game.Config.Password != "" {
+		ui.Println("Сервер закрыт паролем")
+		if !game.Config.TLS {
+			ui.Println(plainPasswordWarning)
+		}
+	}
+	ui.Println("Команды: list — игроки и бои, stop — остановить сервер")
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	commands := make(chan string)
+	go func() {
+		// Без ввода сервер работает до Ctrl+C
+		for {
+			cmd, err := ui.ReadLine()
+			if err != nil {
+				return
+			}
+			commands <- cmd
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-interrupt:
+			running = false
+		case cmd := <-commands:
+			switch cmd {
+			case "list":
+				ui.Print(lobby.Describe())
+			case "stop":
+				running = false
+			case "":
+			default:
+				ui.Println("Неизвестная команда. Доступно: list, stop")
+			}
+		}
+	}
+
+	ui.Println("Остановка сервера...")
+	ln.Close()
+	lobby.Shutdown(SHUTDOWN_TIMEOUT)
+	ui.Println("Сервер остановлен.")
+}
+
+// Клиентская часть
+// Пустые address и name запрашиваются у игрока
+func runClient(game *GameSession, address, name string) error {
+	ui := game.IO
+	ui.Println("=== ПОДКЛЮЧЕНИЕ К СЕРВЕРУ ===")
+	if address == "" {
+		var err error
+		if address, err = promptServerAddress(ui, game.Config); err != nil {
+			return err
+		}
+	}
+
+	session := newClientSession(game, address)
+	if session.password != "" && !session.secure {
+		ui.Println(plainPasswordWarning)
+	}
+	if err := session.connect(); err != nil {
+		if isInputError(err) {
+			return err
+		}
+		ui.Println("Ошибка подключения к серверу:", err)
+		return nil
+	}
+	defer func() { session.conn.Close() }()
+	ui.Println("Подключено к серверу!")
+
+	if name == "" {
+		ui.Print("Введите ваше имя: ")
+		var err error
+		if name, err = ui.ReadLine(); err != nil {
+			return err
+		}
+	}
+
+	player := newNetworkPlayer(game.Content, name)
+
+	ui.Print("\nХотите управлять инвентарем перед боем? (y/n): ")
+	ok, err := confirm(ui)
+	if err == nil && ok {
+		err = manageInventory(ui, game.Content, player)
+	}
+	if err != nil {
+		return err
+	}
+
+	session.conn.Send(GameMessage{
+		Type:   GameStateMsg,
+		Player: playerToPlayerData(player),
+	})
+
+	msg, err := session.conn.Next()
+	if err != nil {
+		ui.Println("Ошибка входа в лобби:", err)
+		return nil
+	}
+	if msg.Type != LobbyReply {
+		ui.Println("Сервер отказал в подключении:", msg.Text)
+		return nil
+	}
+	ui.Println(msg.Text)
+
+	if err := lobbyMenu(session); err != nil {
+		if isInputError(err) {
+			return err
+		}
+		ui.Println("Соединение с сервером потеряно:", err)
+	}
+	return nil
+}
+
+// clientSession — подключение клиента к серверу. Токен сессии позволяет
+// вернуться в бой после обрыва связи.
+type clientSession struct {
+	ui       GameIO
+	pack     *ContentPack
+	address  string
+	secure   bool
+	password string
+	record   bool
+	token    string
+	conn     *Connection
+
+	countdownMu    sync.Mutex
+	countdown      chan struct{}
+	countdownRound int // раунд, к которому относится countdown
+	turn           int // последний раунд, о начале которого сообщил сервер
+}
+
+// newClientSession готовит подключение к серверу. Адрес вида tls://host:port
+// включает шифрование без флага -tls.
+func newClientSession(game *GameSession, address string) *clientSession {
+	s := &clientSession{
+		ui:       game.IO,
+		pack:     game.Content,
+		address:  address,
+		secure:   game.Config.TLS,
+		password: game.Config.Password,
+		record:   game.Config.Record,
+	}
+	if rest, ok := strings.CutPrefix(address, "tls://"); ok {
+		s.address, s.secure = rest, true
+	}
+	return s
+}
+
+func (s *clientSession) connect() error {
+	var netConn net.Conn
+	var err error
+	if s.secure {
+		netConn, err = dialTLS(s.ui, s.address)
+	} else {
+		netConn, err = net.Dial("tcp", s.address)
+	}
+	if err != nil {
+		return err
+	}
+	conn := NewConnection(netConn)
+	hello, err := clientHandshake(conn, s.pack, s.token, s.password)
+	if errors.Is(err, errPasswordRequired) && s.password == "" {
+		conn.Close()
+		s.ui.Print("🔑 Сервер закрыт паролем. Введите пароль: ")
+		password, inputErr := s.ui.ReadLine()
+		if inputErr != nil {
+			return inputErr
+		}
+		if s.password = password; s.password == "" {
+			return err
+		}
+		return s.connect()
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.token = hello.Session
+	s.conn = conn
 
-	encoder.Encode(GameMessage{
-		Type:   GameStateMsg,
-		Player: playerToPlayerData(player1),
-	})
+	go func() {
+		for msg := range conn.Notices {
+			if msg.Type == TurnStart {
+				s.startCountdown(msg.Round, msg.Seconds)
+				continue
+			}
+			s.ui.Printf("\n📢 %s\n", msg.Text)
+		}
+	}()
+	go func() {
+		for msg := range conn.Chat {
+			s.ui.Printf("\n[ЧАТ] %s: %s\n", msg.Sender, msg.Text)
+		}
+	}()
+	return nil
+}
 
-	var msg GameMessage
-	err = decoder.Decode(&msg)
-	if err != nil {
-		fmt.Println("Ошибка получения данных игрока 2:", err)
+// startCountdown показывает, сколько времени осталось на ход. Отсчёт
+// для более раннего раунда, чем уже идущий, не начинается.
+func (s *clientSession) startCountdown(round, seconds int) {
+	s.countdownMu.Lock()
+	if s.countdown != nil && s.countdownRound > round {
+		s.countdownMu.Unlock()
 		return
 	}
+	if s.countdown != nil {
+		close(s.countdown)
+	}
+	stop := make(chan struct{})
+	s.countdown, s.countdownRound = stop, round
+	if round > s.turn {
+		s.turn = round
+	}
+	s.countdownMu.Unlock()
+
+	out := s.ui
+	go func() {
+		deadline := time.Now().Add(time.Duration(seconds) * time.Second)
+		out.Printf("\n⏳ Раунд %d: на ход %d секунд\n", round, seconds)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				left := secondsUntil(deadline)
+				switch {
+				case left <= 0:
+					out.Println("\n⌛ Время хода истекло! Сервер выберет защиту за вас.")
+					return
+				case left == 30 || left == 10 || left <= 5:
+					out.Printf("\n⏳ Осталось %d сек.\n", left)
+				}
+			}
+		}
+	}()
+}
+
+func (s *clientSession) stopCountdown() {
+	s.stopCountdownThrough(math.MaxInt)
+}
+
+// stopCountdownThrough останавливает отсчёт, только если он относится к
+// раунду round или раньше. Сервер шлёт итог раунда и сразу начало
+// следующего, и уведомление о начале может обогнать разбор итога.
+func (s *clientSession) stopCountdownThrough(round int) {
+	s.countdownMu.Lock()
+	defer s.countdownMu.Unlock()
+	if s.countdown != nil && s.countdownRound <= round {
+		close(s.countdown)
+		s.countdown = nil
+	}
+}
+
+// roundPassed сообщает, что сервер уже начал раунд после round, то есть
+// разыграл round без действия игрока
+func (s *clientSession) roundPassed(round int) bool {
+	s.countdownMu.Lock()
+	defer s.countdownMu.Unlock()
+	return s.turn > round
+}
+
+// reconnect пытается вернуться в прерванный бой, пока сервер держит место
+func (s *clientSession) reconnect() (GameMessage, error) {
+	s.conn.Close()
+	s.ui.Println("\n⚠️ Связь с сервером потеряна. Переподключение...")
+
+	deadline := time.Now().Add(RECONNECT_GRACE)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		if err := s.connect(); err != nil {
+			lastErr = err
+			if errors.Is(err, errRejected) || isInputError(err) {
+				break
+			}
+			time.Sleep(RECONNECT_INTERVAL)
+			continue
+		}
+		for {
+			msg, err := s.conn.Next()
+			if err != nil {
+				lastErr = err
+				break
+			}
+			if msg.Type == MatchResume {
+				return msg, nil
+			}
+		}
+	}
+	return GameMessage{}, fmt.Errorf("не удалось вернуться в бой: %w", lastErr)
+}
+
+// formatBar рисует полоску значения шириной width символов
+func formatBar(value, max, width int) string {
+	if max <= 0 {
+		max = 1
+	}
+	filled := value * width / max
+	if filled < 0 {
+		filled = 0
+	}
+	if filled > width {
+		filled = width
+	}
+	return "[" + strings.Repeat("█", filled) + strings.Repeat("░", width-filled) + "]"
+}
+
+func printFighterBars(ui GameIO, p *Player) {
+	ui.Printf("%-16s HP %s %d/%d  Мана %s %d/%d%s\n", p.Name,
+		formatBar(p.HP, p.MaxHP, 20), p.HP, p.MaxHP,
+		formatBar(p.Mana, p.MaxMana, 10), p.Mana, p.MaxMana,
+		formatEffects(p))
+}
+
+// Режим зрителя
+func runSpectator(game *GameSession, address string) error {
+	ui := game.IO
+	ui.Println("=== ПРОСМОТР БОЯ ===")
+	if address == "" {
+		var err error
+		if address, err = promptServerAddress(ui, game.Config); err != nil {
+			return err
+		}
+	}
+
+	session := newClientSession(game, address)
+	if err := session.connect(); err != nil {
+		if isInputError(err) {
+			return err
+		}
+		ui.Println("Ошибка подключения к серверу:", err)
+		return nil
+	}
+	defer func() { session.conn.Close() }()
+
+	session.conn.Send(GameMessage{Type: LobbyCommand, Action: "matches"})
+	msg, err := session.conn.Expect(LobbyReply)
+	if err != nil {
+		ui.Println("Ошибка получения списка боёв:", err)
+		return nil
+	}
+	if len(msg.Matches) == 0 {
+		ui.Println("Сейчас на сервере нет идущих боёв.")
+		return nil
+	}
+
+	ui.Println("\n=== ИДУЩИЕ БОИ ===")
+	for i, info := range msg.Matches {
+		ui.Printf("%d. %s VS %s (раунд %d, зрителей: %d)\n",
+			i+1, info.Players[0], info.Players[1], info.Round+1, info.Spectators)
+	}
+	ui.Print("Выберите бой: ")
+	input, err := ui.ReadLine()
+	if err != nil {
+		return err
+	}
+	choice, err := strconv.Atoi(input)
+	if err != nil || choice < 1 || choice > len(msg.Matches) {
+		ui.Println("Неверный выбор!")
+		return nil
+	}
+
+	session.conn.Send(GameMessage{
+		Type:   LobbyCommand,
+		Action: "watch",
+		Text:   strconv.Itoa(msg.Matches[choice-1].ID),
+	})
+	msg, err = session.conn.Next()
+	if err != nil {
+		ui.Println("Соединение с сервером потеряно:", err)
+		return nil
+	}
+	if msg.Type != MatchStart || msg.Player == nil || msg.Opponent == nil {
+		ui.Println(msg.Text)
+		return nil
+	}
+
+	watchMatch(session, msg)
+	return nil
+}
+
+// watchMatch показывает зрителю бой до его окончания
+func watchMatch(session *clientSession, start GameMessage) {
+	ui := session.ui
+	first, second := playerDataToPlayer(start.Player), playerDataToPlayer(start.Opponent)
+	ui.Printf("\n👁️ Вы смотрите бой %s VS %s\n", first.Name, second.Name)
+	printFighterBars(ui, first)
+	printFighterBars(ui, second)
+
+	for {
+		msg, err := session.conn.Next()
+		if err != nil {
+			ui.Println("Соединение с сервером потеряно:", err)
+			return
+		}
+
+		switch msg.Type {
+		case GameStateMsg:
+			if msg.Player == nil || msg.Opponent == nil || msg.Result == nil {
+				continue
+			}
+			first, second = playerDataToPlayer(msg.Player), playerDataToPlayer(msg.Opponent)
+			ui.Printf("\n========== РАУНД %d ==========", msg.Round)
+			printRoundResults(ui, *msg.Result)
+			ui.Println()
+			printFighterBars(ui, first)
+			printFighterBars(ui, second)
+		case MatchEnd:
+			ui.Println("\n========== БИТВА ЗАВЕРШЕНА ==========")
+			ui.Println(msg.Text)
+			return
+		case Disconnect:
+			ui.Println(msg.Text)
+			return
+		}
+	}
+}
+
+func lobbyMenu(session *clientSession) error {
+	ui := session.ui
+	for {
+		ui.Println("\n=== ЛОББИ ===")
+		ui.Println("1 - Список игроков и боёв")
+		ui.Println("2 - Вызвать игрока на бой")
+		ui.Println("3 - Встать в очередь на случайного соперника")
+		ui.Println("4 - Выйти")
+		ui.Print("Ваш выбор: ")
+
+		input, err := ui.ReadLine()
+		if err != nil {
+			return err
+		}
+		switch input {
+		case "1":
+			session.conn.Send(GameMessage{Type: LobbyCommand, Action: "list"})
+			err = awaitLobbyReply(session)
+		case "2":
+			ui.Print("Имя игрока: ")
+			var target string
+			if target, err = ui.ReadLine(); err != nil {
+				return err
+			}
+			session.conn.Send(GameMessage{Type: LobbyCommand, Action: "challenge", Text: target})
+			err = awaitLobbyReply(session)
+		case "3":
+			session.conn.Send(GameMessage{Type: LobbyCommand, Action: "queue"})
+			ui.Println("Вы в очереди.")
+			err = awaitLobbyReply(session)
+		case "4":
+			session.conn.Send(GameMessage{Type: Disconnect})
+			return nil
+		default:
+			ui.Println("Неверный выбор!")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// awaitLobbyReply ждёт ответа сервера на команду лобби. Если команда
+// привела к бою, бой проводится здесь же.
+func awaitLobbyReply(session *clientSession) error {
+	ui := session.ui
+	for {
+		msg, err := session.conn.Next()
+		if err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case LobbyReply, MatchCancelled:
+			ui.Println(msg.Text)
+			return nil
+		case Disconnect:
+			return errors.New(msg.Text)
+		case MatchStart:
+			if msg.Player == nil || msg.Opponent == nil {
+				return errors.New("неполное стартовое состояние боя")
+			}
+			me, opponent := playerDataToPlayer(msg.Player), playerDataToPlayer(msg.Opponent)
+			ui.Println("\n=== СОПЕРНИК НАЙДЕН ===")
+			ui.Printf("%s (Вы) VS %s\n", me.Name, opponent.Name)
+			return networkFight(me, opponent, session)
+		}
+	}
+}
+
+// ==================== УПРАВЛЕНИЕ ИНВЕНТАРЕМ ====================
+func manageInventory(ui GameIO, pack *ContentPack, player *Player) error {
+	for {
+		ui.Println("\n=== УПРАВЛЕНИЕ ИНВЕНТАРЕМ ===")
+		ui.Println("1 - Показать инвентарь")
+		ui.Println("2 - Показать экипировку")
+		ui.Println("3 - Надеть предмет")
+		ui.Println("4 - Снять предмет")
+		ui.Println("5 - Показать способности")
+		ui.Println("6 - Вернуться к игре")
+
+		ui.Print("Ваш выбор: ")
+		input, err := ui.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		switch input {
+		case "1":
+			player.ShowInventory(ui, pack)
+		case "2":
+			player.ShowEquipment(ui, pack)
+		case "3":
+			player.ShowInventory(ui, pack)
+			if len(player.Inventory) > 0 {
+				ui.Print("Введите номер предмета для экипировки: ")
+				choice, err := ui.ReadLine()
+				if err != nil {
+					return err
+				}
+				if i, err := strconv.Atoi(choice); err == nil {
+					player.Equip(ui, pack, i)
+				}
+			}
+		case "4":
+			player.ShowEquipment(ui, pack)
+			if len(player.Equipment) > 0 {
+				ui.Print("Введите номер слота: ")
+				choice, err := ui.ReadLine()
+				if err != nil {
+					return err
+				}
+				if i, err := strconv.Atoi(choice); err == nil {
+					player.TakeOff(ui, EquipSlot(i))
+				}
+			}
+		case "5":
+			player.ShowAbilities(ui)
+		case "6":
+			return nil
+		default:
+			ui.Println("Неверный выбор!")
+		}
+	}
+}
+
+func visitMerchant(ui GameIO, pack *ContentPack, player *Player, merchant *Merchant) error {
+	merchant.Greet(ui)
+	for {
+		ui.Println("\n=== ТОРГОВЛЯ ===")
+		ui.Println("1 - Показать товары")
+		ui.Println("2 - Купить предмет")
+		ui.Println("3 - Продать предмет")
+		ui.Println("4 - Выкупить проданное")
+		ui.Println("5 - Уйти")
+
+		ui.Print("Ваш выбор: ")
+		input, err := ui.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		switch input {
+		case "1":
+			merchant.ShowItems(ui, pack, player)
+		case "2":
+			merchant.ShowItems(ui, pack, player)
+			if len(merchant.Items) > 0 {
+				ui.Print("Введите номер предмета для покупки: ")
+				choice, err := ui.ReadLine()
+				if err != nil {
+					return err
+				}
+				if i, err := strconv.Atoi(choice); err == nil {
+					if err := merchant.BuyItem(ui, player, i); err != nil {
+						return err
+					}
+				}
+			}
+		case "3":
+			if merchant.ShowSellable(ui, pack, player) > 0 {
+				ui.Print("Введите номер предмета для продажи: ")
+				choice, err := ui.ReadLine()
+				if err != nil {
+					return err
+				}
+				if i, err := strconv.Atoi(choice); err == nil {
+					merchant.SellItem(ui, player, i)
+				}
+			}
+		case "4":
+			merchant.ShowBuyBack(ui, pack)
+			if len(merchant.BuyBack) > 0 {
+				ui.Print("Введите номер предмета для выкупа: ")
+				choice, err := ui.ReadLine()
+				if err != nil {
+					return err
+				}
+				if i, err := strconv.Atoi(choice); err == nil {
+					merchant.BuyBackItem(ui, player, i)
+				}
+			}
+		case "5":
+			return nil
+		default:
+			ui.Println("Неверный выбор!")
+		}
+	}
+}
+
+// ==================== СЮЖЕТ ====================
+func showPrologue(ui GameIO, playerName string) {
+	ui.Println("=== ПРОЛОГ ===")
+	ui.Printf("Мир Энтроса не просто умирает — он задыхается.\n")
+	ui.Println("Вы - " + playerName)
+	ui.Println("Бывший инквизитор, чья единственная задача — охота на «Слитых».")
+}
+
+func showEpilogue(ui GameIO, victory bool, playerName string) {
+	ui.Println("\n=== ЭПИЛОГ ===")
+	if victory {
+		ui.Printf("%s, Вы достигаете Трона Савана и убивает Первородного Слитого.\n", playerName)
+		ui.Println("Вы победили Конклав, сохранив свою индивидуальность.")
+	} else {
+		ui.Printf("%s, Вы проиграли. Вы погибли.\n", playerName)
+		ui.Println("Попробуйте снова!")
+	}
+}
+
+type Chapter struct {
+	ID          string
+	Locked      bool
+	StoryBefore string
+	Enemy       *Enemy
+	Merchant    *Merchant
+	NewAbility  Ability
+	StoryAfter  string
+}
+
+// ==================== КАМПАНИЯ ====================
+func newCampaignPlayer(pack *ContentPack, name string) *Player {
+	return &Player{
+		Name:         name,
+		HP:           START_HP,
+		MaxHP:        START_HP,
+		Mana:         START_MANA,
+		MaxMana:      START_MANA,
+		BaseStrength: 10,
+		Strength:     10,
+		Gold:         START_GOLD,
+		Inventory:    pack.startingInventory(),
+		Equipment:    []Item{},
+		Abilities:    []Ability{},
+	}
+}
+
+// startCampaign начинает новую кампанию. Пустое имя запрашивается у игрока.
+func startCampaign(game *GameSession, name string) error {
+	ui := game.IO
+	if name == "" {
+		ui.Print("Введите имя вашего персонажа: ")
+		var err error
+		if name, err = ui.ReadLine(); err != nil {
+			return err
+		}
+	}
+
+	player := newCampaignPlayer(game.Content, name)
+	showPrologue(ui, player.Name)
+	// Зерно повторяет партию только с начала, поэтому при загрузке его нет
+	ui.Printf("\n🎲 Зерно партии: %d (запустите игру с -seed %d, чтобы повторить её)\n", game.Seed, game.Seed)
+	return runCampaign(game, player, &PatternTracker{}, 0, 0)
+}
+
+// runCampaign ведёт кампанию с главы startChapter. played — сколько глав
+// игрок уже прошёл: по нему считаются номер главы и сложность, ведь
+// запертые главы могли остаться позади нетронутыми.
+func runCampaign(game *GameSession, player *Player, tracker *PatternTracker, startChapter, played int) error {
+	ui := game.IO
+	chapters := game.Content.buildChapters(game)
+	story := game.Content.storyLength()
+	victory := true
+
+	for chapter := startChapter; chapter < len(chapters); chapter++ {
+		data := chapters[chapter]
+		if data.Locked {
+			opened, err := openChapter(ui, player, data)
+			if err != nil {
+				return err
+			}
+			if !opened {
+				continue
+			}
+		}
+		ui.Printf("\n=== ГЛАВА %d ===\n", played+1)
+		ui.Println(data.StoryBefore)
+
+		// Чем дальше по сюжету, тем внимательнее боссы к привычкам игрока
+		progress := played + 1
+		if progress > story {
+			progress = story
+		}
+		data.Enemy.Tracker = tracker
+		data.Enemy.Difficulty = game.Config.Difficulty * progress / story
+		data.Enemy.Loot = generateLoot(game, played)
+		played++
+
+		if data.Merchant != nil {
+			ui.Print("Хотите посетить торговца перед боем? (y/n): ")
+			ok, err := confirm(ui)
+			if err == nil && ok {
+				err = visitMerchant(ui, game.Content, player, data.Merchant)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		ui.Print("Хотите управлять инвентарем перед боем? (y/n): ")
+		ok, err := confirm(ui)
+		if err == nil && ok {
+			err = manageInventory(ui, game.Content, player)
+		}
+		if err != nil {
+			return err
+		}
+
+		ui.Printf("\nПриготовьтесь к бою с %s!\n", data.Enemy.GetName())
+		ui.Print("Нажмите Enter чтобы начать бой...")
+		if _, err := ui.ReadLine(); err != nil {
+			return err
+		}
+
+		won, err := fight(game, player, data.Enemy)
+		if err != nil {
+			return err
+		}
+		if !won {
+			victory = false
+			break
+		}
+
+		ui.Printf("\n=== ТРОФЕИ ===\n")
+		ui.Printf("Вы получаете %d золота!\n", data.Enemy.GoldDrop)
+		player.Gold += data.Enemy.GoldDrop
+
+		for _, item := range data.Enemy.Loot {
+			ui.Printf("Вы получаете: %s%s!\n", item.Name, itemDetails(game.Content, item))
+			player.Inventory = append(player.Inventory, item)
+		}
+
+		if data.NewAbility.Name != "" {
+			ui.Printf("\n=== НОВАЯ СПОСОБНОСТЬ ===\n")
+			ui.Printf("Вы изучили: %s - %s\n", data.NewAbility.Name, data.NewAbility.Description)
+			player.Abilities = append(player.Abilities, data.NewAbility)
+		}
+
+		player.SetHP(player.GetHP() + HEAL_BETWEEN_BOSS)
+		player.SetMana(player.GetMana() + MANA_REGEN)
+		ui.Printf("Вы восстановили %d HP и %d маны.\n", HEAL_BETWEEN_BOSS, MANA_REGEN)
+
+		// Между главами торговцы пополняют запас. Это происходит до
+		// сохранения, чтобы загрузка не пополняла его второй раз.
+		for _, merchant := range game.Merchants {
+			merchant.Restock()
+		}
+
+		if data.StoryAfter != "" {
+			ui.Println("\n" + data.StoryAfter)
+		}
+
+		if chapter < len(chapters)-1 {
+			if err := offerSave(game, player, tracker, chapter+1, played); err != nil {
+				return err
+			}
+			ui.Print("\nНажмите Enter чтобы продолжить...")
+			if _, err := ui.ReadLine(); err != nil {
+				return err
+			}
+		}
+	}
+
+	showEpilogue(ui, victory, player.Name)
+
+	if victory {
+		ui.Println("\n🎉 ПОЗДРАВЛЯЕМ! ВЫ ПРОШЛИ ИГРУ! 🎉")
+	} else {
+		ui.Println("\n💀 ИГРА ОКОНЧЕНА. ПОПРОБУЙТЕ СНОВА! 💀")
+	}
+	return nil
+}
+
+// ==================== ЗАПИСИ БОЁВ ====================
+// Запись хранит начальные снимки бойцов, зерно генератора и итоги каждого
+// раунда вместе с выбором сторон. При просмотре бой заново разыгрывается
+// движком из того же зерна, а записанные итоги служат проверкой.
+const (
+	REPLAY_VERSION = 1
+	REPLAY_DIR     = "replays"
+	REPLAY_DELAY   = 1500 * time.Millisecond // пауза между раундами при автопросмотре
+)
+
+var replayModes = map[string]string{
+	"campaign": "кампания",
+	"hotseat":  "горячий стул",
+	"network":  "сетевой бой",
+}
+
+type Replay struct {
+	Version  int
+	Mode     string
+	Recorded time.Time
+	Seed     int64
+	Fighters [2]ReplayFighter
+	Rounds   []RoundResult
+	Outcome  string
+}
+
+// ReplayFighter — снимок бойца перед боем: игрок или противник
+type ReplayFighter struct {
+	Player *Player        `json:",omitempty"`
+	Enemy  *EnemySnapshot `json:",omitempty"`
+}
+
+// EnemySnapshot — противник без интерфейса ИИ, который не сохраняется в JSON
+type EnemySnapshot struct {
+	Name       string
+	HP         int
+	MaxHP      int
+	Mana       int
+	Strength   int
+	Defense    int
+	Ability    Ability
+	DeathQuote string
+	Effects    StatusEffects
+	AI         string
+	AIParam    int
+	Tracker    *PatternTracker `json:",omitempty"`
+	Difficulty int
+}
+
+func copyPlayer(p *Player) *Player {
+	c := *p
+	c.Inventory = append([]Item(nil), p.Inventory...)
+	c.Equipment = append([]Item(nil), p.Equipment...)
+	c.Abilities = append([]Ability(nil), p.Abilities...)
+	c.Effects = append(StatusEffects(nil), p.Effects...)
+	return &c
+}
+
+func describeAI(ai EnemyAI) (string, int) {
+	switch ai := ai.(type) {
+	case AggressiveAI:
+		return "aggressive", 0
+	case DefensiveAI:
+		return "defensive", ai.HealThreshold
+	case RandomAI:
+		return "random", ai.AbilityChance
+	}
+	return "random", 0
+}
 
-	player2 := playerDataToPlayer(msg.Player)
-	fmt.Printf("\nИгрок 2 подключился: %s\n", player2.Name)
+func snapshotFighter(c Character) (ReplayFighter, bool) {
+	switch c := c.(type) {
+	case *Player:
+		return ReplayFighter{Player: copyPlayer(c)}, true
+	case *Enemy:
+		kind, param := describeAI(c.AI)
+		snapshot := &EnemySnapshot{
+			Name:       c.Name,
+			HP:         c.HP,
+			MaxHP:      c.MaxHP,
+			Mana:       c.Mana,
+			Strength:   c.Strength,
+			Defense:    c.Defense,
+			Ability:    c.Ability,
+			DeathQuote: c.DeathQuote,
+			Effects:    append(StatusEffects(nil), c.Effects...),
+			AI:         kind,
+			AIParam:    param,
+			Difficulty: c.Difficulty,
+		}
+		if c.Tracker != nil {
+			tracker := *c.Tracker
+			snapshot.Tracker = &tracker
+		}
+		return ReplayFighter{Enemy: snapshot}, true
+	}
+	return ReplayFighter{}, false
+}
 
-	fmt.Println("\n=== ИГРОКИ ГОТОВЫ ===")
-	fmt.Printf("%s (Вы) VS %s\n", player1.Name, player2.Name)
+func (f ReplayFighter) name() string {
+	if f.Enemy != nil {
+		return f.Enemy.Name
+	}
+	return f.Player.Name
+}
 
-	fmt.Print("\nХотите управлять инвентарем перед боем? (y/n): ")
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
-	if strings.ToLower(input) == "y" {
-		manageInventory(player1)
-		encoder.Encode(GameMessage{
-			Type:   GameStateMsg,
-			Player: playerToPlayerData(player1),
-		})
+// restore создаёт бойца из снимка; каждый вызов возвращает новую копию.
+// Противник получает источник случайности r.
+func (f ReplayFighter) restore(r *rand.Rand) Character {
+	if f.Enemy == nil {
+		return copyPlayer(f.Player)
 	}
+	s := f.Enemy
+	ai, _ := newEnemyAI(s.AI, s.AIParam)
+	enemy := &Enemy{
+		Name:       s.Name,
+		HP:         s.HP,
+		MaxHP:      s.MaxHP,
+		Mana:       s.Mana,
+		Strength:   s.Strength,
+		Defense:    s.Defense,
+		Ability:    s.Ability,
+		DeathQuote: s.DeathQuote,
+		Effects:    append(StatusEffects(nil), s.Effects...),
+		AI:         ai,
+		Difficulty: s.Difficulty,
+		rng:        r,
+	}
+	if s.Tracker != nil {
+		tracker := *s.Tracker
+		enemy.Tracker = &tracker
+	}
+	return enemy
+}
 
-	encoder.Encode(GameMessage{Type: PlayerReady})
+// startReplay начинает запись боя, если она включена (флаг -record).
+// Для бойцов, которых нельзя сохранить, возвращает nil.
+func startReplay(record bool, mode string, seed int64, first, second Character) *Replay {
+	if !record {
+		return nil
+	}
+	r := &Replay{Version: REPLAY_VERSION, Mode: mode, Recorded: time.Now(), Seed: seed}
+	for i, c := range []Character{first, second} {
+		fighter, ok := snapshotFighter(c)
+		if !ok {
+			return nil
+		}
+		r.Fighters[i] = fighter
+	}
+	return r
+}
 
-	err = decoder.Decode(&msg)
-	if err != nil || msg.Type != PlayerReady {
-		fmt.Println("Ошибка ожидания готовности клиента")
+func (r *Replay) Record(result RoundResult) {
+	if r == nil {
 		return
 	}
-
-	fmt.Println("Клиент готов! Начинаем бой...")
-	fmt.Print("Нажмите Enter чтобы начать...")
-	reader.ReadString('\n')
-
-	networkFight(player1, player2, encoder, decoder, true)
+	// В сетевом бою порядок сторон задаёт сервер, а не клиент
+	if len(r.Rounds) == 0 && r.Fighters[0].name() != result.Sides[0].Name {
+		r.Fighters[0], r.Fighters[1] = r.Fighters[1], r.Fighters[0]
+	}
+	r.Rounds = append(r.Rounds, result)
 }
 
-// Клиентская часть
-func runClient() {
-	rand.Seed(time.Now().UnixNano())
-	fmt.Println("=== ПОДКЛЮЧЕНИЕ К СЕРВЕРУ ===")
-	fmt.Print("Введите адрес сервера (например, localhost:8080): ")
-	reader := bufio.NewReader(os.Stdin)
-	address, _ := reader.ReadString('\n')
-	address = strings.TrimSpace(address)
-
-	if address == "" {
-		address = "localhost:" + SERVER_PORT
+// Finish сохраняет запись в REPLAY_DIR
+func (r *Replay) Finish(ui GameIO, outcome string) {
+	if r == nil {
+		return
 	}
-
-	conn, err := net.Dial("tcp", address)
+	r.Outcome = outcome
+	path, err := r.save()
 	if err != nil {
-		fmt.Println("Ошибка подключения к серверу:", err)
+		ui.Println("Ошибка сохранения записи боя:", err)
 		return
 	}
-	defer conn.Close()
-
-	fmt.Println("Подключено к серверу!")
-	encoder := gob.NewEncoder(conn)
-	decoder := gob.NewDecoder(conn)
+	ui.Printf("🎞️ Запись боя сохранена: %s\n", path)
+}
 
-	var msg GameMessage
-	err = decoder.Decode(&msg)
+func (r *Replay) save() (string, error) {
+	data, err := json.Marshal(r)
 	if err != nil {
-		fmt.Println("Ошибка получения данных игрока 1:", err)
-		return
+		return "", err
 	}
+	if err := os.MkdirAll(REPLAY_DIR, 0755); err != nil {
+		return "", err
+	}
+	// Бои с одной секунды различаются именами бойцов, а совпадающие
+	// до конца получают номер: существующая запись не перезаписывается
+	base := fmt.Sprintf("%s-%s-%s-%s", r.Mode, r.Recorded.Format("20060102-150405"),
+		fileSafe(r.Fighters[0].name()), fileSafe(r.Fighters[1].name()))
+	for n := 1; ; n++ {
+		name := base + ".json"
+		if n > 1 {
+			name = fmt.Sprintf("%s-%d.json", base, n)
+		}
+		path := filepath.Join(REPLAY_DIR, name)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := file.Write(data); err != nil {
+			file.Close()
+			return "", err
+		}
+		return path, file.Close()
+	}
+}
 
-	player1 := playerDataToPlayer(msg.Player)
-	fmt.Printf("Противник: %s\n", player1.Name)
-
-	fmt.Print("Введите ваше имя: ")
-	name, _ := reader.ReadString('\n')
-	name = strings.TrimSpace(name)
+// fileSafe оставляет от имени бойца буквы и цифры, чтобы оно годилось
+// для имени файла
+func fileSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
 
-	player2 := &Player{
-		Name:         name,
-		HP:           START_HP,
-		MaxHP:        START_HP,
-		Mana:         START_MANA,
-		MaxMana:      START_MANA,
-		BaseStrength: 10,
-		Strength:     10,
-		Gold:         START_GOLD,
-		Inventory:    getStartingInventory(),
-		Equipment:    []Item{},
-		Abilities:    []Ability{},
+func loadReplay(pack *ContentPack, path string) (*Replay, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Replay
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("запись повреждена: %w", err)
+	}
+	if r.Version != REPLAY_VERSION {
+		return nil, fmt.Errorf("неподдерживаемая версия записи %d", r.Version)
+	}
+	for _, f := range r.Fighters {
+		if f.Player == nil && f.Enemy == nil {
+			return nil, errors.New("запись повреждена: нет снимка бойца")
+		}
 	}
 
-	allAbilities := createAbilities()
-	player2.Abilities = append(player2.Abilities, allAbilities[1], allAbilities[4], allAbilities[7])
-
-	encoder.Encode(GameMessage{
-		Type:   GameStateMsg,
-		Player: playerToPlayerData(player2),
-	})
+	// Действия проверяются против состояния бойцов на момент раунда, поэтому
+	// запись разыгрывается вхолостую: номер предмета или часть тела вне
+	// диапазона иначе уронят просмотр
+	cursor := newReplayCursor(pack, &r)
+	for !cursor.Done() {
+		for i, f := range cursor.fighters {
+			if err := validateRecordedAction(f, r.Rounds[cursor.next].Sides[i].Action); err != nil {
+				return nil, fmt.Errorf("запись повреждена: раунд %d, %s: %v", cursor.next+1, f.GetName(), err)
+			}
+		}
+		cursor.Step()
+	}
+	return &r, nil
+}
 
-	fmt.Println("\n=== ИГРОКИ ГОТОВЫ ===")
-	fmt.Printf("%s (Вы) VS %s\n", player2.Name, player1.Name)
-
-	fmt.Print("\nХотите управлять инвентарем перед боем? (y/n): ")
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
-	if strings.ToLower(input) == "y" {
-		manageInventory(player2)
-		encoder.Encode(GameMessage{
-			Type:   GameStateMsg,
-			Player: playerToPlayerData(player2),
-		})
+// validateRecordedAction проверяет действие из записи. Пропуск хода и ход
+// противника нельзя проверить validateAction, у них проверяются только
+// части тела.
+func validateRecordedAction(fighter Character, action CombatAction) error {
+	if p, ok := fighter.(*Player); ok && !action.IsPass() {
+		return validateAction(p, action)
 	}
+	validPart := func(part BodyPart) bool { return part >= Head && part <= Legs }
+	if !validPart(action.BlockPart) || action.IsAttack() && !validPart(action.HitPart) {
+		return errors.New("неверная часть тела")
+	}
+	return nil
+}
 
-	err = decoder.Decode(&msg)
-	if err != nil || msg.Type != PlayerReady {
-		fmt.Println("Ошибка ожидания готовности сервера")
-		return
+// replayCursor заново разыгрывает запись раунд за раундом
+type replayCursor struct {
+	replay   *Replay
+	game     *GameSession
+	fighters [2]Character
+	next     int
+	diverged int
+}
+
+func newReplayCursor(pack *ContentPack, r *Replay) *replayCursor {
+	// Курсор ничего не выводит и не читает: от сессии нужны генератор и
+	// набор контента, по которому свитки находят свои способности
+	game := NewGameSession(nil, pack, r.Seed)
+	return &replayCursor{
+		replay:   r,
+		game:     game,
+		fighters: [2]Character{r.Fighters[0].restore(game.Rand), r.Fighters[1].restore(game.Rand)},
 	}
+}
 
-	encoder.Encode(GameMessage{Type: PlayerReady})
+func (c *replayCursor) Done() bool {
+	return c.next >= len(c.replay.Rounds)
+}
 
-	fmt.Println("Сервер готов! Начинаем бой...")
-	fmt.Print("Нажмите Enter чтобы начать...")
-	reader.ReadString('\n')
+// Step разыгрывает следующий раунд записанными действиями. Противник под
+// управлением ИИ выбирает ход заново, чтобы генератор шёл той же
+// последовательностью, что и в записанном бою.
+func (c *replayCursor) Step() RoundResult {
+	recorded := c.replay.Rounds[c.next]
+	c.next++
+	actions := [2]CombatAction{recorded.Sides[0].Action, recorded.Sides[1].Action}
+
+	matches := true
+	for i, f := range c.fighters {
+		if e, ok := f.(*Enemy); ok && e.ChooseAction(c.fighters[1-i]) != actions[i] {
+			matches = false
+		}
+	}
+	// Криты берутся из записи: в сетевом бою их бросал сервер, чей генератор
+	// клиенту неизвестен. Бросок всё равно делается, чтобы не сбить генератор.
+	rollCrits(c.game.Rand, c.fighters[0], c.fighters[1])
+	crits := [2]bool{recorded.Sides[0].Critical, recorded.Sides[1].Critical}
+	result := resolveRound(c.game.Content, c.fighters[0], c.fighters[1], actions[0], actions[1], crits)
+	for i, f := range c.fighters {
+		if e, ok := f.(*Enemy); ok {
+			e.Observe(actions[1-i])
+		}
+	}
 
-	networkFight(player2, player1, encoder, decoder, false)
+	got, _ := json.Marshal(result)
+	want, _ := json.Marshal(recorded)
+	if !matches || !bytes.Equal(got, want) {
+		c.diverged++
+	}
+	return result
 }
 
-// ==================== СЕТЕВАЯ БИТВА ====================
-func networkFight(myPlayer, opponentPlayer *Player, encoder *gob.Encoder, decoder *gob.Decoder, isServer bool) {
-	reader := bufio.NewReader(os.Stdin)
-	round := 1
-	myTurn := isServer
+func printCharacterBars(ui GameIO, c Character) {
+	switch c := c.(type) {
+	case *Player:
+		printFighterBars(ui, c)
+	case *Enemy:
+		ui.Printf("%-16s HP %s %d/%d  Мана %d%s\n", c.Name,
+			formatBar(c.HP, c.MaxHP, 20), c.HP, c.MaxHP, c.Mana, formatEffects(c))
+	}
+}
 
-	go func() {
-		for {
-			var msg GameMessage
-			err := decoder.Decode(&msg)
+// watchReplay показывает запись. По умолчанию просмотр стоит на паузе и
+// идёт по раунду на Enter; число перематывает вперёд, a — автопросмотр.
+func watchReplay(ui GameIO, pack *ContentPack, r *Replay) error {
+	cursor := newReplayCursor(pack, r)
+	first, second := cursor.fighters[0], cursor.fighters[1]
+
+	ui.Printf("\n=== ЗАПИСЬ БОЯ: %s VS %s ===\n", first.GetName(), second.GetName())
+	ui.Printf("Режим: %s, записан %s, раундов: %d, зерно: %d\n",
+		replayModes[r.Mode], r.Recorded.Format("02.01.2006 15:04"), len(r.Rounds), r.Seed)
+	printCharacterBars(ui, first)
+	printCharacterBars(ui, second)
+	ui.Println("\nEnter — следующий раунд, число N — перемотать на N раундов,")
+	ui.Println("a — автопросмотр, e — в конец, q — выход")
+
+	auto := false
+	for !cursor.Done() {
+		skip := 0
+		if auto {
+			time.Sleep(REPLAY_DELAY)
+		} else {
+			ui.Printf("\n[раунд %d/%d] > ", cursor.next+1, len(r.Rounds))
+			input, err := ui.ReadLine()
 			if err != nil {
-				return
+				return err
 			}
-
-			switch msg.Type {
-			case ChatMessage:
-				fmt.Printf("\n[ЧАТ] %s: %s\n", opponentPlayer.Name, msg.Text)
-			case GameStateMsg:
-				if msg.Player != nil {
-					opponentPlayer.HP = msg.Player.HP
-					opponentPlayer.Mana = msg.Player.Mana
+			switch input = strings.ToLower(input); input {
+			case "":
+			case "a":
+				auto = true
+			case "e":
+				skip = len(r.Rounds)
+			case "q":
+				return nil
+			default:
+				n, err := strconv.Atoi(input)
+				if err != nil || n < 1 {
+					ui.Println("Неверная команда!")
+					continue
 				}
-			case Disconnect:
-				fmt.Println("\nПротивник отключился!")
-				return
+				skip = n
 			}
 		}
-	}()
 
-	for myPlayer.IsAlive() && opponentPlayer.IsAlive() {
-		fmt.Printf("\n========== РАУНД %d ==========\n", round)
-		fmt.Printf("%s: %d HP, %d маны | %s: %d HP, %d маны\n",
-			myPlayer.Name, myPlayer.HP, myPlayer.Mana,
-			opponentPlayer.Name, opponentPlayer.HP, opponentPlayer.Mana)
-
-		if myTurn {
-			fmt.Printf("\n--- Ваш ход (%s) ---\n", myPlayer.Name)
-			fmt.Println("1 - Обычная атака")
-			fmt.Println("2 - Использовать способность")
-			fmt.Println("3 - Показать способности")
-			fmt.Println("4 - Показать инвентарь")
-			fmt.Println("5 - Использовать предмет")
-			fmt.Println("6 - Отправить сообщение в чат")
-
-			var myHit, myBlock BodyPart
-			var abilityUsed bool
-			var myAbilityID, myItemID int = -1, -1
-
-			for {
-				fmt.Print("Ваш выбор: ")
-				input, _ := reader.ReadString('\n')
-				input = strings.TrimSpace(input)
-
-				switch input {
-				case "1":
-					fmt.Printf("\nВыберите куда атаковать:\n")
-					myHit = myPlayer.Hit()
-					fmt.Printf("\nВыберите что защищать:\n")
-					myBlock = myPlayer.Block()
-					abilityUsed = false
-
-					encoder.Encode(GameMessage{
-						Type:      PlayerAction,
-						Action:    "hit",
-						HitPart:   myHit,
-						BlockPart: myBlock,
-						AbilityID: myAbilityID,
-						ItemID:    myItemID,
-					})
-					break
+		if skip > 0 {
+			for i := 0; i < skip && !cursor.Done(); i++ {
+				cursor.Step()
+			}
+			ui.Printf("\n⏩ Перемотано к раунду %d\n", cursor.next)
+			printCharacterBars(ui, first)
+			printCharacterBars(ui, second)
+			continue
+		}
 
-				case "2":
-					myPlayer.ShowAbilities()
-					if len(myPlayer.Abilities) > 0 {
-						fmt.Print("Выберите способность: ")
-						abilityInput, _ := reader.ReadString('\n')
-						abilityInput = strings.TrimSpace(abilityInput)
-						if idx, err := strconv.Atoi(abilityInput); err == nil && idx >= 0 && idx < len(myPlayer.Abilities) {
-							if myPlayer.Mana >= myPlayer.Abilities[idx].ManaCost {
-								result := myPlayer.UseAbility(myPlayer.Abilities[idx], opponentPlayer)
-								fmt.Println(result)
-								abilityUsed = true
-								myAbilityID = idx
-
-								encoder.Encode(GameMessage{
-									Type:      PlayerAction,
-									Action:    "ability",
-									HitPart:   myHit,
-									BlockPart: myBlock,
-									AbilityID: myAbilityID,
-									ItemID:    myItemID,
-								})
-							} else {
-								fmt.Println("Недостаточно маны!")
-								continue
-							}
-						}
-					}
-					if !abilityUsed {
-						fmt.Printf("\nВыберите что защищать:\n")
-						myBlock = myPlayer.Block()
-					}
-					break
+		result := cursor.Step()
+		ui.Printf("\n========== РАУНД %d ==========", cursor.next)
+		printRoundResults(ui, result)
+		ui.Println()
+		printCharacterBars(ui, first)
+		printCharacterBars(ui, second)
+	}
 
-				case "3":
-					myPlayer.ShowAbilities()
-					continue
+	ui.Println("\n========== БИТВА ЗАВЕРШЕНА ==========")
+	ui.Println(r.Outcome)
+	if cursor.diverged > 0 {
+		ui.Printf("\n⚠️ Раундов, разыгранных иначе, чем в записи: %d. Вероятно, запись сделана другой версией игры.\n",
+			cursor.diverged)
+	}
+	return nil
+}
 
-				case "4":
-					myPlayer.ShowInventory()
-					continue
+// replayMenu предлагает выбрать запись из REPLAY_DIR
+func replayMenu(ui GameIO, pack *ContentPack) error {
+	paths, _ := filepath.Glob(filepath.Join(REPLAY_DIR, "*.json"))
+	if len(paths) == 0 {
+		ui.Println("Записей боёв пока нет. Запустите игру с флагом -record, чтобы записывать бои.")
+		return nil
+	}
+	sort.Strings(paths)
 
-				case "5":
-					myPlayer.ShowInventory()
-					if len(myPlayer.Inventory) > 0 {
-						fmt.Print("Введите номер предмета: ")
-						itemInput, _ := reader.ReadString('\n')
-						itemInput = strings.TrimSpace(itemInput)
-						if idx, err := strconv.Atoi(itemInput); err == nil {
-							myPlayer.Equip(idx)
-							myItemID = idx
-
-							encoder.Encode(GameMessage{
-								Type:      PlayerAction,
-								Action:    "item",
-								HitPart:   myHit,
-								BlockPart: myBlock,
-								AbilityID: myAbilityID,
-								ItemID:    myItemID,
-							})
-						}
-					}
-					fmt.Printf("\nВыберите что защищать:\n")
-					myBlock = myPlayer.Block()
-					abilityUsed = false
-					break
+	ui.Println("\n=== ЗАПИСИ БОЁВ ===")
+	for i, path := range paths {
+		ui.Printf("%d. %s\n", i+1, filepath.Base(path))
+	}
+	ui.Print("Выберите запись: ")
+	input, err := ui.ReadLine()
+	if err != nil {
+		return err
+	}
+	choice, err := strconv.Atoi(input)
+	if err != nil || choice < 1 || choice > len(paths) {
+		ui.Println("Неверный выбор!")
+		return nil
+	}
 
-				case "6":
-					fmt.Print("Введите сообщение: ")
-					msgText, _ := reader.ReadString('\n')
-					msgText = strings.TrimSpace(msgText)
+	r, err := loadReplay(pack, paths[choice-1])
+	if err != nil {
+		ui.Println("Ошибка загрузки записи:", err)
+		return nil
+	}
+	return watchReplay(ui, pack, r)
+}
 
-					encoder.Encode(GameMessage{
-						Type: ChatMessage,
-						Text: msgText,
-					})
-					fmt.Printf("%s: %s\n", myPlayer.Name, msgText)
-					continue
+// ==================== СОХРАНЕНИЯ ====================
+type SaveGame struct {
+	Version int
+	SavedAt time.Time
+	Chapter int
+	Played  int // пройдено глав; запертые и пропущенные не считаются
+	Seed    int64
+	Player  *Player
+	Tracker PatternTracker
+
+	Merchants map[string]MerchantState `json:",omitempty"`
+}
 
-				default:
-					fmt.Println("Неверный выбор!")
-					continue
-				}
-				break
-			}
+type saveFile struct {
+	Version  int
+	Checksum string
+	Data     json.RawMessage
+}
 
-			encoder.Encode(GameMessage{
-				Type:   GameStateMsg,
-				Player: playerToPlayerData(myPlayer),
-			})
+var errEmptySlot = errors.New("слот пуст")
 
-			fmt.Println("\n⏳ Ожидание хода противника...")
+func savePath(slot int) string {
+	return filepath.Join(SAVE_DIR, fmt.Sprintf("slot%d.json", slot))
+}
 
-		} else {
-			fmt.Printf("\n--- Ход %s ---\n", opponentPlayer.Name)
-			fmt.Println("⏳ Ожидание действий противника...")
+func saveChecksum(data []byte) (string, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(compact.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
 
-			var actionMsg GameMessage
-			err := decoder.Decode(&actionMsg)
-			if err != nil {
-				fmt.Println("\nОшибка получения данных от противника")
-				return
-			}
+func writeSave(slot int, save SaveGame) error {
+	save.Version = SAVE_VERSION
+	data, err := json.Marshal(save)
+	if err != nil {
+		return err
+	}
+	checksum, err := saveChecksum(data)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.MarshalIndent(saveFile{Version: SAVE_VERSION, Checksum: checksum, Data: data}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(SAVE_DIR, 0755); err != nil {
+		return err
+	}
+	path := savePath(slot)
+	if err := os.WriteFile(path+".tmp", encoded, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
 
-			var stateMsg GameMessage
-			err = decoder.Decode(&stateMsg)
-			if err == nil && stateMsg.Type == GameStateMsg && stateMsg.Player != nil {
-				opponentPlayer.HP = stateMsg.Player.HP
-				opponentPlayer.Mana = stateMsg.Player.Mana
-			}
+// readSave читает слот и проверяет сохранение по набору контента pack
+func readSave(pack *ContentPack, slot int) (*SaveGame, error) {
+	encoded, err := os.ReadFile(savePath(slot))
+	if os.IsNotExist(err) {
+		return nil, errEmptySlot
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file saveFile
+	if err := json.Unmarshal(encoded, &file); err != nil {
+		return nil, fmt.Errorf("файл сохранения повреждён: %v", err)
+	}
+	if file.Version != SAVE_VERSION {
+		return nil, fmt.Errorf("неподдерживаемая версия сохранения %d (ожидается %d)", file.Version, SAVE_VERSION)
+	}
+	checksum, err := saveChecksum(file.Data)
+	if err != nil || checksum != file.Checksum {
+		return nil, errors.New("файл сохранения повреждён: контрольная сумма не совпадает")
+	}
+
+	var save SaveGame
+	if err := json.Unmarshal(file.Data, &save); err != nil {
+		return nil, fmt.Errorf("файл сохранения повреждён: %v", err)
+	}
+	if save.Player == nil || save.Chapter < 0 || save.Chapter >= len(pack.Chapters) {
+		return nil, errors.New("файл сохранения повреждён: неверные данные кампании")
+	}
+	return &save, nil
+}
 
-			fmt.Println("Ход противника завершен!")
+func showSaveSlots(ui GameIO, pack *ContentPack) {
+	ui.Println("\n=== СЛОТЫ СОХРАНЕНИЙ ===")
+	for slot := 1; slot <= SAVE_SLOTS; slot++ {
+		save, err := readSave(pack, slot)
+		switch {
+		case err == errEmptySlot:
+			ui.Printf("%d - пусто\n", slot)
+		case err != nil:
+			ui.Printf("%d - ошибка: %v\n", slot, err)
+		default:
+			ui.Printf("%d - %s, глава %d, %s\n", slot, save.Player.Name, save.Played+1,
+				save.SavedAt.Format("02.01.2006 15:04"))
 		}
+	}
+}
 
-		myTurn = !myTurn
-		if !myTurn {
-			round++
+func promptSaveSlot(ui GameIO, pack *ContentPack) (int, error) {
+	showSaveSlots(ui, pack)
+	for {
+		ui.Printf("Выберите слот (1-%d, 0 - отмена): ", SAVE_SLOTS)
+		input, err := ui.ReadLine()
+		if err != nil {
+			return 0, err
 		}
+		slot, err := strconv.Atoi(input)
+		if err == nil && slot >= 0 && slot <= SAVE_SLOTS {
+			return slot, nil
+		}
+		ui.Println("Неверный выбор!")
+	}
+}
 
-		if myPlayer.IsAlive() && opponentPlayer.IsAlive() {
-			fmt.Print("\nНажмите Enter для продолжения...")
-			reader.ReadString('\n')
+// offerSave предлагает сохраниться перед главой nextChapter. Генератор
+// случайных чисел пересеивается, и зерно попадает в сохранение.
+func offerSave(game *GameSession, player *Player, tracker *PatternTracker, nextChapter, played int) error {
+	ui := game.IO
+	ui.Print("\nХотите сохранить игру? (y/n): ")
+	if ok, err := confirm(ui); !ok {
+		return err
+	}
+	slot := game.Config.SaveSlot
+	if slot == 0 {
+		var err error
+		if slot, err = promptSaveSlot(ui, game.Content); err != nil {
+			return err
 		}
 	}
+	if slot == 0 {
+		return nil
+	}
+	seed := game.Reseed()
+	merchants := make(map[string]MerchantState)
+	for id, merchant := range game.Merchants {
+		merchants[id] = merchant.State()
+	}
+	err := writeSave(slot, SaveGame{
+		SavedAt:   time.Now(),
+		Chapter:   nextChapter,
+		Played:    played,
+		Seed:      seed,
+		Player:    player,
+		Tracker:   *tracker,
+		Merchants: merchants,
+	})
+	if err != nil {
+		ui.Println("Ошибка сохранения:", err)
+		return nil
+	}
+	ui.Printf("Игра сохранена в слот %d.\n", slot)
+	return nil
+}
 
-	fmt.Println("\n========== БИТВА ЗАВЕРШЕНА ==========")
-	if myPlayer.IsAlive() {
-		fmt.Printf("\n🏆 %s ПОБЕЖДАЕТ! 🏆\n", myPlayer.Name)
-		fmt.Printf("%s повержен!\n", opponentPlayer.Name)
-	} else {
-		fmt.Printf("\n🏆 %s ПОБЕЖДАЕТ! 🏆\n", opponentPlayer.Name)
-		fmt.Printf("%s повержен!\n", myPlayer.Name)
+func loadCampaign(game *GameSession) error {
+	slot, err := promptSaveSlot(game.IO, game.Content)
+	if err != nil || slot == 0 {
+		return err
+	}
+	return continueCampaign(game, slot)
+}
+
+// continueCampaign продолжает кампанию из слота. Пустой слот с -slot
+// начинает новую кампанию, которая будет сохраняться в него. Сохранённая
+// игра продолжается в новой сессии с зерном из сохранения.
+func continueCampaign(game *GameSession, slot int) error {
+	ui, pack := game.IO, game.Content
+	save, err := readSave(pack, slot)
+	if errors.Is(err, errEmptySlot) && game.Config.SaveSlot == slot {
+		ui.Printf("Слот %d пуст — начинается новая игра.\n", slot)
+		return startCampaign(game, game.Config.PlayerName)
+	}
+	if err != nil {
+		ui.Println("Ошибка загрузки:", err)
+		return nil
 	}
+	ui.Printf("\nС возвращением, %s! Глава %d.\n", save.Player.Name, save.Played+1)
+	config := game.Config
+	game = NewGameSession(ui, pack, save.Seed)
+	game.Config = config
+	for id, state := range save.Merchants {
+		// Торговец мог исчезнуть из набора контента с момента сохранения
+		if _, ok := pack.merchants[id]; ok {
+			pack.sessionMerchant(game, id).Restore(state)
+		}
+	}
+	return runCampaign(game, save.Player, &save.Tracker, save.Chapter, save.Played)
+}
 
-	encoder.Encode(GameMessage{Type: Disconnect})
+// ==================== КОМАНДНАЯ СТРОКА ====================
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Использование: 4ver [флаги] [команда] [аргументы]")
+	fmt.Fprintln(out, "\nКоманды:")
+	fmt.Fprintln(out, "  campaign             одиночная кампания (с -slot — продолжить из слота)")
+	fmt.Fprintln(out, "  hotseat [имя1 имя2]  бой двух игроков на одном компьютере")
+	fmt.Fprintln(out, "  serve                запустить сервер")
+	fmt.Fprintln(out, "  connect <адрес>      подключиться к серверу")
+	fmt.Fprintln(out, "  spectate <адрес>     смотреть бой на сервере")
+	fmt.Fprintln(out, "  replay <файл>        посмотреть запись боя")
+	fmt.Fprintln(out, "Без команды открывается меню.")
+	fmt.Fprintln(out, "\nФлаги:")
+	flag.PrintDefaults()
 }
 
-// ==================== УПРАВЛЕНИЕ ИНВЕНТАРЕМ ====================
-func manageInventory(player *Player) {
-	reader := bufio.NewReader(os.Stdin)
+// parseCommandArgs разбирает аргументы команды. Флаги можно указывать и
+// после команды, вперемешку с её аргументами.
+func parseCommandArgs(args []string) []string {
+	var positional []string
 	for {
-		fmt.Println("\n=== УПРАВЛЕНИЕ ИНВЕНТАРЕМ ===")
-		fmt.Println("1 - Показать инвентарь")
-		fmt.Println("2 - Показать экипировку")
-		fmt.Println("3 - Надеть предмет")
-		fmt.Println("4 - Снять предмет")
-		fmt.Println("5 - Показать способности")
-		fmt.Println("6 - Вернуться к игре")
-
-		fmt.Print("Ваш выбор: ")
-		input, _ := reader.ReadString('\n')
-		input = strings.TrimSpace(input)
-
-		switch input {
-		case "1":
-			player.ShowInventory()
-		case "2":
-			player.ShowEquipment()
-		case "3":
-			player.ShowInventory()
-			if len(player.Inventory) > 0 {
-				fmt.Print("Введите номер предмета для экипировки: ")
-				choice, _ := reader.ReadString('\n')
-				choice = strings.TrimSpace(choice)
-				if i, err := strconv.Atoi(choice); err == nil {
-					player.Equip(i)
-				}
-			}
-		case "4":
-			player.ShowEquipment()
-			if len(player.Equipment) > 0 {
-				fmt.Print("Введите номер предмета для снятия: ")
-				choice, _ := reader.ReadString('\n')
-				choice = strings.TrimSpace(choice)
-				if i, err := strconv.Atoi(choice); err == nil {
-					player.TakeOff(i)
-				}
-			}
-		case "5":
-			player.ShowAbilities()
-		case "6":
-			return
-		default:
-			fmt.Println("Неверный выбор!")
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if len(args) == 0 {
+			return positional
 		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
 }
 
-func visitMerchant(player *Player, merchant Merchant) {
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		fmt.Println("\n=== ТОРГОВЛЯ ===")
-		fmt.Println("1 - Показать товары")
-		fmt.Println("2 - Купить предмет")
-		fmt.Println("3 - Уйти")
+// runCommand запускает режим, заданный в командной строке, в сессии game.
+// Возвращает false, если команда неизвестна или аргументы неверны.
+func runCommand(game *GameSession, command string, args []string) (bool, error) {
+	var err error
+	switch {
+	case command == "campaign" && len(args) == 0:
+		if game.Config.SaveSlot != 0 {
+			err = continueCampaign(game, game.Config.SaveSlot)
+		} else {
+			err = startCampaign(game, game.Config.PlayerName)
+		}
+	case command == "hotseat" && (len(args) == 0 || len(args) == 2):
+		names := []string{game.Config.PlayerName, ""}
+		if len(args) == 2 {
+			names = args
+		}
+		err = runHotseat(game, names)
+	case command == "serve" && len(args) == 0:
+		runServer(game, game.Config.listenAddress())
+	case command == "connect" && len(args) == 1:
+		err = runClient(game, game.Config.withDefaultPort(args[0]), game.Config.PlayerName)
+	case command == "spectate" && len(args) == 1:
+		err = runSpectator(game, game.Config.withDefaultPort(args[0]))
+	case command == "replay" && len(args) == 1:
+		r, loadErr := loadReplay(game.Content, args[0])
+		if loadErr != nil {
+			game.IO.Println("Ошибка загрузки записи:", loadErr)
+			return true, nil
+		}
+		err = watchReplay(game.IO, game.Content, r)
+	default:
+		return false, nil
+	}
+	return true, err
+}
 
-		fmt.Print("Ваш выбор: ")
-		input, _ := reader.ReadString('\n')
-		input = strings.TrimSpace(input)
+// configFromFlags собирает настройки из разобранных флагов
+func configFromFlags() Config {
+	return Config{
+		PlayerName:  *playerName,
+		Difficulty:  *difficulty,
+		SaveSlot:    *saveSlot,
+		Port:        *port,
+		ServerAddr:  *serverAddr,
+		TurnTimeout: *turnTimeout,
+		AFKLimit:    *afkLimit,
+		TLS:         *useTLS,
+		Password:    *netPassword,
+		Record:      *recordFights,
+	}
+}
 
-		switch input {
-		case "1":
-			merchant.ShowItems(player)
-		case "2":
-			merchant.ShowItems(player)
-			if len(merchant.Items) > 0 {
-				fmt.Print("Введите номер предмета для покупки: ")
-				choice, _ := reader.ReadString('\n')
-				choice = strings.TrimSpace(choice)
-				if i, err := strconv.Atoi(choice); err == nil {
-					merchant.BuyItem(player, i)
-				}
-			}
-		case "3":
-			return
-		default:
-			fmt.Println("Неверный выбор!")
-		}
+// checkConfig проверяет значения флагов, которые нельзя проверить при разборе
+func checkConfig(ui GameIO, config Config) bool {
+	if config.Difficulty < 0 || config.Difficulty > 100 {
+		ui.Println("Сложность должна быть от 0 до 100")
+		return false
+	}
+	if config.SaveSlot < 0 || config.SaveSlot > SAVE_SLOTS {
+		ui.Printf("Слот сохранения должен быть от 1 до %d\n", SAVE_SLOTS)
+		return false
 	}
+	return true
 }
 
-// ==================== СЮЖЕТ ====================
-func showPrologue(playerName string) {
-	fmt.Println("=== ПРОЛОГ ===")
-	fmt.Printf("Мир Энтроса не просто умирает — он задыхается.\n")
-	fmt.Println("Вы - " + playerName)
-	fmt.Println("Бывший инквизитор, чья единственная задача — охота на «Слитых».")
+// listenAddress — адрес сервера из -addr. -port заменяет в нём только порт,
+// а адрес без порта дополняет.
+func (c Config) listenAddress() string {
+	if c.Port == "" {
+		return c.ServerAddr
+	}
+	host, _, err := net.SplitHostPort(c.ServerAddr)
+	if err != nil {
+		host = c.ServerAddr
+	}
+	return net.JoinHostPort(host, c.Port)
 }
 
-func showEpilogue(victory bool, playerName string) {
-	fmt.Println("\n=== ЭПИЛОГ ===")
-	if victory {
-		fmt.Printf("%s, Вы достигаете Трона Савана и убивает Первородного Слитого.\n", playerName)
-		fmt.Println("Вы победили Конклав, сохранив свою индивидуальность.")
-	} else {
-		fmt.Printf("%s, Вы проиграли. Вы погибли.\n", playerName)
-		fmt.Println("Попробуйте снова!")
+// withDefaultPort дописывает порт к адресу без порта
+func (c Config) withDefaultPort(address string) string {
+	defaultPort := SERVER_PORT
+	if c.Port != "" {
+		defaultPort = c.Port
+	}
+	if address == "" {
+		return "localhost:" + defaultPort
+	}
+
+	prefix := ""
+	if rest, ok := strings.CutPrefix(address, "tls://"); ok {
+		prefix, address = "tls://", rest
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, defaultPort)
 	}
+	return prefix + address
+}
+
+func promptServerAddress(ui GameIO, config Config) (string, error) {
+	ui.Print("Введите адрес сервера (например, localhost:8080 или tls://localhost:8080): ")
+	address, err := ui.ReadLine()
+	return config.withDefaultPort(address), err
 }
 
 // ==================== MAIN ====================
 func main() {
-	rand.Seed(time.Now().UnixNano())
-	reader := bufio.NewReader(os.Stdin)
+	ui := NewTerminalIO(os.Stdin, os.Stdout)
+	flag.Usage = printUsage
+	flag.Parse()
+	var command string
+	var args []string
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+		args = parseCommandArgs(flag.Args()[1:])
+	}
+	config := configFromFlags()
+	if !checkConfig(ui, config) {
+		return
+	}
 
 	gob.Register(&PlayerData{})
 	gob.Register([]Item{})
 	gob.Register([]Ability{})
 
-	fmt.Println("=== ВЫБОР РЕЖИМА ИГРЫ ===")
-	fmt.Println("1 - Одиночная игра (PvE)")
-	fmt.Println("2 - Мультиплеер")
-	fmt.Print("Ваш выбор: ")
-	modeInput, _ := reader.ReadString('\n')
-	modeInput = strings.TrimSpace(modeInput)
-
-	if modeInput == "2" {
-		fmt.Println("\n=== МУЛЬТИПЛЕЕР ===")
-		fmt.Println("1 - Горячий стул (на одном компьютере)")
-		fmt.Println("2 - По сети")
-		fmt.Print("Ваш выбор: ")
-		multiInput, _ := reader.ReadString('\n')
-		multiInput = strings.TrimSpace(multiInput)
-
-		if multiInput == "2" {
-			fmt.Println("\n=== СЕТЕВОЙ РЕЖИМ ===")
-			fmt.Println("1 - Запустить сервер")
-			fmt.Println("2 - Подключиться как клиент")
-			fmt.Print("Ваш выбор: ")
-			netInput, _ := reader.ReadString('\n')
-			netInput = strings.TrimSpace(netInput)
-
-			if netInput == "1" {
-				runServer()
-			} else {
-				runClient()
-			}
-		} else {
-			fmt.Println("\n=== РЕЖИМ ГОРЯЧИЙ СТУЛ ===")
-			players := make([]*Player, 2)
-			for i := 0; i < 2; i++ {
-				players[i] = createPlayer(i + 1)
-				allAbilities := createAbilities()
-				players[i].Abilities = append(players[i].Abilities, allAbilities[1], allAbilities[4], allAbilities[7])
-			}
-
-			fmt.Println("\n=== ИГРОКИ СОЗДАНЫ ===")
-			fmt.Printf("1. %s - HP: %d, Мана: %d, Сила: %d\n", players[0].Name, players[0].HP, players[0].Mana, players[0].GetStrength())
-			fmt.Printf("2. %s - HP: %d, Мана: %d, Сила: %d\n", players[1].Name, players[1].HP, players[1].Mana, players[1].GetStrength())
-
-			for i := 0; i < 2; i++ {
-				fmt.Printf("\n--- Управление инвентарем для %s ---\n", players[i].Name)
-				fmt.Print("Хотите управлять инвентарем перед боем? (y/n): ")
-				input, _ := reader.ReadString('\n')
-				input = strings.TrimSpace(input)
-				if strings.ToLower(input) == "y" {
-					manageInventory(players[i])
-				}
-			}
-
-			pvpFight(players)
+	pack := mustValidate(defaultContentPack())
+	if _, err := os.Stat(*contentPath); err == nil {
+		if pack, err = loadContentPack(*contentPath); err != nil {
+			ui.Println("Ошибка загрузки контента:", err)
+			return
+		}
+		ui.Printf("Загружен набор контента: %s\n", pack.Name)
+	} else if *contentPath != CONTENT_FILE {
+		ui.Println("Ошибка загрузки контента:", err)
+		return
+	}
+	game := NewGameSession(ui, pack, newSeed())
+	game.Config = config
+
+	var err error
+	if command != "" {
+		var known bool
+		if known, err = runCommand(game, command, args); !known {
+			ui.Printf("Неизвестная команда или неверные аргументы: %s %s\n\n", command, strings.Join(args, " "))
+			printUsage()
 		}
 	} else {
-		fmt.Print("Введите имя вашего персонажа: ")
-		playerName, _ := reader.ReadString('\n')
-		playerName = strings.TrimSpace(playerName)
-
-		player := &Player{
-			Name:         playerName,
-			HP:           START_HP,
-			MaxHP:        START_HP,
-			Mana:         START_MANA,
-			MaxMana:      START_MANA,
-			BaseStrength: 10,
-			Strength:     10,
-			Gold:         START_GOLD,
-			Inventory:    getStartingInventory(),
-			Equipment:    []Item{},
-			Abilities:    []Ability{},
-		}
-
-		merchant := Merchant{
-			Name:     "Старый торговец",
-			Dialogue: "Ты чего тут забыл?",
-			Items:    createGameItems(),
-		}
-
-		showPrologue(player.Name)
-
-		chapters := []struct {
-			StoryBefore string
-			enemy       *Enemy
-			newAbility  Ability
-			StoryAfter  string
-		}{
-			{
-				StoryBefore: "Вы достигаете Врат Опустевшего серебра.",
-				enemy:       &Enemy{Name: "Сир Алдрих Немигающий", HP: 50, Mana: 20, Strength: 8, Loot: generateLoot(), GoldDrop: 25, DeathQuote: "Тьма, которую я выбрал... была милосерднее."},
-				newAbility:  createAbilities()[0],
-				StoryAfter:  "Врата открыты.",
-			},
-			{
-				StoryBefore: "Затопленные приюты Нижнего Города.",
-				enemy:       &Enemy{Name: "Мать Гноя", HP: 80, Mana: 40, Strength: 12, Loot: generateLoot(), GoldDrop: 50, DeathQuote: "Теперь... они наконец уснут."},
-				newAbility:  createAbilities()[7],
-				StoryAfter:  "Тишина приюта пугает.",
-			},
-			{
-				StoryBefore: "Пиршественный зал Эбеновой Крепости.",
-				enemy:       &Enemy{Name: "Судья Варек", HP: 110, Mana: 50, Strength: 18, Loot: generateLoot(), GoldDrop: 70, DeathQuote: "Наконец-то... тишина внутри."},
-				newAbility:  createAbilities()[2],
-				StoryAfter:  "Вы переступаете через объедки.",
-			},
-			{
-				StoryBefore: "Мост Вздохов. Близнецы Раздора.",
-				enemy:       &Enemy{Name: "Близнецы Раздора", HP: 140, Mana: 60, Strength: 22, Loot: generateLoot(), GoldDrop: 100, DeathQuote: "Свободен... как же холодно."},
-				newAbility:  createAbilities()[6],
-				StoryAfter:  "Они наконец едины в смерти.",
-			},
-			{
-				StoryBefore: "Сад Освежеванных Роз.",
-				enemy:       &Enemy{Name: "Иеремия Безмолвный", HP: 170, Mana: 80, Strength: 28, Loot: generateLoot(), GoldDrop: 130, DeathQuote: "Убей меня... вырежи мое имя."},
-				newAbility:  createAbilities()[8],
-				StoryAfter:  "Лепестки роз пропитались кровью.",
-			},
-			{
-				StoryBefore: "Обсерватория Шепотов.",
-				enemy:       &Enemy{Name: "Консул Малакай", HP: 210, Mana: 100, Strength: 35, Loot: generateLoot(), GoldDrop: 200, DeathQuote: "Ты... всего лишь лишняя запятая."},
-				newAbility:  createAbilities()[3],
-				StoryAfter:  "Книги сгорели.",
-			},
-			{
-				StoryBefore: "Трон Немого Неба.",
-				enemy:       &Enemy{Name: "Отражение", HP: 300, Mana: 150, Strength: 45, Loot: generateLoot(), GoldDrop: 500, DeathQuote: "Ты победил. Ты один."},
-				newAbility:  createAbilities()[0],
-				StoryAfter:  "Мир замер в ожидании финала.",
-			},
-		}
-
-		victory := true
-
-		for chapter, data := range chapters {
-			fmt.Printf("\n=== ГЛАВА %d ===\n", chapter+1)
-			fmt.Println(data.StoryBefore)
-
-			fmt.Print("Хотите посетить торговца перед боем? (y/n): ")
-			input, _ := reader.ReadString('\n')
-			input = strings.TrimSpace(input)
-			if strings.ToLower(input) == "y" {
-				visitMerchant(player, merchant)
-			}
-
-			fmt.Print("Хотите управлять инвентарем перед боем? (y/n): ")
-			input, _ = reader.ReadString('\n')
-			input = strings.TrimSpace(input)
-			if strings.ToLower(input) == "y" {
-				manageInventory(player)
-			}
-
-			fmt.Printf("\nПриготовьтесь к бою с %s!\n", data.enemy.GetName())
-			fmt.Print("Нажмите Enter чтобы начать бой...")
-			reader.ReadString('\n')
-
-			if !fight(player, data.enemy) {
-				victory = false
-				break
-			}
-
-			fmt.Printf("\n=== ТРОФЕИ ===\n")
-			fmt.Printf("Вы получаете %d золота!\n", data.enemy.GoldDrop)
-			player.Gold += data.enemy.GoldDrop
-
-			for _, item := range data.enemy.Loot {
-				fmt.Printf("Вы получаете: %s!\n", item.Name)
-				player.Inventory = append(player.Inventory, item)
-			}
-
-			fmt.Printf("\n=== НОВАЯ СПОСОБНОСТЬ ===\n")
-			fmt.Printf("Вы изучили: %s - %s\n", data.newAbility.Name, data.newAbility.Description)
-			player.Abilities = append(player.Abilities, data.newAbility)
-
-			player.SetHP(player.GetHP() + HEAL_BETWEEN_BOSS)
-			player.SetMana(player.GetMana() + MANA_REGEN)
-			fmt.Printf("Вы восстановили %d HP и %d маны.\n", HEAL_BETWEEN_BOSS, MANA_REGEN)
+		err = mainMenu(game)
+	}
+	switch {
+	case isInputError(err):
+		ui.Println("\nВвод закончился, выход.")
+	case err != nil:
+		ui.Println("Ошибка:", err)
+		os.Exit(1)
+	}
+}
 
-			if data.StoryAfter != "" {
-				fmt.Println("\n" + data.StoryAfter)
-			}
+// mainMenu спрашивает режим игры, когда он не задан командой
+func mainMenu(game *GameSession) error {
+	ui := game.IO
+	ui.Println("=== ВЫБОР РЕЖИМА ИГРЫ ===")
+	ui.Println("1 - Одиночная игра (PvE)")
+	ui.Println("2 - Мультиплеер")
+	ui.Println("3 - Продолжить (загрузить сохранение)")
+	ui.Println("4 - Смотреть запись боя")
+	ui.Print("Ваш выбор: ")
+	modeInput, err := ui.ReadLine()
+	if err != nil {
+		return err
+	}
 
-			if chapter < len(chapters)-1 {
-				fmt.Print("\nНажмите Enter чтобы продолжить...")
-				reader.ReadString('\n')
-			}
+	switch modeInput {
+	case "2":
+		ui.Println("\n=== МУЛЬТИПЛЕЕР ===")
+		ui.Println("1 - Горячий стул (на одном компьютере)")
+		ui.Println("2 - По сети")
+		ui.Print("Ваш выбор: ")
+		multiInput, err := ui.ReadLine()
+		if err != nil {
+			return err
+		}
+		if multiInput != "2" {
+			return runHotseat(game, []string{game.Config.PlayerName, ""})
 		}
 
-		showEpilogue(victory, player.Name)
-
-		if victory {
-			fmt.Println("\n🎉 ПОЗДРАВЛЯЕМ! ВЫ ПРОШЛИ ИГРУ! 🎉")
-		} else {
-			fmt.Println("\n💀 ИГРА ОКОНЧЕНА. ПОПРОБУЙТЕ СНОВА! 💀")
+		ui.Println("\n=== СЕТЕВОЙ РЕЖИМ ===")
+		ui.Println("1 - Запустить сервер")
+		ui.Println("2 - Подключиться как клиент")
+		ui.Println("3 - Смотреть бой")
+		ui.Print("Ваш выбор: ")
+		netInput, err := ui.ReadLine()
+		if err != nil {
+			return err
+		}
+		switch netInput {
+		case "1":
+			runServer(game, game.Config.listenAddress())
+			return nil
+		case "3":
+			return runSpectator(game, "")
+		default:
+			return runClient(game, "", game.Config.PlayerName)
 		}
+	case "3":
+		return loadCampaign(game)
+	case "4":
+		return replayMenu(ui, game.Content)
+	default:
+		return startCampaign(game, game.Config.PlayerName)
 	}
 }
\ No newline at end of file
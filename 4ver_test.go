@@ -0,0 +1,1934 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFighter(name string, strength int) *Player {
+	return &Player{
+		Name:         name,
+		HP:           100,
+		MaxHP:        100,
+		Mana:         50,
+		MaxMana:      50,
+		BaseStrength: strength,
+		Strength:     strength,
+	}
+}
+
+// chdirTemp переносит тест во временный каталог: сохранения и записи
+// пишутся относительно текущего каталога
+func chdirTemp(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+// testArmor — броня в слоте slot, вдвое снижающая урон
+func testArmor(slot EquipSlot) Item {
+	return Item{ID: "armor", Name: "Броня", Type: Armor, Defence: DEFENSE_SCALE, Slot: slot}
+}
+
+// testPack — встроенный набор контента; тесты его не меняют
+var testPack = mustValidate(defaultContentPack())
+
+var testBolt = Ability{ID: "bolt", Name: "Молния", Type: DamageAbility, Damage: 30, ManaCost: 10}
+
+func TestStatusEffectsStacking(t *testing.T) {
+	poison := StatusEffect{Name: "Яд", Duration: 3, MaxStacks: 2, Stacking: StackIntensity, DamagePerTurn: 6}
+	stun := StatusEffect{Name: "Оглушение", Duration: 1, Stacking: StackIgnore, Stun: true}
+
+	var effects StatusEffects
+	for i := 0; i < 3; i++ {
+		effects.Add(poison)
+	}
+	if len(effects) != 1 || effects[0].Stacks != 2 {
+		t.Errorf("яд после трёх наложений = %+v, ожидается один эффект x2", effects)
+	}
+
+	effects.Add(stun)
+	effects[1].Duration = 5
+	effects.Add(stun)
+	if len(effects) != 2 || effects[1].Duration != 5 {
+		t.Errorf("повторное оглушение изменило эффект: %+v", effects)
+	}
+
+	effects = StatusEffects{{Name: "Щит", Duration: 3, Stacks: 1, Shield: 10}}
+	if rest := effects.AbsorbDamage(25); rest != 15 || len(effects) != 0 {
+		t.Errorf("AbsorbDamage = %d, эффекты %+v; ожидается 15 и снятый щит", rest, effects)
+	}
+}
+
+func TestTickEffectsDuration(t *testing.T) {
+	tests := []struct {
+		name       string
+		effect     StatusEffect
+		wantRounds int // сколько концов раунда эффект переживает, считая раунд наложения
+		wantHP     int
+	}{
+		{"прибавка действует с раунда наложения", StatusEffect{Name: "Ярость", Duration: 3, AttackBonus: 5}, 2, 100},
+		{"щит действует с раунда наложения", StatusEffect{Name: "Щит", Duration: 2, Shield: 10}, 1, 100},
+		{"яд тикает со следующего раунда", StatusEffect{Name: "Яд", Duration: 3, DamagePerTurn: 5}, 3, 85},
+		{"оглушение на следующий раунд", StatusEffect{Name: "Оглушение", Duration: 1, Stun: true}, 1, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fighter := testFighter("Цель", 10)
+			fighter.Effects.Add(tt.effect)
+			rounds := 0
+			for len(fighter.Effects) > 0 && rounds < 10 {
+				tickEffects(fighter)
+				if len(fighter.Effects) > 0 {
+					rounds++
+				}
+			}
+			if rounds != tt.wantRounds || fighter.HP != tt.wantHP {
+				t.Errorf("эффект пережил %d раундов, HP %d; ожидается %d и %d", rounds, fighter.HP, tt.wantRounds, tt.wantHP)
+			}
+		})
+	}
+}
+
+func TestResolveRound(t *testing.T) {
+	tests := []struct {
+		name          string
+		setup         func(first, second *Player)
+		first, second CombatAction
+		crits         [2]bool
+		wantHP        [2]int
+		wantDamage    [2]int
+		wantBlocked   [2]bool
+		wantDead      [2]bool
+		check         func(t *testing.T, result RoundResult, first, second *Player)
+	}{
+		{
+			name:        "удар заблокирован",
+			first:       attackAction(Head, Torso),
+			second:      attackAction(Torso, Head),
+			wantHP:      [2]int{100, 100},
+			wantBlocked: [2]bool{true, true},
+		},
+		{
+			name:       "блок не угадан",
+			first:      attackAction(Legs, Torso),
+			second:     idleAction(Head),
+			wantHP:     [2]int{100, 80},
+			wantDamage: [2]int{20, 0},
+		},
+		{
+			name:       "обмен ударами одновременный",
+			first:      attackAction(Arms, Head),
+			second:     attackAction(Legs, Torso),
+			wantHP:     [2]int{80, 80},
+			wantDamage: [2]int{20, 20},
+		},
+		{
+			name: "урон способности",
+			setup: func(first, second *Player) {
+				first.Abilities = []Ability{testBolt}
+			},
+			first:  abilityAction(0, Head),
+			second: idleAction(Legs),
+			// 30 урона способности плюс половина силы
+			wantHP: [2]int{100, 60},
+			check: func(t *testing.T, result RoundResult, first, second *Player) {
+				if first.Mana != 40 {
+					t.Errorf("мана после способности = %d, ожидается 40", first.Mana)
+				}
+				if result.Sides[0].Effect == "" {
+					t.Error("нет описания действия способности")
+				}
+			},
+		},
+		{
+			name: "способности не хватает маны",
+			setup: func(first, second *Player) {
+				first.Abilities = []Ability{testBolt}
+				first.Mana = 5
+			},
+			first:  abilityAction(0, Head),
+			second: idleAction(Legs),
+			wantHP: [2]int{100, 100},
+		},
+		{
+			name: "предмет лечит до обмена ударами",
+			setup: func(first, second *Player) {
+				first.HP = 50
+				first.Inventory = []Item{{Name: "Зелье", Type: Consumable, PlusHP: 30}}
+			},
+			first:      itemAction(0, Head),
+			second:     attackAction(Torso, Legs),
+			wantHP:     [2]int{60, 100},
+			wantDamage: [2]int{0, 20},
+			check: func(t *testing.T, result RoundResult, first, second *Player) {
+				if len(first.Inventory) != 0 {
+					t.Errorf("зелье не потрачено: %v", first.Inventory)
+				}
+			},
+		},
+		{
+			name: "броня поглощает половину удара",
+			setup: func(first, second *Player) {
+				second.Equipment = []Item{testArmor(SlotChest)}
+			},
+			first:      attackAction(Torso, Torso),
+			second:     idleAction(Legs),
+			wantHP:     [2]int{100, 90},
+			wantDamage: [2]int{10, 0},
+			check: func(t *testing.T, result RoundResult, first, second *Player) {
+				if result.Sides[0].Absorbed != 10 {
+					t.Errorf("поглощено %d урона, ожидается 10", result.Sides[0].Absorbed)
+				}
+			},
+		},
+		{
+			name: "бафф защиты снижает урон способности",
+			setup: func(first, second *Player) {
+				first.Abilities = []Ability{testBolt}
+				second.Effects = StatusEffects{{Name: "Стойкость", Duration: 2, Stacks: 1, DefenseBonus: DEFENSE_SCALE}}
+			},
+			first:  abilityAction(0, Head),
+			second: idleAction(Legs),
+			wantHP: [2]int{100, 80},
+		},
+		{
+			name: "сквозь любую защиту проходит минимальный урон",
+			setup: func(first, second *Player) {
+				second.Effects = StatusEffects{{Name: "Стойкость", Duration: 2, Stacks: 1, DefenseBonus: 1000}}
+			},
+			first:      attackAction(Head, Torso),
+			second:     idleAction(Legs),
+			wantHP:     [2]int{100, 100 - MIN_DAMAGE},
+			wantDamage: [2]int{MIN_DAMAGE, 0},
+		},
+		{
+			name: "яд тикает в конце раунда",
+			setup: func(first, second *Player) {
+				second.Effects = StatusEffects{{Name: "Яд", Duration: 2, Stacks: 2, DamagePerTurn: 4}}
+			},
+			first:  idleAction(Head),
+			second: idleAction(Head),
+			wantHP: [2]int{100, 92},
+			check: func(t *testing.T, result RoundResult, first, second *Player) {
+				if len(result.Sides[1].Ticks) != 1 {
+					t.Errorf("тики = %v, ожидается один", result.Sides[1].Ticks)
+				}
+				if len(second.Effects) != 1 || second.Effects[0].Duration != 1 {
+					t.Errorf("эффекты после тика = %+v", second.Effects)
+				}
+			},
+		},
+		{
+			name: "свежий эффект не тикает в раунде наложения",
+			setup: func(first, second *Player) {
+				second.Effects.Add(StatusEffect{Name: "Яд", Duration: 1, DamagePerTurn: 5})
+			},
+			first:  idleAction(Head),
+			second: idleAction(Head),
+			wantHP: [2]int{100, 100},
+		},
+		{
+			name: "оглушённый не бьёт и не блокирует",
+			setup: func(first, second *Player) {
+				second.Effects = StatusEffects{{Name: "Оглушение", Duration: 1, Stacks: 1, Stun: true}}
+			},
+			first:      attackAction(Head, Torso),
+			second:     attackAction(Head, Head),
+			wantHP:     [2]int{100, 80},
+			wantDamage: [2]int{20, 0},
+		},
+		{
+			name: "щит поглощает урон",
+			setup: func(first, second *Player) {
+				second.Effects = StatusEffects{{Name: "Щит", Duration: 2, Stacks: 1, Shield: 15}}
+			},
+			first:      attackAction(Head, Torso),
+			second:     idleAction(Legs),
+			wantHP:     [2]int{100, 95},
+			wantDamage: [2]int{5, 0},
+		},
+		{
+			name:       "пропуск хода",
+			first:      attackAction(Head, Torso),
+			second:     idleAction(Legs),
+			wantHP:     [2]int{100, 80},
+			wantDamage: [2]int{20, 0},
+			check: func(t *testing.T, result RoundResult, first, second *Player) {
+				if result.Sides[1].Attacked || result.Sides[1].Effect == "" {
+					t.Errorf("пропуск хода = %+v", result.Sides[1])
+				}
+			},
+		},
+		{
+			name: "гибель",
+			setup: func(first, second *Player) {
+				first.BaseStrength = 150
+			},
+			first:      attackAction(Torso, Head),
+			second:     idleAction(Legs),
+			wantHP:     [2]int{100, -50},
+			wantDamage: [2]int{150, 0},
+			wantDead:   [2]bool{false, true},
+		},
+		{
+			name:       "критический удар",
+			first:      attackAction(Head, Torso),
+			second:     idleAction(Legs),
+			crits:      [2]bool{true, false},
+			wantHP:     [2]int{100, 70},
+			wantDamage: [2]int{30, 0},
+			check: func(t *testing.T, result RoundResult, first, second *Player) {
+				if !result.Sides[0].Critical {
+					t.Error("удар не отмечен как критический")
+				}
+			},
+		},
+		{
+			name: "шлем защищает голову",
+			setup: func(first, second *Player) {
+				second.Equipment = []Item{testArmor(SlotHelmet)}
+			},
+			first:      attackAction(Head, Torso),
+			second:     idleAction(Legs),
+			wantHP:     [2]int{100, 90},
+			wantDamage: [2]int{10, 0},
+		},
+		{
+			name: "шлем не защищает торс",
+			setup: func(first, second *Player) {
+				second.Equipment = []Item{testArmor(SlotHelmet)}
+			},
+			first:      attackAction(Torso, Torso),
+			second:     idleAction(Legs),
+			wantHP:     [2]int{100, 80},
+			wantDamage: [2]int{20, 0},
+		},
+		{
+			name: "амулет защищает всё тело",
+			setup: func(first, second *Player) {
+				second.Equipment = []Item{testArmor(SlotAmulet)}
+			},
+			first:      attackAction(Legs, Torso),
+			second:     idleAction(Head),
+			wantHP:     [2]int{100, 90},
+			wantDamage: [2]int{10, 0},
+		},
+		{
+			name:        "крит не срабатывает при блоке",
+			first:       attackAction(Head, Torso),
+			second:      idleAction(Head),
+			crits:       [2]bool{true, false},
+			wantHP:      [2]int{100, 100},
+			wantBlocked: [2]bool{true, false},
+			check: func(t *testing.T, result RoundResult, first, second *Player) {
+				if result.Sides[0].Critical {
+					t.Error("заблокированный удар отмечен как критический")
+				}
+			},
+		},
+		{
+			name: "вампиризм возвращает часть урона",
+			setup: func(first, second *Player) {
+				first.HP = 50
+				first.Equipment = []Item{{ID: "fang", Name: "Клык", Type: Weapon,
+					Affixes: []Affix{{Kind: AffixLifesteal, Value: 50}}}}
+			},
+			first:      attackAction(Head, Torso),
+			second:     idleAction(Legs),
+			wantHP:     [2]int{60, 80},
+			wantDamage: [2]int{20, 0},
+			check: func(t *testing.T, result RoundResult, first, second *Player) {
+				if result.Sides[0].Healed != 10 {
+					t.Errorf("восстановлено %d HP, ожидается 10", result.Sides[0].Healed)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second := testFighter("Первый", 20), testFighter("Второй", 20)
+			if tt.setup != nil {
+				tt.setup(first, second)
+			}
+			result := resolveRound(testPack, first, second, tt.first, tt.second, tt.crits)
+
+			if got := [2]int{first.HP, second.HP}; got != tt.wantHP {
+				t.Errorf("HP = %v, ожидается %v", got, tt.wantHP)
+			}
+			if got := [2]int{result.Sides[0].Damage, result.Sides[1].Damage}; tt.wantDamage != [2]int{} && got != tt.wantDamage {
+				t.Errorf("урон = %v, ожидается %v", got, tt.wantDamage)
+			}
+			if got := [2]bool{result.Sides[0].Blocked, result.Sides[1].Blocked}; got != tt.wantBlocked {
+				t.Errorf("блоки = %v, ожидается %v", got, tt.wantBlocked)
+			}
+			if result.Dead != tt.wantDead {
+				t.Errorf("гибель = %v, ожидается %v", result.Dead, tt.wantDead)
+			}
+			if tt.check != nil {
+				tt.check(t, result, first, second)
+			}
+		})
+	}
+}
+
+func TestEnemyAIChoosesAbility(t *testing.T) {
+	heal := Ability{Name: "Лечение", Type: HealAbility, Heal: 40, ManaCost: 10}
+	smite := Ability{Name: "Кара", Type: DamageAbility, Damage: 30, ManaCost: 10}
+	poison := Ability{Name: "Отрава", Type: CurseAbility, ManaCost: 10,
+		Effect: &StatusEffect{Name: "Яд", Duration: 3, MaxStacks: 2, Stacking: StackIntensity, DamagePerTurn: 5}}
+
+	tests := []struct {
+		name     string
+		ai       EnemyAI
+		ability  Ability
+		hp, mana int
+		targetHP int
+		effects  StatusEffects
+		wantCast bool
+	}{
+		{"осторожный лечится ниже порога", DefensiveAI{HealThreshold: 50}, heal, 40, 20, 100, nil, true},
+		{"осторожный не лечится без нужды", DefensiveAI{HealThreshold: 50}, heal, 90, 20, 100, nil, false},
+		{"осторожный бьёт способностью только насмерть", DefensiveAI{HealThreshold: 50}, smite, 100, 20, 100, nil, false},
+		{"осторожный добивает способностью", DefensiveAI{HealThreshold: 50}, smite, 100, 20, 30, nil, true},
+		{"без маны только атака", AggressiveAI{}, smite, 100, 5, 100, nil, false},
+		{"агрессивный накладывает яд", AggressiveAI{}, poison, 100, 20, 100, nil, true},
+		{"агрессивный не тратит ману на полный яд", AggressiveAI{}, poison, 100, 20, 100,
+			StatusEffects{{Name: "Яд", Duration: 2, Stacks: 2, MaxStacks: 2, Stacking: StackIntensity}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enemy := &Enemy{Name: "Босс", HP: tt.hp, MaxHP: 100, Mana: tt.mana, Strength: 10, Ability: tt.ability, AI: tt.ai,
+				rng: rand.New(rand.NewSource(1))}
+			target := testFighter("Игрок", 10)
+			target.HP = tt.targetHP
+			target.Effects = tt.effects
+
+			action := enemy.ChooseAction(target)
+			if cast := action.AbilityID == 0; cast != tt.wantCast {
+				t.Errorf("способность применена: %v, ожидается %v (действие %+v)", cast, tt.wantCast, action)
+			}
+		})
+	}
+}
+
+func TestPatternTrackerFollowsHabits(t *testing.T) {
+	tracker := &PatternTracker{}
+	for i := 0; i < 100; i++ {
+		// Игрок всегда бьёт в голову и защищает голову
+		tracker.Record(attackAction(Head, Head))
+	}
+	tracker.Record(abilityAction(0, Head))
+	if tracker.HitCounts[Head] != 100 || tracker.BlockCounts[Head] != 101 {
+		t.Errorf("статистика = %+v, способность не должна считаться ударом", tracker)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	var blocks, hits [4]int
+	for i := 0; i < 1000; i++ {
+		blocks[tracker.PredictTarget(r)]++
+		hits[tracker.PredictOpening(r)]++
+	}
+	if blocks[Head] < 900 {
+		t.Errorf("защита головы выбрана %d раз из 1000, ожидается почти всегда", blocks[Head])
+	}
+	if hits[Head] > 100 {
+		t.Errorf("удар в защищённую голову выбран %d раз из 1000, ожидается редко", hits[Head])
+	}
+}
+
+func TestSaveRoundTrip(t *testing.T) {
+	chdirTemp(t)
+	if _, err := readSave(testPack, 1); err != errEmptySlot {
+		t.Fatalf("пустой слот: %v, ожидается errEmptySlot", err)
+	}
+
+	player := testFighter("Путник", 15)
+	player.Effects = StatusEffects{{Name: "Яд", Duration: 2, Stacks: 1, DamagePerTurn: 4}}
+	save := SaveGame{Chapter: 2, Seed: 42, Player: player, Tracker: PatternTracker{HitCounts: [4]int{1, 2, 3, 4}}}
+	if err := writeSave(1, save); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readSave(testPack, 1)
+	if err != nil {
+		t.Fatalf("readSave: %v", err)
+	}
+	if loaded.Version != SAVE_VERSION || loaded.Chapter != 2 || loaded.Seed != 42 || loaded.Tracker != save.Tracker {
+		t.Errorf("данные кампании = %+v", loaded)
+	}
+	if loaded.Player.Name != "Путник" || loaded.Player.BaseStrength != 15 || len(loaded.Player.Effects) != 1 {
+		t.Errorf("персонаж = %+v", loaded.Player)
+	}
+
+	data, err := os.ReadFile(savePath(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(data), "Путник", "Читер", 1)
+	if err := os.WriteFile(savePath(1), []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSave(testPack, 1); err == nil || !strings.Contains(err.Error(), "контрольная сумма") {
+		t.Errorf("изменённое сохранение: %v, ожидается ошибка контрольной суммы", err)
+	}
+}
+
+func TestContentPackValidate(t *testing.T) {
+	chdirTemp(t)
+	data, err := json.Marshal(defaultContentPack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("pack.json", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pack, err := loadContentPack("pack.json")
+	if err != nil {
+		t.Fatalf("встроенный набор не прочитан из файла: %v", err)
+	}
+	if len(pack.buildChapters(NewGameSession(nil, pack, 1))) != len(testPack.Chapters) {
+		t.Error("набор из файла дал другое число глав")
+	}
+
+	pack = defaultContentPack()
+	pack.Enemies[0].Ability = "missing_ability"
+	pack.Chapters[0].Merchant = "missing_merchant"
+	pack.Items = append(pack.Items, pack.Items[0])
+	err = pack.Validate()
+	for _, want := range []string{`неизвестная способность "missing_ability"`, `неизвестный торговец "missing_merchant"`, "повторяющийся ID"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate = %v, ожидается ошибка %q", err, want)
+		}
+	}
+}
+
+// fightInputs — ввод на rounds раундов: обычная атака в hit, защита block
+// и Enter после раунда
+func fightInputs(rounds int, hit, block string) []string {
+	var inputs []string
+	for i := 0; i < rounds; i++ {
+		inputs = append(inputs, "1", hit, block, "")
+	}
+	return inputs
+}
+
+func TestScriptedHotseat(t *testing.T) {
+	chdirTemp(t)
+	inputs := []string{"2", "1", "Первая", "Вторая", "n", "n", ""}
+	for i := 0; i < 30; i++ {
+		// Первый бьёт туда, где второй всегда защищается
+		inputs = append(inputs, "1", "0", "1", "", "1", "3", "0", "")
+	}
+	scripted := NewScriptedIO(inputs...)
+	err := mainMenu(NewGameSession(scripted, testPack, 1))
+	out := scripted.Output()
+	if err != nil {
+		t.Fatalf("сценарий прерван: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"=== НАЧАЛО PVP БИТВЫ ===",
+		"Первая VS Вторая",
+		"🛡️ Вторая блокирует удар в голова!",
+		"💥 Удар достиг цели! Вторая наносит 10 урона Первая!",
+		"🏆 Вторая ПОБЕЖДАЕТ В PVP БИТВЕ! 🏆",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("в выводе нет %q", want)
+		}
+	}
+	if strings.Contains(out, "Первая наносит") {
+		t.Error("удары первого игрока должны блокироваться")
+	}
+}
+
+func TestHotseatDoubleKnockout(t *testing.T) {
+	first, second := testFighter("Первая", 10), testFighter("Вторая", 10)
+	first.HP, second.HP = 5, 5
+	// Оба бьют мимо защиты друг друга и падают в одном раунде
+	scripted := NewScriptedIO("", "1", "0", "1", "", "1", "2", "3")
+	if err := pvpFight(NewGameSession(scripted, testPack, 1), []*Player{first, second}); err != nil {
+		t.Fatalf("сценарий прерван: %v\n%s", err, scripted.Output())
+	}
+	out := scripted.Output()
+	if !strings.Contains(out, "Ничья! Оба бойца пали.") || strings.Contains(out, "ПОБЕЖДАЕТ") {
+		t.Errorf("двойной нокаут должен быть ничьей:\n%s", out)
+	}
+}
+
+func TestScriptedCampaign(t *testing.T) {
+	t.Parallel()
+	// Кампания из одной главы, чтобы сценарий оставался коротким
+	pack := defaultContentPack()
+	pack.Chapters = pack.Chapters[:1]
+	for _, item := range pack.Items {
+		for i := range item.Effects {
+			// Ключи ведут в главы, которых в урезанной кампании нет
+			if item.Effects[i].Kind == EffectUnlock {
+				item.Effects[i].Chapter = pack.Chapters[0].ID
+			}
+		}
+	}
+	inputs := []string{
+		"Инквизитор",
+		"y", "2", "2", "5", // торговец: купить железный шлем
+		"y", "3", "0", "3", "0", "3", "2", "2", "6", // надеть меч, доспех и шлем
+		"",
+	}
+	inputs = append(inputs, fightInputs(40, "1", "0")...)
+	scripted := NewScriptedIO(inputs...)
+	err := startCampaign(NewGameSession(scripted, mustValidate(pack), 7), "")
+	out := scripted.Output()
+	if err != nil {
+		t.Fatalf("сценарий прерван: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"=== ПРОЛОГ ===",
+		"Вы - Инквизитор",
+		"🎲 Зерно партии: 7",
+		"=== ГЛАВА 1 ===",
+		"Старый торговец: «Ты чего тут забыл?»",
+		"Вы купили Железный шлем за 60 золота!",
+		"1. голова: Железный шлем",
+		"Итого: атака 15, защита: голова 6, торс 5, руки 0, ноги 0",
+		"=== РАУНД 1 ===",
+		"=== ЭПИЛОГ ===",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("в выводе нет %q", want)
+		}
+	}
+}
+
+func TestValidateAction(t *testing.T) {
+	player := testFighter("Игрок", 10)
+	player.Abilities = []Ability{testBolt}
+	player.Inventory = []Item{
+		{ID: "potion", Name: "Зелье", Type: Consumable, PlusHP: 10},
+		{ID: "charm", Name: "Оберег", Type: Special, Effects: []ItemEffect{{Kind: EffectRevive, Value: 30}}},
+	}
+
+	tests := []struct {
+		name    string
+		mana    int
+		action  CombatAction
+		wantErr string
+	}{
+		{"удар", 50, attackAction(Head, Legs), ""},
+		{"способность", 50, abilityAction(0, Torso), ""},
+		{"предмет", 50, itemAction(0, Arms), ""},
+		{"удар мимо тела", 50, attackAction(BodyPart(7), Head), "неверная часть тела для удара"},
+		{"защита мимо тела", 50, attackAction(Head, BodyPart(-3)), "неверная часть тела для защиты"},
+		{"чужая способность", 50, abilityAction(3, Head), "нет способности"},
+		{"без маны", 5, abilityAction(0, Head), "недостаточно маны"},
+		{"чужой предмет", 50, itemAction(2, Head), "нет предмета"},
+		{"оберег вместо хода", 50, itemAction(1, Head), "срабатывает сам"},
+		{"способность и предмет сразу", 50, CombatAction{BlockPart: Head, AbilityID: 0, ItemID: 0}, "одновременно"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			player.Mana = tt.mana
+			err := validateAction(player, tt.action)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateAction = %v, ожидается nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateAction = %v, ожидается %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSanitizeLoadout(t *testing.T) {
+	claimed := &PlayerData{
+		Name:         "  " + strings.Repeat("Я", 40) + "  ",
+		HP:           9999,
+		MaxHP:        9999,
+		BaseStrength: 500,
+		Gold:         1000000,
+		Equipment: []Item{
+			{ID: "paladin_sword", Name: "Меч паладина", Type: Weapon, Attack: 5},
+			{ID: "forged_blade", Name: "Подделка", Type: Weapon, Attack: 999},
+		},
+	}
+	player := sanitizeLoadout(testPack, claimed)
+	if player.Name != strings.Repeat("Я", 32) {
+		t.Errorf("имя = %q, ожидается обрезанное до 32 символов", player.Name)
+	}
+	if player.HP != START_HP || player.BaseStrength != 10 || player.Gold != START_GOLD {
+		t.Errorf("характеристики клиента не сброшены: %+v", player)
+	}
+	if len(player.Equipment) != 1 || player.Equipment[0].ID != "paladin_sword" {
+		t.Errorf("экипировка = %+v, ожидается только меч из стартового набора", player.Equipment)
+	}
+	if sanitizeLoadout(testPack, nil).Name != "Игрок" {
+		t.Error("игрок без данных должен получить имя по умолчанию")
+	}
+}
+
+// connectionPair — два конца соединения в памяти
+func connectionPair(t *testing.T) (local, peer *Connection) {
+	server, client := net.Pipe()
+	local, peer = NewConnection(server), NewConnection(client)
+	t.Cleanup(func() {
+		local.Close()
+		peer.Close()
+	})
+	return local, peer
+}
+
+func TestRemoteSeatSkipsStaleActions(t *testing.T) {
+	conn, peer := connectionPair(t)
+	seat := newRemoteSeat(NewScriptedIO(), testFighter("Гость", 10), newSession(conn), func(string) {})
+	// Ход прошлого раунда пришёл после таймаута и не должен засчитаться
+	peer.Send(actionToMessage(attackAction(Legs, Legs), 1))
+	peer.Send(actionToMessage(attackAction(Head, Arms), 2))
+
+	action, err := seat.RequestAction(2, testFighter("Хозяин", 10), time.Now().Add(time.Second))
+	if err != nil || action != attackAction(Head, Arms) {
+		t.Errorf("RequestAction = %+v, %v; ожидается ход раунда 2", action, err)
+	}
+
+	start := time.Now()
+	_, err = seat.RequestAction(3, testFighter("Хозяин", 10), start.Add(50*time.Millisecond))
+	if err != errTurnTimeout {
+		t.Errorf("без хода RequestAction = %v, ожидается errTurnTimeout", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("таймаут хода не соблюдён")
+	}
+}
+
+func TestConnectionDemultiplexes(t *testing.T) {
+	conn, peer := connectionPair(t)
+	// Непрочитанный чат не должен останавливать чтение остальных сообщений
+	for i := 0; i < MESSAGE_BUFFER+5; i++ {
+		peer.Send(GameMessage{Type: ChatMessage, Text: "привет"})
+	}
+	peer.Send(GameMessage{Type: PlayerAction, Round: 1})
+	peer.Send(GameMessage{Type: GameStateMsg, Round: 1})
+	peer.Send(GameMessage{Type: Disconnect})
+
+	select {
+	case msg := <-conn.Actions:
+		if msg.Round != 1 {
+			t.Errorf("действие = %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("действие не дошло: чтение остановилось на чате")
+	}
+	if msg, err := conn.Next(); err != nil || msg.Type != GameStateMsg {
+		t.Errorf("первым ожидается итог раунда, получено %+v, %v", msg, err)
+	}
+	if _, err := conn.Expect(GameStateMsg); err == nil {
+		t.Error("Expect принял Disconnect вместо состояния")
+	}
+	if n := len(conn.Chat); n != MESSAGE_BUFFER {
+		t.Errorf("в очереди чата %d сообщений, ожидается %d", n, MESSAGE_BUFFER)
+	}
+}
+
+func TestConnectionRejectsFlood(t *testing.T) {
+	queues := map[GameMessageType]func(*Connection) chan GameMessage{
+		PlayerAction: func(c *Connection) chan GameMessage { return c.Actions },
+		GameStateMsg: func(c *Connection) chan GameMessage { return c.State },
+		LobbyCommand: func(c *Connection) chan GameMessage { return c.Control },
+	}
+	for kind, queue := range queues {
+		conn, peer := connectionPair(t)
+		// Очередь никто не читает: лишнее сообщение не должно остановить чтение
+		for i := 0; i <= MESSAGE_BUFFER; i++ {
+			peer.Send(GameMessage{Type: kind, Round: i})
+		}
+
+		select {
+		case <-conn.closed:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("тип %d: чтение остановилось на переполненной очереди", kind)
+		}
+		if err := conn.Err(); !errors.Is(err, errQueueOverflow) {
+			t.Errorf("тип %d: Err = %v, ожидается %v", kind, err, errQueueOverflow)
+		}
+		if n := len(queue(conn)); n != MESSAGE_BUFFER {
+			t.Errorf("тип %d: в очереди %d сообщений, ожидается %d", kind, n, MESSAGE_BUFFER)
+		}
+	}
+}
+
+func TestLobbyChallenge(t *testing.T) {
+	t.Parallel()
+	lobby := NewLobby(NewGameSession(NewScriptedIO(), testPack, 1), MatchRules{TurnTimeout: TURN_TIMEOUT}, "")
+	connA, peerA := connectionPair(t)
+	connB, peerB := connectionPair(t)
+	a, err := lobby.join(&PlayerData{Name: "Аня"}, newSession(connA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := lobby.join(&PlayerData{Name: "Аня"}, newSession(connB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Name != "Аня (2)" {
+		t.Errorf("второй игрок с тем же именем назван %q", b.Name)
+	}
+
+	for target, want := range map[string]string{"Борис": "не найден", "Аня": "самого себя"} {
+		if err := lobby.challenge(a, target); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("вызов %q: %v, ожидается %q", target, err, want)
+		}
+	}
+
+	if err := lobby.challenge(a, b.Name); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-peerB.Notices:
+		if !strings.Contains(msg.Text, "вызывает вас на бой") {
+			t.Errorf("объявление = %q", msg.Text)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("вызванный игрок не получил объявления")
+	}
+	if a.state != clientWaiting {
+		t.Errorf("вызвавший игрок %s, ожидается %s", a.state, clientWaiting)
+	}
+	// Ответный вызов начинает бой
+	if err := lobby.challenge(b, a.Name); err != nil {
+		t.Fatal(err)
+	}
+	m := <-a.matched
+	if !strings.Contains(lobby.Describe(), "#1: Аня VS Аня (2)") {
+		t.Errorf("бой не виден в лобби:\n%s", lobby.Describe())
+	}
+
+	// Оба соперника выходят из боя — он должен завершиться
+	peerA.Send(GameMessage{Type: Disconnect})
+	peerB.Send(GameMessage{Type: Disconnect})
+	select {
+	case <-m.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("бой не завершился после отключения игроков")
+	}
+	lobby.running.Wait()
+	if a.state != clientIdle || len(lobby.matches) != 0 {
+		t.Errorf("после боя: игрок %s, боёв %d", a.state, len(lobby.matches))
+	}
+}
+
+func TestCheckHello(t *testing.T) {
+	hello := func(change func(h *HelloData)) *HelloData {
+		h := localHello(testPack, "")
+		change(h)
+		return h
+	}
+	tests := []struct {
+		name   string
+		remote *HelloData
+		want   string
+	}{
+		{"совместимая сторона", localHello(testPack, ""), ""},
+		{"без приветствия", nil, "старая версия"},
+		{"старый протокол", hello(func(h *HelloData) { h.Protocol = PROTOCOL_VERSION - 1 }), "несовместимая версия протокола"},
+		{"протокол из будущего", hello(func(h *HelloData) { h.Protocol = PROTOCOL_VERSION + 1 }), "несовместимая версия протокола"},
+		{"другой контент", hello(func(h *HelloData) { h.ContentHash = "0123456789abcdef" }), "наборы контента различаются"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkHello(testPack, tt.remote)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("checkHello = %v, ожидается nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("checkHello = %v, ожидается %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name             string
+		server, client   string
+		wantServer       bool
+		wantClient       error
+		wantClientSubstr string
+	}{
+		{name: "открытый сервер", wantServer: true},
+		{name: "верный пароль", server: "секрет", client: "секрет", wantServer: true},
+		{name: "неверный пароль", server: "секрет", client: "догадка", wantClientSubstr: "неверный пароль"},
+		{name: "пароль не задан", server: "секрет", wantClient: errPasswordRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := connectionPair(t)
+			done := make(chan error, 1)
+			go func() {
+				hello, err := serverHandshake(server, testPack, tt.server)
+				if err == nil && hello.Session != "токен" {
+					err = fmt.Errorf("сервер получил сессию %q", hello.Session)
+				}
+				if err == nil {
+					err = server.Send(GameMessage{Type: Hello, Hello: localHello(testPack, "новый")})
+				}
+				done <- err
+			}()
+
+			hello, err := clientHandshake(client, testPack, "токен", tt.client)
+			switch {
+			case tt.wantClient != nil:
+				if !errors.Is(err, tt.wantClient) {
+					t.Errorf("clientHandshake = %v, ожидается %v", err, tt.wantClient)
+				}
+			case tt.wantClientSubstr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantClientSubstr) {
+					t.Errorf("clientHandshake = %v, ожидается %q", err, tt.wantClientSubstr)
+				}
+			case err != nil || hello.Session != "новый":
+				t.Errorf("clientHandshake = %+v, %v", hello, err)
+			}
+			if err != nil {
+				client.Close()
+			}
+			if err := <-done; (err == nil) != tt.wantServer {
+				t.Errorf("serverHandshake = %v", err)
+			}
+		})
+	}
+}
+
+func TestClientWarnsPasswordWithoutTLS(t *testing.T) {
+	// Адрес, на котором никто не слушает: до подключения дело не дойдёт
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	for _, tt := range []struct {
+		address string
+		warn    bool
+	}{
+		{address, true},
+		{"tls://" + address, false},
+	} {
+		scripted := NewScriptedIO()
+		game := NewGameSession(scripted, testPack, 1)
+		game.Config.Password = "секрет"
+		if err := runClient(game, tt.address, "Гость"); err != nil {
+			t.Fatal(err)
+		}
+		if warned := strings.Contains(scripted.Output(), plainPasswordWarning); warned != tt.warn {
+			t.Errorf("%s: предупреждение о пароле без TLS = %v, ожидается %v", tt.address, warned, tt.warn)
+		}
+	}
+}
+
+func TestRemoteSeatResumesAfterDrop(t *testing.T) {
+	t.Parallel()
+	first, firstPeer := connectionPair(t)
+	session := newSession(first)
+	var notices []string
+	seat := newRemoteSeat(NewScriptedIO(), testFighter("Гость", 10), session, func(text string) { notices = append(notices, text) })
+
+	type answer struct {
+		action CombatAction
+		err    error
+	}
+	answers := make(chan answer, 1)
+	go func() {
+		action, err := seat.RequestAction(1, testFighter("Хозяин", 10), time.Now().Add(5*time.Second))
+		answers <- answer{action, err}
+	}()
+
+	// Связь обрывается посреди хода, игрок возвращается с новым соединением
+	firstPeer.Close()
+	second, secondPeer := connectionPair(t)
+	session.Resume(second)
+
+	msg, err := secondPeer.Expect(MatchResume)
+	if err != nil || msg.Round != 1 || msg.Player.Name != "Гость" {
+		t.Fatalf("вернувшийся игрок получил %+v, %v", msg, err)
+	}
+	secondPeer.Send(actionToMessage(attackAction(Torso, Legs), 1))
+
+	select {
+	case got := <-answers:
+		if got.err != nil || got.action != attackAction(Torso, Legs) {
+			t.Errorf("RequestAction = %+v, %v", got.action, got.err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ход после переподключения не принят")
+	}
+	if session.Conn() != second {
+		t.Error("сессия не переключилась на новое соединение")
+	}
+	if len(notices) == 0 || !strings.Contains(notices[len(notices)-1], "вернулся в бой") {
+		t.Errorf("сопернику не сообщили о возвращении: %v", notices)
+	}
+
+	lobby := NewLobby(NewGameSession(NewScriptedIO(), testPack, 1), MatchRules{TurnTimeout: TURN_TIMEOUT}, "")
+	if _, err := lobby.resume("unknown", second); err == nil {
+		t.Error("неизвестная сессия возобновлена")
+	}
+}
+
+func TestCountdownSurvivesPreviousRoundState(t *testing.T) {
+	t.Parallel()
+	session := &clientSession{ui: NewScriptedIO()}
+	defer session.stopCountdown()
+	// Начало раунда 2 обработано раньше, чем итог раунда 1
+	session.startCountdown(2, 60)
+	session.stopCountdownThrough(1)
+	if session.countdown == nil {
+		t.Fatal("итог раунда 1 остановил отсчёт раунда 2")
+	}
+	// Запоздавшее начало раунда 1 не сбивает текущий отсчёт
+	session.startCountdown(1, 60)
+	if session.countdownRound != 2 {
+		t.Errorf("отсчёт идёт для раунда %d, ожидается 2", session.countdownRound)
+	}
+	if !session.roundPassed(1) || session.roundPassed(2) {
+		t.Error("раунд 1 должен считаться разыгранным, раунд 2 — нет")
+	}
+	session.stopCountdownThrough(2)
+	if session.countdown != nil {
+		t.Error("итог раунда 2 не остановил его отсчёт")
+	}
+}
+
+// idleSeat — место игрока, который всегда отвечает одним и тем же или
+// не отвечает вовсе
+type idleSeat struct {
+	player   *Player
+	action   CombatAction
+	afk      bool
+	finished string
+}
+
+func (s *idleSeat) Player() *Player                         { return s.player }
+func (s *idleSeat) StartTurn(round int, deadline time.Time) {}
+func (s *idleSeat) RejectAction(reason string)              {}
+func (s *idleSeat) SendRound(round int, result RoundResult, opponent *Player) {
+}
+func (s *idleSeat) Finish(winner, loser, reason string) { s.finished = reason }
+
+func (s *idleSeat) RequestAction(round int, opponent *Player, deadline time.Time) (CombatAction, error) {
+	if s.afk {
+		return CombatAction{}, errTurnTimeout
+	}
+	return s.action, nil
+}
+
+func TestRunMatchForfeitsAFK(t *testing.T) {
+	active := &idleSeat{player: testFighter("Активный", 10), action: attackAction(Head, Torso)}
+	away := &idleSeat{player: testFighter("Ушедший", 10), afk: true}
+	conn, watcher := connectionPair(t)
+	audience := &Audience{}
+	audience.Add(conn)
+	runMatch(NewGameSession(NewScriptedIO(), testPack, 1), [2]Seat{active, away}, MatchRules{TurnTimeout: time.Second, AFKLimit: 2}, audience)
+
+	for _, seat := range []*idleSeat{active, away} {
+		if !strings.Contains(seat.finished, "Ушедший бездействует (пропущено ходов подряд: 2)") {
+			t.Errorf("%s: итог боя %q", seat.player.Name, seat.finished)
+		}
+	}
+
+	// Зритель видит начало, оба раунда и итог. Next отдаёт итоги раундов
+	// раньше управляющих сообщений, поэтому порядок не проверяется.
+	seen := make(map[GameMessageType]int)
+	for i := 0; i < 4; i++ {
+		msg, err := watcher.Next()
+		if err != nil {
+			t.Fatalf("зритель: %v, получено %v", err, seen)
+		}
+		seen[msg.Type]++
+	}
+	if seen[MatchStart] != 1 || seen[GameStateMsg] != 2 || seen[MatchEnd] != 1 {
+		t.Errorf("зритель получил %v", seen)
+	}
+}
+
+func TestSpectatorJoinsMidMatch(t *testing.T) {
+	audience := &Audience{}
+	first, second := testFighter("Первый", 10), testFighter("Второй", 10)
+	audience.Update(0, first, second, nil)
+	second.HP = 70
+	audience.Update(3, first, second, &RoundResult{})
+
+	conn, watcher := connectionPair(t)
+	audience.Add(conn)
+	msg, err := watcher.Next()
+	if err != nil || msg.Type != MatchStart || msg.Round != 3 || msg.Opponent.HP != 70 || msg.Result != nil {
+		t.Errorf("опоздавший зритель получил %+v, %v; ожидается снимок после раунда 3", msg, err)
+	}
+	if audience.Count() != 1 || audience.Round() != 3 {
+		t.Errorf("зрителей %d, раунд %d", audience.Count(), audience.Round())
+	}
+}
+
+func TestBroadcastDropsStuckSpectator(t *testing.T) {
+	// Зритель, который ничего не читает
+	stuckServer, stuckClient := net.Pipe()
+	defer stuckClient.Close()
+	stuck := NewConnection(stuckServer)
+	defer stuck.Close()
+
+	server, client := net.Pipe()
+	watcher := NewConnection(client)
+	defer watcher.Close()
+	live := NewConnection(server)
+	defer live.Close()
+
+	audience := &Audience{timeout: 100 * time.Millisecond}
+	audience.Add(stuck)
+	audience.Add(live)
+
+	done := make(chan struct{})
+	go func() {
+		audience.Broadcast(GameMessage{Type: MatchEnd, Text: "Конец"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("зависший зритель остановил рассылку")
+	}
+
+	if msg, err := watcher.Next(); err != nil || msg.Type != MatchEnd {
+		t.Errorf("живой зритель получил %+v, %v", msg, err)
+	}
+	if n := audience.Count(); n != 1 {
+		t.Errorf("зрителей после рассылки: %d, ожидается 1", n)
+	}
+}
+
+// promptAfterIO отвечает на вопрос только после события ready, как игрок,
+// который долго сверяет отпечаток
+type promptAfterIO struct {
+	*ScriptedIO
+	t     *testing.T
+	ready <-chan struct{}
+}
+
+func (p promptAfterIO) ReadLine() (string, error) {
+	select {
+	case <-p.ready:
+	case <-time.After(2 * time.Second):
+		p.t.Error("соединение с сервером не закрыто до вопроса о доверии")
+	}
+	return p.ScriptedIO.ReadLine()
+}
+
+func TestDialTLSTrustOnFirstUse(t *testing.T) {
+	chdirTemp(t)
+	config, fingerprint, err := serverTLSConfig(NewScriptedIO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	firstClosed := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(i int, conn net.Conn) {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				// Ждём, пока клиент закроет соединение
+				conn.Read(make([]byte, 1))
+				if i == 0 {
+					close(firstClosed)
+				}
+			}(i, conn)
+		}
+	}()
+
+	address := ln.Addr().String()
+	conn, err := dialTLS(promptAfterIO{NewScriptedIO("y"), t, firstClosed}, address)
+	if err != nil {
+		t.Fatalf("dialTLS: %v", err)
+	}
+	conn.Close()
+	if known, _ := loadKnownHosts(); known[address] != fingerprint {
+		t.Errorf("known_hosts = %v, ожидается отпечаток %s", known, fingerprint)
+	}
+
+	// Знакомый сервер подключается без вопросов
+	scripted := NewScriptedIO()
+	conn, err = dialTLS(scripted, address)
+	if err != nil {
+		t.Fatalf("повторное подключение: %v\n%s", err, scripted.Output())
+	}
+	conn.Close()
+}
+
+func TestReplayReproducesFight(t *testing.T) {
+	chdirTemp(t)
+	scripted := NewScriptedIO(fightInputs(40, "1", "0")...)
+	game := NewGameSession(scripted, testPack, 7)
+	game.Config.Record = true
+
+	player := testFighter("Игрок", 20)
+	player.Equipment = []Item{{ID: "blade", Name: "Клинок", Type: Weapon, Attack: 5,
+		Affixes: []Affix{{Kind: AffixCrit, Value: 40}}}}
+	enemy := &Enemy{
+		Name: "Гуль", HP: 80, MaxHP: 80, Mana: 30, Strength: 12,
+		Ability: testBolt, AI: RandomAI{AbilityChance: 40}, rng: game.Rand,
+	}
+	if _, err := fight(game, player, enemy); err != nil {
+		t.Fatalf("сценарий прерван: %v\n%s", err, scripted.Output())
+	}
+
+	paths, err := filepath.Glob(filepath.Join(REPLAY_DIR, "campaign-*.json"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("записи боя: %v, %v", paths, err)
+	}
+	r, err := loadReplay(testPack, paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Rounds) == 0 || r.Outcome == "" {
+		t.Fatalf("запись без раундов или итога: %+v", r)
+	}
+	crits := 0
+	for _, round := range r.Rounds {
+		if round.Sides[0].Critical {
+			crits++
+		}
+	}
+	if crits == 0 {
+		t.Error("в записи нет критических ударов, проверка их повтора ничего не даёт")
+	}
+	cursor := newReplayCursor(testPack, r)
+	for !cursor.Done() {
+		cursor.Step()
+	}
+	if cursor.diverged != 0 {
+		t.Errorf("просмотр разошёлся с записью в %d раундах из %d", cursor.diverged, len(r.Rounds))
+	}
+}
+
+func TestReplayCastsScrolls(t *testing.T) {
+	scroll := Item{ID: "scroll", Name: "Свиток", Type: Special, Effects: []ItemEffect{{Kind: EffectCast, Ability: "renewal"}}}
+	player := testFighter("Игрок", 10)
+	player.HP = 40
+	player.Inventory = []Item{scroll}
+	enemy := testFighter("Враг", 10)
+
+	r := &Replay{Version: REPLAY_VERSION, Mode: "hotseat", Fighters: [2]ReplayFighter{
+		{Player: copyPlayer(player)}, {Player: copyPlayer(enemy)},
+	}}
+	r.Rounds = []RoundResult{resolveRound(testPack, player, enemy, itemAction(0, Torso), attackAction(Head, Legs), [2]bool{})}
+
+	cursor := newReplayCursor(testPack, r)
+	cursor.Step()
+	if cursor.diverged != 0 {
+		t.Errorf("свиток в записи разыгран иначе: %+v", r.Rounds[0])
+	}
+}
+
+func TestLoadReplayValidatesActions(t *testing.T) {
+	chdirTemp(t)
+	tests := []struct {
+		name    string
+		action  CombatAction
+		wantErr string
+	}{
+		{"пропуск хода", idleAction(Legs), ""},
+		{"удар мимо тела", attackAction(BodyPart(7), Head), "часть тела"},
+		{"защита мимо тела", attackAction(Head, BodyPart(-2)), "часть тела"},
+		{"чужой предмет", itemAction(3, Head), "нет предмета"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enemy := &EnemySnapshot{Name: "Гуль", HP: 80, MaxHP: 80, Strength: 12, AI: "random",
+				Tracker: &PatternTracker{}}
+			r := Replay{Version: REPLAY_VERSION, Mode: "campaign", Fighters: [2]ReplayFighter{
+				{Player: testFighter("Игрок", 10)}, {Enemy: enemy},
+			}}
+			r.Rounds = []RoundResult{{Sides: [2]SideResult{{Action: tt.action}, {Action: attackAction(Arms, Torso)}}}}
+			data, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := fmt.Sprintf("replay-%d.json", i)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = loadReplay(testPack, path)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("loadReplay: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("loadReplay: %v, ожидается ошибка %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplaySaveKeepsEarlierRecords(t *testing.T) {
+	chdirTemp(t)
+	recorded := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	replay := func(first, second string) *Replay {
+		return &Replay{Version: REPLAY_VERSION, Mode: "hotseat", Recorded: recorded, Fighters: [2]ReplayFighter{
+			{Player: testFighter(first, 10)}, {Player: testFighter(second, 10)},
+		}}
+	}
+
+	// Три боя за одну секунду, два из них — между одними и теми же бойцами
+	paths := make(map[string]bool)
+	for _, r := range []*Replay{replay("Аня", "Боря"), replay("Аня", "Боря"), replay("Вика", "Гоша/2")} {
+		path, err := r.save()
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths[path] = true
+	}
+	if len(paths) != 3 {
+		t.Fatalf("записи сохранены в %d файлов, ожидается 3: %v", len(paths), paths)
+	}
+	for path := range paths {
+		if _, err := loadReplay(testPack, path); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+		if filepath.Dir(path) != REPLAY_DIR {
+			t.Errorf("запись %s сохранена вне %s", path, REPLAY_DIR)
+		}
+	}
+	if !paths[filepath.Join(REPLAY_DIR, "hotseat-20240501-120000-Аня-Боря-2.json")] {
+		t.Errorf("повторный бой не получил номер: %v", paths)
+	}
+}
+
+func TestSeedRepeatsSession(t *testing.T) {
+	// play проводит короткую партию и записывает всё, что решил генератор
+	play := func() []string {
+		game := NewGameSession(nil, testPack, 7)
+		var log []string
+		for i, chapter := range testPack.buildChapters(game) {
+			player := testFighter("Игрок", 10)
+			player.Equipment = []Item{{ID: "blade", Name: "Клинок", Type: Weapon,
+				Affixes: []Affix{{Kind: AffixCrit, Value: 50}}}}
+			for round := 0; round < 5; round++ {
+				action := chapter.Enemy.ChooseAction(player)
+				chapter.Enemy.Observe(attackAction(Head, Torso))
+				crits := rollCrits(game.Rand, player, chapter.Enemy)
+				log = append(log, fmt.Sprintf("%s: %+v %v", chapter.Enemy.Name, action, crits))
+			}
+			for _, item := range generateLoot(game, i+1) {
+				log = append(log, fmt.Sprintf("%s %v %+v", item.ID, item.Rarity, item.Affixes))
+			}
+		}
+		return log
+	}
+
+	first, second := play(), play()
+	if strings.Join(first, "\n") != strings.Join(second, "\n") {
+		t.Errorf("одно зерно дало разные партии:\n%v\n%v", first, second)
+	}
+}
+
+func TestHotseatCommandTakesNames(t *testing.T) {
+	chdirTemp(t)
+	inputs := []string{"n", "n"}
+	for i := 0; i < 30; i++ {
+		inputs = append(inputs, "1", "0", "1", "", "1", "3", "0", "")
+	}
+	scripted := NewScriptedIO(inputs...)
+	ok, err := runCommand(NewGameSession(scripted, testPack, 1), "hotseat", []string{"Первая", "Вторая"})
+	out := scripted.Output()
+	if err != nil {
+		t.Fatalf("сценарий прерван: %v\n%s", err, out)
+	}
+	if !ok {
+		t.Fatal("runCommand не узнал команду hotseat")
+	}
+	if strings.Contains(out, "Введите имя") {
+		t.Error("имена из командной строки не должны запрашиваться")
+	}
+	if !strings.Contains(out, "Первая VS Вторая") {
+		t.Errorf("в выводе нет начала боя:\n%s", out)
+	}
+	if ok, _ := runCommand(NewGameSession(NewScriptedIO(), testPack, 1), "hotseat", []string{"Одна"}); ok {
+		t.Error("hotseat с одним именем должен быть отклонён")
+	}
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	tests := []struct {
+		address, port, want string
+	}{
+		{"", "", "localhost:" + SERVER_PORT},
+		{"example.org", "", "example.org:" + SERVER_PORT},
+		{"example.org:9000", "", "example.org:9000"},
+		{"example.org", "9100", "example.org:9100"},
+		{"tls://example.org", "", "tls://example.org:" + SERVER_PORT},
+		{"tls://[::1]:9000", "", "tls://[::1]:9000"},
+		{"::1", "", "[::1]:" + SERVER_PORT},
+	}
+	for _, tt := range tests {
+		config := Config{Port: tt.port}
+		if got := config.withDefaultPort(tt.address); got != tt.want {
+			t.Errorf("withDefaultPort(%q) с -port=%q = %q, ожидается %q", tt.address, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		addr, port, want string
+	}{
+		{":" + SERVER_PORT, "", ":" + SERVER_PORT},
+		{":" + SERVER_PORT, "9100", ":9100"},
+		{"127.0.0.1:9000", "9100", "127.0.0.1:9100"},
+		{"[::1]:9000", "9100", "[::1]:9100"},
+		{"0.0.0.0", "9100", "0.0.0.0:9100"},
+	}
+	for _, tt := range tests {
+		config := Config{ServerAddr: tt.addr, Port: tt.port}
+		if got := config.listenAddress(); got != tt.want {
+			t.Errorf("listenAddress() с -addr=%q -port=%q = %q, ожидается %q", tt.addr, tt.port, got, tt.want)
+		}
+	}
+}
+
+// testMerchant — торговец с одним товаром в запасе stock
+func testMerchant(item Item, stock int) *Merchant {
+	return &Merchant{
+		Name:        "Торговец",
+		Items:       []Item{item},
+		Stock:       []int{stock},
+		MaxStock:    stock,
+		SellPercent: SELL_PERCENT,
+	}
+}
+
+func TestMerchantSellAndBuyBack(t *testing.T) {
+	sword := Item{ID: "sword", Name: "Меч", Type: Weapon, Attack: 10, Price: 101}
+	potion := Item{ID: "potion", Name: "Зелье", Type: Consumable, PlusHP: 10, Price: 20}
+
+	tests := []struct {
+		name        string
+		percent     int
+		inventory   []Item
+		equipment   []Item
+		sell        []int // индексы, продаваемые по очереди
+		buyBack     int   // индекс выкупа, -1 — не выкупать
+		wantGold    int
+		wantBuyBack int
+		wantItems   int
+	}{
+		{"продажа по проценту торговца", 50, []Item{sword}, nil, []int{0}, -1, 145, 1, 0},
+		{"скупщик платит больше", 80, []Item{sword}, nil, []int{0}, -1, 172, 1, 0},
+		{"продажа надетого", 50, nil, []Item{sword}, []int{0}, -1, 145, 1, 0},
+		{"бесплатный товар не покупается", 0, []Item{sword}, nil, []int{0}, -1, 100, 0, 1},
+		{"выкуп за цену продажи", 50, []Item{sword}, nil, []int{0}, 0, 100, 0, 1},
+		{"неверный индекс", 50, []Item{potion}, nil, []int{3}, -1, 100, 0, 1},
+		{"старые продажи вытесняются", 50,
+			[]Item{potion, potion, potion, potion, potion, sword}, nil,
+			[]int{5, 0, 0, 0, 0, 0}, -1, 180, BUYBACK_LIMIT, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merchant := testMerchant(sword, 1)
+			merchant.SellPercent = tt.percent
+			player := testFighter("Игрок", 10)
+			player.Gold = 100
+			player.Inventory = append([]Item(nil), tt.inventory...)
+			player.Equipment = append([]Item(nil), tt.equipment...)
+
+			ui := NewScriptedIO()
+			for _, index := range tt.sell {
+				merchant.SellItem(ui, player, index)
+			}
+			if tt.buyBack >= 0 {
+				merchant.BuyBackItem(ui, player, tt.buyBack)
+			}
+			if player.Gold != tt.wantGold {
+				t.Errorf("золото = %d, ожидается %d", player.Gold, tt.wantGold)
+			}
+			if len(merchant.BuyBack) != tt.wantBuyBack {
+				t.Errorf("к выкупу %d предметов, ожидается %d", len(merchant.BuyBack), tt.wantBuyBack)
+			}
+			if items := len(player.Inventory) + len(player.Equipment); items != tt.wantItems {
+				t.Errorf("у игрока %d предметов, ожидается %d", items, tt.wantItems)
+			}
+		})
+	}
+
+	// Вытесняется самая старая продажа: меч продан первым
+	merchant := testMerchant(sword, 1)
+	player := testFighter("Игрок", 10)
+	player.Inventory = []Item{sword, potion, potion, potion, potion, potion}
+	ui := NewScriptedIO()
+	for range player.Inventory {
+		merchant.SellItem(ui, player, 0)
+	}
+	for _, sold := range merchant.BuyBack {
+		if sold.Item.Name == sword.Name {
+			t.Error("старейшая продажа должна вытесняться первой")
+		}
+	}
+}
+
+func TestMerchantStock(t *testing.T) {
+	tests := []struct {
+		name      string
+		price     int
+		stock     int
+		inputs    []string
+		wantBuys  int
+		wantStock int
+	}{
+		{"дешёвый товар без подтверждения", 20, 3, nil, 2, 1},
+		{"запас кончается", 20, 1, nil, 1, 0},
+		{"дорогой товар с подтверждением", CONFIRM_PRICE, 3, []string{"y", "y"}, 2, 1},
+		{"отказ от дорогой покупки", CONFIRM_PRICE, 3, []string{"n", "y"}, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merchant := testMerchant(Item{Name: "Товар", Type: Consumable, Price: tt.price}, tt.stock)
+			player := testFighter("Игрок", 10)
+			player.Gold = 1000
+
+			scripted := NewScriptedIO(tt.inputs...)
+			err := merchant.BuyItem(scripted, player, 0)
+			if err == nil {
+				err = merchant.BuyItem(scripted, player, 0)
+			}
+			out := scripted.Output()
+			if err != nil {
+				t.Fatalf("сценарий прерван: %v\n%s", err, out)
+			}
+			if len(player.Inventory) != tt.wantBuys || merchant.Stock[0] != tt.wantStock {
+				t.Errorf("куплено %d, в запасе %d, ожидается %d и %d",
+					len(player.Inventory), merchant.Stock[0], tt.wantBuys, tt.wantStock)
+			}
+			if asked := strings.Contains(out, "Купить? (y/n)"); asked != (tt.price >= CONFIRM_PRICE) {
+				t.Errorf("подтверждение запрошено: %v при цене %d", asked, tt.price)
+			}
+
+			merchant.Restock()
+			if merchant.Stock[0] != tt.stock {
+				t.Errorf("после пополнения в запасе %d, ожидается %d", merchant.Stock[0], tt.stock)
+			}
+		})
+	}
+}
+
+func TestMerchantPricing(t *testing.T) {
+	sword := Item{ID: "sword", Name: "Меч", Type: Weapon, Price: 200}
+
+	tests := []struct {
+		name        string
+		supply      int
+		reputation  int
+		wantSupply  int
+		wantBuy     int
+		wantSell    int
+		wantRestock int
+	}{
+		{"обычная цена", 0, 0, 100, 200, 90, 0},
+		{"избыток дешевит товар", 3, 0, 70, 140, 60, 1},
+		{"цена не падает ниже порога", 50, 0, SUPPLY_MIN_PERCENT, 80, 40, 25},
+		{"скидка постоянному покупателю", 0, 5, 100, 180, 90, 0},
+		{"скидка не выше предела", 0, 100, 100, 200 * (100 - REPUTATION_MAX) / 100, 90, 0},
+		{"избыток и скидка вместе", 2, 5, 80, 144, 70, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merchant := testMerchant(sword, 1)
+			merchant.Supply = map[string]int{sword.ID: tt.supply}
+			merchant.Reputation = tt.reputation
+
+			if got := supplyPercent(merchant.Supply[sword.ID]); got != tt.wantSupply {
+				t.Errorf("supplyPercent = %d, ожидается %d", got, tt.wantSupply)
+			}
+			if got := merchant.BuyPrice(sword); got != tt.wantBuy {
+				t.Errorf("BuyPrice = %d, ожидается %d", got, tt.wantBuy)
+			}
+			if got := merchant.SellPrice(sword); got != tt.wantSell {
+				t.Errorf("SellPrice = %d, ожидается %d", got, tt.wantSell)
+			}
+			merchant.Restock()
+			if got := merchant.Supply[sword.ID]; got != tt.wantRestock {
+				t.Errorf("после пополнения избыток %d, ожидается %d", got, tt.wantRestock)
+			}
+		})
+	}
+
+	// Выкуп забирает предмет из избытка, покупка поднимает репутацию
+	merchant := testMerchant(sword, 1)
+	player := testFighter("Игрок", 10)
+	player.Gold = 1000
+	player.Inventory = []Item{sword, sword}
+	ui := NewScriptedIO("y")
+	merchant.SellItem(ui, player, 0)
+	merchant.SellItem(ui, player, 0)
+	merchant.BuyBackItem(ui, player, 0)
+	if err := merchant.BuyItem(ui, player, 0); err != nil {
+		t.Fatal(err)
+	}
+	if merchant.Supply[sword.ID] != 0 || merchant.Reputation != 1 {
+		t.Errorf("избыток %d, репутация %d, ожидается 0 и 1", merchant.Supply[sword.ID], merchant.Reputation)
+	}
+}
+
+func TestMerchantResaleNeverProfits(t *testing.T) {
+	sword := Item{ID: "sword", Name: "Меч", Type: Weapon, Price: 137}
+	for supply := 0; supply <= 8; supply++ {
+		for reputation := 0; reputation <= REPUTATION_MAX/REPUTATION_STEP+2; reputation++ {
+			merchant := testMerchant(sword, 1)
+			merchant.SellPercent = 100 - REPUTATION_MAX
+			merchant.Supply = map[string]int{sword.ID: supply}
+			merchant.Reputation = reputation
+			player := testFighter("Игрок", 10)
+			player.Gold = 1000
+
+			ui := NewScriptedIO("y")
+			if err := merchant.BuyItem(ui, player, 0); err != nil {
+				t.Fatal(err)
+			}
+			merchant.SellItem(ui, player, 0)
+			if player.Gold > 1000 {
+				t.Errorf("избыток %d, репутация %d: покупка и продажа принесли %d золота",
+					supply, reputation, player.Gold-1000)
+			}
+		}
+	}
+}
+
+func TestValidateMerchant(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(m *MerchantDef)
+		want   string
+	}{
+		{"без имени", func(m *MerchantDef) { m.Name = "" }, "не задано имя"},
+		{"отрицательный запас", func(m *MerchantDef) { m.Stock = -1 }, "отрицательный запас"},
+		{"доля цены выше скидки", func(m *MerchantDef) { m.SellPercent = 100 - REPUTATION_MAX + 1 }, "от 0 до 80"},
+		{"пустой прилавок", func(m *MerchantDef) { m.Items = nil }, "нечего продавать"},
+		{"неизвестный товар", func(m *MerchantDef) { m.Items = []string{"missing_item"} }, `неизвестный предмет "missing_item"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pack := defaultContentPack()
+			tt.change(&pack.Merchants[0])
+			if err := pack.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate = %v, ожидается %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestContinueCampaignKeepsMerchantStock(t *testing.T) {
+	chdirTemp(t)
+	chapter := testPack.Chapters[0]
+	merchant := testPack.merchants[chapter.Merchant]
+	// Торговец распродан к моменту сохранения
+	state := MerchantState{Stock: make([]int, len(merchant.Items))}
+	err := writeSave(1, SaveGame{
+		Chapter:   0,
+		Seed:      7,
+		Player:    testFighter("Путник", 10),
+		Merchants: map[string]MerchantState{chapter.Merchant: state},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scripted := NewScriptedIO("y", "1", "5")
+	continueCampaign(NewGameSession(scripted, testPack, 1), 1)
+	out := scripted.Output()
+	if strings.Contains(out, "(в наличии:") {
+		t.Errorf("загрузка пополнила запас торговца:\n%s", out)
+	}
+	if !strings.Contains(out, "(нет в наличии)") {
+		t.Errorf("в выводе нет распроданного товара:\n%s", out)
+	}
+	if strings.Contains(out, "Зерно партии") {
+		t.Errorf("продолжение сохранения объявляет новое зерно:\n%s", out)
+	}
+}
+
+func TestItemRarityText(t *testing.T) {
+	item := Item{ID: "blade", Name: "Клинок", Rarity: Epic, Affixes: []Affix{{Kind: AffixLifesteal, Value: 5}}}
+	data, err := json.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Rarity":"epic"`) || !strings.Contains(string(data), `"Kind":"lifesteal"`) {
+		t.Errorf("редкость и свойства не записаны по имени: %s", data)
+	}
+	var decoded Item
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Rarity != Epic || decoded.Affixes[0].Kind != AffixLifesteal {
+		t.Errorf("обратное чтение = %+v, %v", decoded, err)
+	}
+
+	for _, bad := range []string{`{"Rarity":"mythic"}`, `{"Affixes":[{"Kind":"vampirism","Value":1}]}`} {
+		if err := json.Unmarshal([]byte(bad), &decoded); err == nil {
+			t.Errorf("%s прочитан без ошибки", bad)
+		}
+	}
+
+	pack := defaultContentPack()
+	pack.Items[0].Rarity = Legendary + 1
+	pack.Items[1].Affixes = []Affix{{Kind: AffixKind(len(affixKindKeys)), Value: 1}}
+	err = pack.Validate()
+	if err == nil || !strings.Contains(err.Error(), "уровень редкости") || !strings.Contains(err.Error(), "тип свойства") {
+		t.Errorf("Validate = %v, ожидаются ошибки редкости и свойства", err)
+	}
+}
+
+func TestEquipSlotText(t *testing.T) {
+	data, err := json.Marshal(testArmor(SlotOffHand))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Slot":"off_hand"`) {
+		t.Errorf("слот не записан по имени: %s", data)
+	}
+	var item Item
+	if err := json.Unmarshal([]byte(`{"Slot":"head"}`), &item); err != nil || item.Slot != SlotHelmet {
+		t.Errorf("слот head прочитан как %v, %v", item.Slot, err)
+	}
+	if err := json.Unmarshal([]byte(`{"Slot":"tail"}`), &item); err == nil {
+		t.Error("неизвестный слот прочитан без ошибки")
+	}
+
+	tests := []struct {
+		name string
+		item Item
+		want string
+	}{
+		{"оружие на голове", Item{Type: Weapon, Slot: SlotHelmet}, "оружие держат только в руках"},
+		{"броня в правой руке", Item{Type: Armor, Slot: SlotMainHand}, "броню нельзя взять в правую руку"},
+		{"слот у расходника", Item{Type: Consumable, Slot: SlotRing}, "слот задаётся только оружию и броне"},
+		{"неизвестный слот", Item{Type: Armor, Slot: SlotRing + 1}, "неизвестный слот"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pack := defaultContentPack()
+			tt.item.ID, tt.item.Name = "test_item", "Проверка"
+			pack.Items = append(pack.Items, tt.item)
+			if err := pack.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate = %v, ожидается %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCampaignFightUsesItems(t *testing.T) {
+	chdirTemp(t)
+	// Дымовая шашка, затем свиток приговора (он сдвигается на место шашки)
+	inputs := []string{"5", "0", "0", "", "5", "0", "0", ""}
+	inputs = append(inputs, fightInputs(40, "1", "0")...)
+	scripted := NewScriptedIO(inputs...)
+	game := NewGameSession(scripted, testPack, 7)
+	enemy := testPack.buildChapters(game)[0].Enemy
+	player := testFighter("Инквизитор", 40)
+	player.Inventory = []Item{testPack.items["smoke_bomb"], testPack.items["scroll_of_verdict"]}
+
+	_, err := fight(game, player, enemy)
+	out := scripted.Output()
+	if err != nil {
+		t.Fatalf("сценарий прерван: %v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"5 - Использовать предмет",
+		"Инквизитор использует Дымовая шашка!",
+		enemy.Name + " теряет раундов: 1!",
+		"Инквизитор использует Свиток приговора!",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("в выводе нет %q", want)
+		}
+	}
+	if len(player.Inventory) != 0 {
+		t.Errorf("предметы не потрачены: %v", player.Inventory)
+	}
+}
+
+func TestCampaignCountsPlayedChapters(t *testing.T) {
+	chdirTemp(t)
+	// Запертая глава впереди первой: без ключа игрок её пропускает
+	pack := defaultContentPack()
+	var locked ChapterDef
+	for _, chapter := range pack.Chapters {
+		if chapter.Locked {
+			locked = chapter
+		}
+	}
+	pack.Chapters = []ChapterDef{locked, pack.Chapters[0]}
+	validated := mustValidate(pack)
+
+	if story := validated.storyLength(); story != 1 {
+		t.Errorf("storyLength = %d, ожидается 1", story)
+	}
+
+	inputs := append([]string{"n", "n", ""}, fightInputs(40, "1", "0")...)
+	scripted := NewScriptedIO(inputs...)
+	err := startCampaign(NewGameSession(scripted, validated, 7), "Инквизитор")
+	out := scripted.Output()
+	if err != nil {
+		t.Fatalf("сценарий прерван: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "запертой двери") || !strings.Contains(out, "=== ГЛАВА 1 ===") {
+		t.Errorf("первая сыгранная глава должна иметь номер 1:\n%s", out)
+	}
+	if strings.Contains(out, "=== ГЛАВА 2 ===") {
+		t.Error("пропущенная запертая глава учтена в номере")
+	}
+}
+
+func TestUseSpecial(t *testing.T) {
+	scroll := Item{ID: "scroll", Name: "Свиток", Type: Special, Effects: []ItemEffect{{Kind: EffectCast, Ability: "renewal"}}}
+	smoke := Item{ID: "smoke", Name: "Дымовая шашка", Type: Special, Effects: []ItemEffect{{Kind: EffectSmoke, Value: 2}}}
+	charm := Item{ID: "charm", Name: "Оберег", Type: Special, Effects: []ItemEffect{{Kind: EffectRevive, Value: 30}}}
+
+	tests := []struct {
+		name      string
+		item      Item
+		inBattle  bool
+		wantUsed  bool
+		wantStun  int
+		wantMana  int
+		wantWords string
+	}{
+		{"свиток применяет способность без маны", scroll, true, true, 0, 50, "использует Свиток"},
+		{"свиток вне боя не тратится", scroll, false, false, 0, 50, "только в бою"},
+		{"дым оглушает противника", smoke, true, true, 2, 50, "теряет раундов: 2"},
+		{"оберег срабатывает сам", charm, true, false, 0, 50, "сработает сам"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			player := testFighter("Игрок", 10)
+			player.Inventory = []Item{tt.item}
+			enemy := testFighter("Враг", 10)
+			var target Character
+			if tt.inBattle {
+				target = enemy
+			}
+
+			text := player.useSpecial(testPack, 0, target)
+			if used := len(player.Inventory) == 0; used != tt.wantUsed {
+				t.Errorf("предмет потрачен: %v, ожидается %v", used, tt.wantUsed)
+			}
+			stun := 0
+			for _, effect := range enemy.Effects {
+				if effect.Stun {
+					stun = effect.Duration
+				}
+			}
+			if stun != tt.wantStun || player.Mana != tt.wantMana {
+				t.Errorf("оглушение %d, мана %d, ожидается %d и %d", stun, player.Mana, tt.wantStun, tt.wantMana)
+			}
+			if !strings.Contains(text, tt.wantWords) {
+				t.Errorf("useSpecial = %q, ожидается %q", text, tt.wantWords)
+			}
+		})
+	}
+
+	// Свиток берёт способность из набора своей партии, а не из встроенного
+	pack := defaultContentPack()
+	pack.Abilities = append(pack.Abilities, testBolt)
+	custom := mustValidate(pack)
+	bolt := Item{ID: "bolt_scroll", Name: "Свиток молнии", Type: Special, Effects: []ItemEffect{{Kind: EffectCast, Ability: testBolt.ID}}}
+	for _, tt := range []struct {
+		pack     *ContentPack
+		wantUsed bool
+	}{
+		{custom, true},
+		{testPack, false},
+	} {
+		player := testFighter("Игрок", 10)
+		player.Inventory = []Item{bolt}
+		enemy := testFighter("Враг", 10)
+		text := player.useSpecial(tt.pack, 0, enemy)
+		used, hit := len(player.Inventory) == 0, enemy.HP < enemy.MaxHP
+		if used != tt.wantUsed || hit != tt.wantUsed {
+			t.Errorf("свиток молнии: потрачен %v, враг ранен %v, ожидается %v (%q)", used, hit, tt.wantUsed, text)
+		}
+	}
+
+	player := testFighter("Игрок", 10)
+	player.Inventory = []Item{charm}
+	if text := player.tryRevive(); player.HP != 30 || len(player.Inventory) != 0 || text == "" {
+		t.Errorf("tryRevive: HP %d, инвентарь %v, %q", player.HP, player.Inventory, text)
+	}
+	if text := player.tryRevive(); text != "" {
+		t.Errorf("воскрешение без оберега: %q", text)
+	}
+
+	// Оберег в бою не предлагается вместо хода: игрок выбирает заново
+	player.Inventory = []Item{charm}
+	scripted := NewScriptedIO("5", "0", "1", "0", "1")
+	action, err := promptCombatAction(scripted, testPack, player, nil)
+	if err != nil || action != attackAction(Head, Torso) {
+		t.Errorf("promptCombatAction = %+v, %v; ожидается удар", action, err)
+	}
+	if !strings.Contains(scripted.Output(), "срабатывает сам") || len(player.Inventory) != 1 {
+		t.Errorf("оберег принят как ход:\n%s", scripted.Output())
+	}
+}
+
+func TestItemEffectText(t *testing.T) {
+	effect := ItemEffect{Kind: EffectCast, Ability: "renewal"}
+	data, err := json.Marshal(effect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Kind":"cast"`) {
+		t.Errorf("вид действия не записан по имени: %s", data)
+	}
+	var decoded ItemEffect
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded != effect {
+		t.Errorf("обратное чтение = %+v, %v", decoded, err)
+	}
+	if err := json.Unmarshal([]byte(`{"Kind":"teleport"}`), &decoded); err == nil {
+		t.Error("неизвестный вид действия прочитан без ошибки")
+	}
+	if got := effect.Describe("Обновление"); got != "«Обновление» без маны" {
+		t.Errorf("Describe = %q", got)
+	}
+
+	pack := defaultContentPack()
+	for i, item := range pack.Items {
+		if item.Type == Special {
+			pack.Items[i].Effects = []ItemEffect{{Kind: EffectUnlock + 1}}
+			break
+		}
+	}
+	if err := pack.Validate(); err == nil || !strings.Contains(err.Error(), "неизвестный вид действия") {
+		t.Errorf("Validate = %v, ожидается ошибка вида действия", err)
+	}
+}
\ No newline at end of file